@@ -17,10 +17,14 @@ package v2
 import (
 	"errors"
 	"fmt"
+	"github.com/sequix/grok_exporter/tailer/jsonpath"
 	"github.com/sequix/grok_exporter/template"
 	"gopkg.in/natefinch/lumberjack.v2"
 	"gopkg.in/yaml.v2"
 	"os"
+	"path"
+	"reflect"
+	"regexp"
 	"strings"
 	"time"
 )
@@ -32,9 +36,21 @@ const (
 	defaultPositionSyncIntervcal  = 500 * time.Millisecond
 	defaultPollInterval           = 500 * time.Millisecond
 	defaultRetentionCheckInterval = 60 * time.Second
+	defaultMatchingWorkers        = 1
+	defaultMultilineMaxLines      = 500
+	defaultMultilineMaxWait       = time.Second
 	inputTypeStdin                = "stdin"
 	inputTypeFile                 = "file"
 	inputTypeWebhook              = "webhook"
+	inputTypeSyslog               = "syslog"
+	inputTypeKubernetes           = "kubernetes"
+	inputTypeJournald             = "journald"
+	defaultKubernetesLogPath      = "/var/log/containers/*.log"
+	defaultJournaldSource         = "journalctl"
+	defaultJournaldCommand        = "journalctl"
+	defaultWebhookMaxBodySize     = 10 * 1024 * 1024
+	defaultWebhookQueueSize       = 10000
+	defaultWebhookQueueTimeout    = 5 * time.Second
 )
 
 func Unmarshal(config []byte) (*Config, error) {
@@ -53,6 +69,7 @@ func Unmarshal(config []byte) (*Config, error) {
 type Config struct {
 	Global    GlobalConfig      `yaml:",omitempty"`
 	Input     InputConfig       `yaml:",omitempty"`
+	Inputs    []InputConfig     `yaml:",omitempty"` // several inputs in one process, cannot be combined with Input
 	Grok      GrokConfig        `yaml:",omitempty"`
 	Metrics   MetricsConfig     `yaml:",omitempty"`
 	Server    ServerConfig      `yaml:",omitempty"`
@@ -64,24 +81,50 @@ type GlobalConfig struct {
 	LogLevel               string        `yaml:"log_level,omitempty"`
 	LogTo                  string        `yaml:"log_to,omitempty"`
 	RetentionCheckInterval time.Duration `yaml:"retention_check_interval,omitempty"` // implicitly parsed with time.ParseDuration()
+	MatchingWorkers        int           `yaml:"matching_workers,omitempty"`
 }
 
 type InputConfig struct {
-	CollectMode              string        `yaml:"collectMode,omitempty"`
-	Type                     string        `yaml:",omitempty"`
-	Path                     []string      `yaml:",omitempty"`
-	Excludes                 []string      `yaml:",omitempty"`
-	PositionFile             string        `yaml:"position_file,omitempty"`
-	SyncInterval             time.Duration `yaml:"position_sync_interval,omitempty"`
-	PollInterval             time.Duration `yaml:"poll_interval,omitempty"`
-	MaxLinesInBuffer         int           `yaml:"max_lines_in_buffer,omitempty"`
-	MaxLineSize              int           `yaml:"max_line_size,omitempty"`
-	MaxLinesRatePerFile      uint16        `yaml:"max_lines_rate_per_file,omitempty"`
-	IdleTimeout              time.Duration `yaml:"idle_timeout,omitempty"`
-	WebhookPath              string        `yaml:"webhook_path,omitempty"`
-	WebhookFormat            string        `yaml:"webhook_format,omitempty"`
-	WebhookJsonSelector      string        `yaml:"webhook_json_selector,omitempty"`
-	WebhookTextBulkSeparator string        `yaml:"webhook_text_bulk_separator,omitempty"`
+	Name                     string            `yaml:",omitempty"` // defaults to the type, used as value of the input label
+	CollectMode              string            `yaml:"collectMode,omitempty"`
+	Type                     string            `yaml:",omitempty"`
+	Path                     []string          `yaml:",omitempty"`
+	Excludes                 []string          `yaml:",omitempty"`
+	PositionFile             string            `yaml:"position_file,omitempty"`
+	SyncInterval             time.Duration     `yaml:"position_sync_interval,omitempty"`
+	PollInterval             time.Duration     `yaml:"poll_interval,omitempty"`
+	MaxLinesInBuffer         int               `yaml:"max_lines_in_buffer,omitempty"`
+	BufferOverflow           string            `yaml:"buffer_overflow,omitempty"` // drop (default), spill, or block, what happens when max_lines_in_buffer is reached
+	BufferSpillDirectory     string            `yaml:"buffer_spill_directory,omitempty"`
+	BufferSpillMaxSize       int64             `yaml:"buffer_spill_max_size,omitempty"` // in bytes, 0 means unlimited
+	MaxLineSize              int               `yaml:"max_line_size,omitempty"`
+	MaxLinesRatePerFile      uint16            `yaml:"max_lines_rate_per_file,omitempty"`
+	IdleTimeout              time.Duration     `yaml:"idle_timeout,omitempty"`
+	WebhookPath              string            `yaml:"webhook_path,omitempty"`
+	WebhookFormat            string            `yaml:"webhook_format,omitempty"`
+	WebhookJsonSelector      string            `yaml:"webhook_json_selector,omitempty"`
+	WebhookTextBulkSeparator string            `yaml:"webhook_text_bulk_separator,omitempty"`
+	WebhookBearerToken       string            `yaml:"webhook_bearer_token,omitempty"`
+	WebhookBasicAuthUsername string            `yaml:"webhook_basic_auth_username,omitempty"`
+	WebhookBasicAuthPassword string            `yaml:"webhook_basic_auth_password,omitempty"`
+	WebhookMaxBodySize       int64             `yaml:"webhook_max_body_size,omitempty"` // in bytes, applies to the compressed and the decompressed body
+	WebhookFields            map[string]string `yaml:"webhook_fields,omitempty"`        // field name -> Loki stream label or path in Elasticsearch documents
+	WebhookQueueSize         int               `yaml:"webhook_queue_size,omitempty"`    // number of lines received but not processed yet
+	WebhookQueueTimeout      time.Duration     `yaml:"webhook_queue_timeout,omitempty"` // how long a request waits for space in the queue before it is rejected
+	SyslogUdpAddress         string            `yaml:"syslog_udp_address,omitempty"`
+	SyslogTcpAddress         string            `yaml:"syslog_tcp_address,omitempty"`
+	KubernetesMetadataFile   string            `yaml:"kubernetes_metadata_file,omitempty"` // JSON list of pods, like the output of the kubelet's /pods endpoint
+	JournaldSource           string            `yaml:"journald_source,omitempty"`          // journalctl (default) or stdin
+	JournaldCommand          string            `yaml:"journald_command,omitempty"`
+	JournaldDirectory        string            `yaml:"journald_directory,omitempty"` // read journal files from this directory instead of the system journal
+	Multiline                *MultilineConfig  `yaml:",omitempty"`
+}
+
+type MultilineConfig struct {
+	Start    string        `yaml:",omitempty"`
+	Continue string        `yaml:",omitempty"`
+	MaxLines int           `yaml:"max_lines,omitempty"`
+	MaxWait  time.Duration `yaml:"max_wait,omitempty"` // implicitly parsed with time.ParseDuration()
 }
 
 type GrokConfig struct {
@@ -94,9 +137,16 @@ type MetricConfig struct {
 	Name                 string              `yaml:",omitempty"`
 	Path                 []string            `yaml:",omitempty"`
 	Excludes             []string            `yaml:",omitempty"`
+	PathMatch            string              `yaml:"path_match,omitempty"` // regular expression with named groups extracting template fields from the file path
+	Inputs               []string            `yaml:",omitempty"`           // names of the inputs, empty means all inputs
 	Help                 string              `yaml:",omitempty"`
+	Format               string              `yaml:",omitempty"` // grok (default), json, or logfmt
 	Match                string              `yaml:",omitempty"`
-	Retention            time.Duration       `yaml:",omitempty"` // implicitly parsed with time.ParseDuration()
+	Fields               map[string]string   `yaml:",omitempty"` // field name -> path, for structured formats
+	Filter               *FilterConfig       `yaml:",omitempty"`
+	Retention            time.Duration       `yaml:",omitempty"`                  // implicitly parsed with time.ParseDuration()
+	MaxSeries            int                 `yaml:"max_series,omitempty"`        // maximum number of label combinations, 0 means no limit
+	MaxSeriesPolicy      string              `yaml:"max_series_policy,omitempty"` // drop (default), evict, or overflow
 	Value                string              `yaml:",omitempty"`
 	Cumulative           bool                `yaml:",omitempty"`
 	Buckets              []float64           `yaml:",flow,omitempty"`
@@ -107,6 +157,16 @@ type MetricConfig struct {
 	DeleteMatch          string              `yaml:"delete_match,omitempty"`
 	DeleteLabels         map[string]string   `yaml:"delete_labels,omitempty"` // TODO: Make sure that DeleteMatch is not nil if DeleteLabels are used.
 	DeleteLabelTemplates []template.Template `yaml:"-"`                       // parsed version of DeleteLabels, will not be serialized to yaml.
+	Exemplar             map[string]string   `yaml:",omitempty"`              // exemplar labels like the trace id, for counters and histograms
+	ExemplarTemplates    []template.Template `yaml:"-"`                       // parsed version of Exemplar, will not be serialized to yaml.
+}
+
+// Literal checks evaluated before the match pattern.
+type FilterConfig struct {
+	Contains    []string          `yaml:",omitempty"`             // the line must contain all of these
+	NotContains []string          `yaml:"not_contains,omitempty"` // the line must contain none of these
+	Prefix      []string          `yaml:",omitempty"`             // the line must start with one of these
+	Fields      map[string]string `yaml:",omitempty"`             // field name -> shell pattern, the input fields must match all of these
 }
 
 type MetricsConfig []MetricConfig
@@ -120,15 +180,30 @@ type ServerConfig struct {
 	Key      string `yaml:",omitempty"`
 }
 
-func (cfg *Config) LoadEnvironments() {
-	path := cfg.Input.Path
-	for i := range path {
-		path[i] = os.ExpandEnv(path[i])
+// The configured inputs, i.e. the 'inputs' list, or the single 'input' if the list is empty.
+func (cfg *Config) AllInputs() []*InputConfig {
+	if len(cfg.Inputs) == 0 {
+		return []*InputConfig{&cfg.Input}
 	}
+	result := make([]*InputConfig, 0, len(cfg.Inputs))
+	for i := range cfg.Inputs {
+		result = append(result, &cfg.Inputs[i])
+	}
+	return result
+}
 
-	excludes := cfg.Input.Excludes
-	for i := range excludes {
-		excludes[i] = os.ExpandEnv(excludes[i])
+func (cfg *Config) LoadEnvironments() {
+	for _, input := range cfg.AllInputs() {
+		for i := range input.Path {
+			input.Path[i] = os.ExpandEnv(input.Path[i])
+		}
+		for i := range input.Excludes {
+			input.Excludes[i] = os.ExpandEnv(input.Excludes[i])
+		}
+		input.PositionFile = os.ExpandEnv(input.PositionFile)
+		input.BufferSpillDirectory = os.ExpandEnv(input.BufferSpillDirectory)
+		input.WebhookBearerToken = os.ExpandEnv(input.WebhookBearerToken)
+		input.WebhookBasicAuthPassword = os.ExpandEnv(input.WebhookBasicAuthPassword)
 	}
 
 	for i := range cfg.Metrics {
@@ -140,12 +215,13 @@ func (cfg *Config) LoadEnvironments() {
 			m.Excludes[j] = os.ExpandEnv(p)
 		}
 	}
-	cfg.Input.PositionFile = os.ExpandEnv(cfg.Input.PositionFile)
 }
 
 func (cfg *Config) addDefaults() {
 	cfg.Global.addDefaults()
-	cfg.Input.addDefaults()
+	for _, input := range cfg.AllInputs() {
+		input.addDefaults()
+	}
 	cfg.Grok.addDefaults()
 	if cfg.Metrics == nil {
 		cfg.Metrics = MetricsConfig(make([]MetricConfig, 0))
@@ -161,6 +237,9 @@ func (c *GlobalConfig) addDefaults() {
 	if c.RetentionCheckInterval == 0 {
 		c.RetentionCheckInterval = defaultRetentionCheckInterval
 	}
+	if c.MatchingWorkers == 0 {
+		c.MatchingWorkers = defaultMatchingWorkers
+	}
 	if c.LogLevel == "" {
 		c.LogLevel = defaultLogLevel
 	}
@@ -179,7 +258,18 @@ func (c *InputConfig) addDefaults() {
 	switch c.Type {
 	case "", inputTypeStdin:
 		c.Type = inputTypeStdin
-	case inputTypeFile:
+	case inputTypeFile, inputTypeKubernetes, inputTypeJournald:
+		if c.Type == inputTypeKubernetes && len(c.Path) == 0 {
+			c.Path = []string{defaultKubernetesLogPath}
+		}
+		if c.Type == inputTypeJournald {
+			if len(c.JournaldSource) == 0 {
+				c.JournaldSource = defaultJournaldSource
+			}
+			if len(c.JournaldCommand) == 0 {
+				c.JournaldCommand = defaultJournaldCommand
+			}
+		}
 		if c.PositionFile == "" {
 			c.PositionFile = defaultPositionsFile
 		}
@@ -199,6 +289,30 @@ func (c *InputConfig) addDefaults() {
 		if len(c.WebhookTextBulkSeparator) == 0 {
 			c.WebhookTextBulkSeparator = "\n\n"
 		}
+		if c.WebhookMaxBodySize == 0 {
+			c.WebhookMaxBodySize = defaultWebhookMaxBodySize
+		}
+		if c.WebhookQueueSize == 0 {
+			c.WebhookQueueSize = defaultWebhookQueueSize
+		}
+		if c.WebhookQueueTimeout == 0 {
+			c.WebhookQueueTimeout = defaultWebhookQueueTimeout
+		}
+	}
+	if c.Multiline != nil {
+		c.Multiline.addDefaults()
+	}
+	if len(c.Name) == 0 {
+		c.Name = c.Type
+	}
+}
+
+func (c *MultilineConfig) addDefaults() {
+	if c.MaxLines == 0 {
+		c.MaxLines = defaultMultilineMaxLines
+	}
+	if c.MaxWait == 0 {
+		c.MaxWait = defaultMultilineMaxWait
 	}
 }
 
@@ -219,7 +333,11 @@ func (c *ServerConfig) addDefaults() {
 }
 
 func (cfg *Config) validate() error {
-	err := cfg.Input.validate()
+	err := cfg.Global.validate()
+	if err != nil {
+		return err
+	}
+	err = cfg.validateInputs()
 	if err != nil {
 		return err
 	}
@@ -238,6 +356,85 @@ func (cfg *Config) validate() error {
 	return nil
 }
 
+func (cfg *Config) validateInputs() error {
+	if len(cfg.Inputs) > 0 && !reflect.DeepEqual(cfg.Input, InputConfig{}) {
+		return fmt.Errorf("invalid input configuration: 'input' and 'inputs' cannot be used together")
+	}
+	names := make(map[string]bool)
+	positionFiles := make(map[string]string)
+	spillDirectories := make(map[string]string)
+	webhookPaths := make(map[string]bool)
+	nStdin := 0
+	for _, input := range cfg.AllInputs() {
+		err := input.validate()
+		if err != nil {
+			return err
+		}
+		if names[input.Name] {
+			return fmt.Errorf("invalid input configuration: input name '%v' is used twice", input.Name)
+		}
+		names[input.Name] = true
+		if input.Type == inputTypeStdin || input.Type == inputTypeJournald && input.JournaldSource == "stdin" {
+			nStdin++
+		}
+		if input.Type == inputTypeWebhook {
+			paths := []string{input.WebhookPath}
+			if input.WebhookFormat == "elasticsearch_bulk" {
+				// Elasticsearch clients append /_bulk to the configured path.
+				paths = append(paths, strings.TrimSuffix(input.WebhookPath, "/")+"/_bulk")
+			}
+			for _, path := range paths {
+				if webhookPaths[path] {
+					return fmt.Errorf("invalid input configuration: 'input.webhook_path' %v is used twice", path)
+				}
+				webhookPaths[path] = true
+			}
+		}
+		if input.usesPositionFile() {
+			if other, exists := positionFiles[input.PositionFile]; exists {
+				return fmt.Errorf("invalid input configuration: inputs '%v' and '%v' use the same 'input.position_file' %v", other, input.Name, input.PositionFile)
+			}
+			positionFiles[input.PositionFile] = input.Name
+		}
+		if input.BufferOverflow == "spill" {
+			if other, exists := spillDirectories[input.BufferSpillDirectory]; exists {
+				return fmt.Errorf("invalid input configuration: inputs '%v' and '%v' use the same 'input.buffer_spill_directory' %v", other, input.Name, input.BufferSpillDirectory)
+			}
+			spillDirectories[input.BufferSpillDirectory] = input.Name
+		}
+	}
+	if nStdin > 1 {
+		return fmt.Errorf("invalid input configuration: only one input can read from stdin")
+	}
+	for _, metric := range cfg.Metrics {
+		for _, name := range metric.Inputs {
+			if !names[name] {
+				return fmt.Errorf("Invalid metric configuration: metric '%v' uses input '%v', which is not defined.", metric.Name, name)
+			}
+		}
+	}
+	return nil
+}
+
+// Inputs that store their read positions in PositionFile.
+func (c *InputConfig) usesPositionFile() bool {
+	switch c.Type {
+	case inputTypeFile, inputTypeKubernetes:
+		return true
+	case inputTypeJournald:
+		return c.JournaldSource != "stdin"
+	default:
+		return false
+	}
+}
+
+func (c *GlobalConfig) validate() error {
+	if c.MatchingWorkers < 0 {
+		return fmt.Errorf("Invalid 'global.matching_workers': '%v'. Expecting a positive number.", c.MatchingWorkers)
+	}
+	return nil
+}
+
 func (c *InputConfig) validate() error {
 	switch {
 	case c.Type == inputTypeStdin:
@@ -247,27 +444,31 @@ func (c *InputConfig) validate() error {
 		if c.PollInterval != 0 {
 			return fmt.Errorf("invalid input configuration: cannot use 'input.poll_interval_seconds' when 'input.type' is stdin")
 		}
-	case c.Type == inputTypeFile:
+	case c.Type == inputTypeFile || c.Type == inputTypeKubernetes:
 		if len(c.Path) == 0 {
-			return fmt.Errorf("invalid input configuration: 'input.path' is required for input type \"file\"")
+			return fmt.Errorf("invalid input configuration: 'input.path' is required for input type \"%v\"", c.Type)
 		}
-		if c.PollInterval > 0 {
-			if c.MaxLinesRatePerFile != 0 {
-				return fmt.Errorf("cannot limit input speed when using poller")
-			}
+		if c.Type == inputTypeFile && len(c.KubernetesMetadataFile) > 0 {
+			return fmt.Errorf("invalid input configuration: 'input.kubernetes_metadata_file' can only be used for input type \"kubernetes\"")
 		}
-		fi, err := os.Stat(c.PositionFile)
-		if err != nil {
-			if !os.IsNotExist(err) {
-				return err
+		if err := c.validatePositionFile(); err != nil {
+			return err
+		}
+	case c.Type == inputTypeJournald:
+		if len(c.Path) > 0 {
+			return fmt.Errorf("invalid input configuration: cannot use 'input.path' when 'input.type' is journald")
+		}
+		switch c.JournaldSource {
+		case "stdin":
+			if len(c.JournaldDirectory) > 0 {
+				return fmt.Errorf("invalid input configuration: cannot use 'input.journald_directory' when 'input.journald_source' is stdin")
 			}
-		} else {
-			if fi.IsDir() {
-				return errors.New("expected a file for position_file")
+		case "journalctl":
+			if err := c.validatePositionFile(); err != nil {
+				return err
 			}
-		}
-		if c.SyncInterval < time.Second {
-			return errors.New("expected sync_interval more than 1s")
+		default:
+			return fmt.Errorf("invalid input configuration: 'input.journald_source' must be \"journalctl|stdin\"")
 		}
 	case c.Type == inputTypeWebhook:
 		if c.WebhookPath == "" {
@@ -275,20 +476,115 @@ func (c *InputConfig) validate() error {
 		} else if c.WebhookPath[0] != '/' {
 			return fmt.Errorf("invalid input configuration: 'input.webhook_path' must start with \"/\"")
 		}
-		if c.WebhookFormat != "text_single" && c.WebhookFormat != "text_bulk" && c.WebhookFormat != "json_single" && c.WebhookFormat != "json_bulk" {
-			return fmt.Errorf("invalid input configuration: 'input.webhook_format' must be \"text_single|text_bulk|json_single|json_bulk\"")
+		switch c.WebhookFormat {
+		case "text_single", "text_bulk", "json_single", "json_bulk":
+			if len(c.WebhookFields) > 0 {
+				return fmt.Errorf("invalid input configuration: 'input.webhook_fields' can only be used with webhook_format \"loki|elasticsearch_bulk\"")
+			}
+		case "loki", "elasticsearch_bulk":
+			for name, path := range c.WebhookFields {
+				if name == "" || path == "" {
+					return fmt.Errorf("invalid input configuration: 'input.webhook_fields' must not contain empty field names or paths")
+				}
+			}
+		default:
+			return fmt.Errorf("invalid input configuration: 'input.webhook_format' must be \"text_single|text_bulk|json_single|json_bulk|loki|elasticsearch_bulk\"")
 		}
 		if c.WebhookJsonSelector == "" {
 			return fmt.Errorf("invalid input configuration: 'input.webhook_json_selector' is required for input type \"webhook\"")
-		} else if c.WebhookJsonSelector[0] != '.' {
-			return fmt.Errorf("invalid input configuration: 'input.webhook_json_selector' must start with \".\"")
+		} else if _, err := jsonpath.Parse(c.WebhookJsonSelector); err != nil {
+			return fmt.Errorf("invalid input configuration: 'input.webhook_json_selector' %v", err)
 		}
 		if c.WebhookFormat == "text_bulk" && c.WebhookTextBulkSeparator == "" {
 			return fmt.Errorf("invalid input configuration: 'input.webhook_text_bulk_separator' is required for input type \"webhook\" and webhook_format \"text_bulk\"")
 		}
+		if c.WebhookBearerToken != "" && (c.WebhookBasicAuthUsername != "" || c.WebhookBasicAuthPassword != "") {
+			return fmt.Errorf("invalid input configuration: 'input.webhook_bearer_token' and 'input.webhook_basic_auth_username' cannot be used together")
+		}
+		if (c.WebhookBasicAuthUsername == "") != (c.WebhookBasicAuthPassword == "") {
+			return fmt.Errorf("invalid input configuration: 'input.webhook_basic_auth_username' and 'input.webhook_basic_auth_password' must be configured together")
+		}
+		if c.WebhookMaxBodySize < 0 {
+			return fmt.Errorf("invalid input configuration: 'input.webhook_max_body_size' must not be negative")
+		}
+		if c.WebhookQueueSize < 0 {
+			return fmt.Errorf("invalid input configuration: 'input.webhook_queue_size' must not be negative")
+		}
+		if c.WebhookQueueTimeout < 0 {
+			return fmt.Errorf("invalid input configuration: 'input.webhook_queue_timeout' must not be negative")
+		}
+	case c.Type == inputTypeSyslog:
+		if c.SyslogUdpAddress == "" && c.SyslogTcpAddress == "" {
+			return fmt.Errorf("invalid input configuration: one of 'input.syslog_udp_address' and 'input.syslog_tcp_address' is required for input type \"syslog\"")
+		}
 	default:
 		return fmt.Errorf("unsupported 'input.type': %v", c.Type)
 	}
+	if err := c.validateBuffer(); err != nil {
+		return err
+	}
+	if c.Multiline != nil {
+		return c.Multiline.validate()
+	}
+	return nil
+}
+
+func (c *InputConfig) validatePositionFile() error {
+	fi, err := os.Stat(c.PositionFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+	} else {
+		if fi.IsDir() {
+			return errors.New("expected a file for position_file")
+		}
+	}
+	if c.SyncInterval < time.Second {
+		return errors.New("expected sync_interval more than 1s")
+	}
+	return nil
+}
+
+func (c *InputConfig) validateBuffer() error {
+	if c.MaxLinesInBuffer < 0 {
+		return fmt.Errorf("invalid input configuration: 'input.max_lines_in_buffer' must not be negative")
+	}
+	switch c.BufferOverflow {
+	case "", "drop":
+		if c.BufferSpillDirectory != "" || c.BufferSpillMaxSize != 0 {
+			return fmt.Errorf("invalid input configuration: 'input.buffer_spill_directory' and 'input.buffer_spill_max_size' can only be used with buffer_overflow \"spill\"")
+		}
+		return nil
+	case "spill":
+		if c.BufferSpillDirectory == "" {
+			return fmt.Errorf("invalid input configuration: 'input.buffer_spill_directory' is required for buffer_overflow \"spill\"")
+		}
+		if c.BufferSpillMaxSize < 0 {
+			return fmt.Errorf("invalid input configuration: 'input.buffer_spill_max_size' must not be negative")
+		}
+	case "block":
+		if c.BufferSpillDirectory != "" || c.BufferSpillMaxSize != 0 {
+			return fmt.Errorf("invalid input configuration: 'input.buffer_spill_directory' and 'input.buffer_spill_max_size' can only be used with buffer_overflow \"spill\"")
+		}
+	default:
+		return fmt.Errorf("invalid input configuration: 'input.buffer_overflow' must be \"drop|spill|block\"")
+	}
+	if c.MaxLinesInBuffer == 0 {
+		return fmt.Errorf("invalid input configuration: 'input.buffer_overflow' %q requires 'input.max_lines_in_buffer'", c.BufferOverflow)
+	}
+	return nil
+}
+
+func (c *MultilineConfig) validate() error {
+	switch {
+	case c.Start == "" && c.Continue == "":
+		return fmt.Errorf("invalid input configuration: one of 'input.multiline.start' and 'input.multiline.continue' must be configured")
+	case c.MaxLines < 0:
+		return fmt.Errorf("invalid input configuration: 'input.multiline.max_lines' must not be negative")
+	case c.MaxWait < 0:
+		return fmt.Errorf("invalid input configuration: 'input.multiline.max_wait' must not be negative")
+	}
 	return nil
 }
 
@@ -326,26 +622,58 @@ func (c *MetricConfig) validate() error {
 		return fmt.Errorf("Invalid metric configuration: 'metrics.name' must not be empty.")
 	case c.Help == "":
 		return fmt.Errorf("Invalid metric configuration: 'metrics.help' must not be empty.")
-	case c.Match == "":
-		return fmt.Errorf("Invalid metric configuration: 'metrics.match' must not be empty.")
 	}
-	var hasValue, cumulativeAllowed, bucketsAllowed, quantilesAllowed bool
+	switch c.Format {
+	case "", "grok":
+		if c.Match == "" {
+			return fmt.Errorf("Invalid metric configuration: 'metrics.match' must not be empty.")
+		}
+		if len(c.Fields) > 0 {
+			return fmt.Errorf("Invalid metric configuration: 'metrics.fields' cannot be used for format grok, use named grok fields in 'metrics.match' instead.")
+		}
+	case "json":
+		if c.Match != "" {
+			return fmt.Errorf("Invalid metric configuration: 'metrics.match' cannot be used for format %v.", c.Format)
+		}
+		if len(c.Fields) == 0 {
+			return fmt.Errorf("Invalid metric configuration: 'metrics.fields' must not be empty for format %v.", c.Format)
+		}
+		for name, path := range c.Fields {
+			if name == "" || path == "" {
+				return fmt.Errorf("Invalid metric configuration: 'metrics.fields' must not contain empty field names or paths.")
+			}
+		}
+	case "logfmt":
+		if c.Match != "" {
+			return fmt.Errorf("Invalid metric configuration: 'metrics.match' cannot be used for format %v.", c.Format)
+		}
+		// fields are optional for logfmt, all keys are available as fields anyway
+		for name, key := range c.Fields {
+			if name == "" || key == "" {
+				return fmt.Errorf("Invalid metric configuration: 'metrics.fields' must not contain empty field names or keys.")
+			}
+		}
+	default:
+		return fmt.Errorf("Invalid 'metrics.format': '%v'. Expecting 'grok', 'json', or 'logfmt'.", c.Format)
+	}
+	// Counters without value count the matching lines, counters with value sum up the values.
+	var hasValue, valueAllowed, cumulativeAllowed, bucketsAllowed, quantilesAllowed, exemplarAllowed bool
 	switch c.Type {
 	case "counter":
-		hasValue, cumulativeAllowed, bucketsAllowed, quantilesAllowed = false, false, false, false
+		hasValue, valueAllowed, cumulativeAllowed, bucketsAllowed, quantilesAllowed, exemplarAllowed = false, true, false, false, false, true
 	case "gauge":
-		hasValue, cumulativeAllowed, bucketsAllowed, quantilesAllowed = true, true, false, false
+		hasValue, valueAllowed, cumulativeAllowed, bucketsAllowed, quantilesAllowed, exemplarAllowed = true, true, true, false, false, false
 	case "histogram":
-		hasValue, cumulativeAllowed, bucketsAllowed, quantilesAllowed = true, false, true, false
+		hasValue, valueAllowed, cumulativeAllowed, bucketsAllowed, quantilesAllowed, exemplarAllowed = true, true, false, true, false, true
 	case "summary":
-		hasValue, cumulativeAllowed, bucketsAllowed, quantilesAllowed = true, false, false, true
+		hasValue, valueAllowed, cumulativeAllowed, bucketsAllowed, quantilesAllowed, exemplarAllowed = true, true, false, false, true, false
 	default:
 		return fmt.Errorf("Invalid 'metrics.type': '%v'. We currently only support 'counter' and 'gauge'.", c.Type)
 	}
 	switch {
 	case hasValue && len(c.Value) == 0:
 		return fmt.Errorf("Invalid metric configuration: 'metrics.value' must not be empty for %v metrics.", c.Type)
-	case !hasValue && len(c.Value) > 0:
+	case !valueAllowed && len(c.Value) > 0:
 		return fmt.Errorf("Invalid metric configuration: 'metrics.value' cannot be used for %v metrics.", c.Type)
 	case !cumulativeAllowed && c.Cumulative:
 		return fmt.Errorf("Invalid metric configuration: 'metrics.cumulative' cannot be used for %v metrics.", c.Type)
@@ -353,6 +681,32 @@ func (c *MetricConfig) validate() error {
 		return fmt.Errorf("Invalid metric configuration: 'metrics.buckets' cannot be used for %v metrics.", c.Type)
 	case !quantilesAllowed && len(c.Quantiles) > 0:
 		return fmt.Errorf("Invalid metric configuration: 'metrics.buckets' cannot be used for %v metrics.", c.Type)
+	case !exemplarAllowed && len(c.Exemplar) > 0:
+		return fmt.Errorf("Invalid metric configuration: 'metrics.exemplar' cannot be used for %v metrics.", c.Type)
+	}
+	for name := range c.Exemplar {
+		if !isValidLabelName(name) {
+			return fmt.Errorf("Invalid metric configuration: '%v' is not a valid exemplar label name.", name)
+		}
+	}
+	if len(c.PathMatch) > 0 {
+		if _, err := regexp.Compile(c.PathMatch); err != nil {
+			return fmt.Errorf("Invalid metric configuration: 'metrics.path_match' is not a valid regular expression: %v", err)
+		}
+	}
+	if c.Filter != nil {
+		for _, list := range [][]string{c.Filter.Contains, c.Filter.NotContains, c.Filter.Prefix} {
+			for _, s := range list {
+				if len(s) == 0 {
+					return fmt.Errorf("Invalid metric configuration: 'metrics.filter' must not contain empty strings.")
+				}
+			}
+		}
+		for name, pattern := range c.Filter.Fields {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("Invalid metric configuration: 'metrics.filter.fields' contains an invalid pattern for %v: %v", name, pattern)
+			}
+		}
 	}
 	if len(c.DeleteMatch) > 0 && len(c.Labels) == 0 {
 		return fmt.Errorf("Invalid metric configuration: 'metrics.delete_match' is only supported for metrics with labels.")
@@ -363,6 +717,19 @@ func (c *MetricConfig) validate() error {
 	if c.Retention > 0 && len(c.Labels) == 0 {
 		return fmt.Errorf("Invalid metric configuration: 'metrics.retention' is only supported for metrics with labels.")
 	}
+	switch {
+	case c.MaxSeries < 0:
+		return fmt.Errorf("Invalid metric configuration: 'metrics.max_series' must not be negative.")
+	case c.MaxSeries > 0 && len(c.Labels) == 0:
+		return fmt.Errorf("Invalid metric configuration: 'metrics.max_series' is only supported for metrics with labels.")
+	case c.MaxSeries == 0 && len(c.MaxSeriesPolicy) > 0:
+		return fmt.Errorf("Invalid metric configuration: 'metrics.max_series_policy' can only be used when 'metrics.max_series' is present.")
+	}
+	switch c.MaxSeriesPolicy {
+	case "", "drop", "evict", "overflow":
+	default:
+		return fmt.Errorf("Invalid 'metrics.max_series_policy': '%v'. Expecting 'drop', 'evict', or 'overflow'.", c.MaxSeriesPolicy)
+	}
 	for _, deleteLabelTemplate := range c.DeleteLabelTemplates {
 		found := false
 		for _, labelTemplate := range c.LabelTemplates {
@@ -379,6 +746,19 @@ func (c *MetricConfig) validate() error {
 	return nil
 }
 
+// Prometheus label names match [a-zA-Z_][a-zA-Z0-9_]*, names starting with __ are reserved.
+func isValidLabelName(name string) bool {
+	if len(name) == 0 || strings.HasPrefix(name, "__") {
+		return false
+	}
+	for i, c := range name {
+		if !(c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (i > 0 && c >= '0' && c <= '9')) {
+			return false
+		}
+	}
+	return true
+}
+
 func (c *ServerConfig) validate() error {
 	switch {
 	case c.Protocol != "https" && c.Protocol != "http":
@@ -435,6 +815,10 @@ func (metric *MetricConfig) InitTemplates() error {
 			src:  metric.DeleteLabels,
 			dest: &(metric.DeleteLabelTemplates),
 		},
+		{
+			src:  metric.Exemplar,
+			dest: &(metric.ExemplarTemplates),
+		},
 	} {
 		*t.dest = make([]template.Template, 0, len(t.src))
 		for name, templateString := range t.src {
@@ -460,6 +844,37 @@ func (cfg *Config) String() string {
 	if stripped.Global.RetentionCheckInterval == defaultRetentionCheckInterval {
 		stripped.Global.RetentionCheckInterval = 0
 	}
+	if stripped.Global.MatchingWorkers == defaultMatchingWorkers {
+		stripped.Global.MatchingWorkers = 0
+	}
+	for _, input := range stripped.AllInputs() {
+		if input.Name == input.Type {
+			input.Name = ""
+		}
+		if input.WebhookMaxBodySize == defaultWebhookMaxBodySize {
+			input.WebhookMaxBodySize = 0
+		}
+		if input.WebhookQueueSize == defaultWebhookQueueSize {
+			input.WebhookQueueSize = 0
+		}
+		if input.WebhookQueueTimeout == defaultWebhookQueueTimeout {
+			input.WebhookQueueTimeout = 0
+		}
+		// Credentials are not shown with -showconfig.
+		for _, secret := range []*string{&input.WebhookBearerToken, &input.WebhookBasicAuthPassword} {
+			if len(*secret) > 0 {
+				*secret = "<secret>"
+			}
+		}
+		if input.Multiline != nil {
+			if input.Multiline.MaxLines == defaultMultilineMaxLines {
+				input.Multiline.MaxLines = 0
+			}
+			if input.Multiline.MaxWait == defaultMultilineMaxWait {
+				input.Multiline.MaxWait = 0
+			}
+		}
+	}
 	if stripped.Server.Path == "/metrics" {
 		stripped.Server.Path = ""
 	}
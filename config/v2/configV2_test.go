@@ -258,6 +258,80 @@ func TestRetentionInvalidConfig(t *testing.T) {
 	}
 }
 
+const inputs_config = `
+global:
+    config_version: 2
+inputs:
+    - name: app
+      type: file
+      path:
+      - /var/log/app/*.log
+      position_file: /tmp/app-position.json
+      position_sync_interval: 10s
+    - type: webhook
+grok:
+    patterns_dir: b/c
+metrics:
+    - type: counter
+      name: test_count_total
+      help: Dummy help message.
+      match: Some text here, then a %{DATE}.
+      inputs:
+      - webhook
+`
+
+func TestInputsConfig(t *testing.T) {
+	cfg, err := Unmarshal([]byte(inputs_config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputs := cfg.AllInputs()
+	if len(inputs) != 2 {
+		t.Fatalf("expected 2 inputs, got %v", len(inputs))
+	}
+	if inputs[0].Name != "app" || inputs[0].Type != "file" || inputs[0].Path[0] != "/var/log/app/*.log" {
+		t.Fatalf("unexpected first input %+v", inputs[0])
+	}
+	if inputs[1].Name != "webhook" || inputs[1].WebhookPath != "/webhook" {
+		t.Fatalf("expected the webhook input with default name and path, got %+v", inputs[1])
+	}
+	for _, test := range []struct {
+		old, new, expectedErr string
+	}{
+		{"    - type: webhook\n", "    - type: webhook\n      name: app\n", "'app' is used twice"},
+		{"      inputs:\n      - webhook\n", "      inputs:\n      - syslog\n", "input 'syslog', which is not defined"},
+		{"global:\n", "global:\ninput:\n    type: stdin\n", "cannot be used together"},
+		{"    - type: webhook\n", "    - type: webhook\n      webhook_bearer_token: x\n      webhook_basic_auth_username: y\n", "cannot be used together"},
+		{"    - type: webhook\n", "    - type: webhook\n      webhook_basic_auth_username: y\n", "must be configured together"},
+		{"    - type: webhook\n", "    - type: file\n      path:\n      - /var/log/other.log\n      position_file: /tmp/app-position.json\n      position_sync_interval: 10s\n", "use the same 'input.position_file'"},
+		{"    - type: webhook\n", "    - type: webhook\n      webhook_fields:\n        job: job\n", "can only be used with webhook_format"},
+		{"    - type: webhook\n", "    - type: webhook\n      webhook_format: json_bulk\n      webhook_json_selector: $..msg\n", "recursive descent"},
+		{"    - type: webhook\n", "    - type: webhook\n      webhook_queue_timeout: -1s\n", "'input.webhook_queue_timeout' must not be negative"},
+		{"    - type: webhook\n", "    - type: webhook\n      webhook_format: loki\n      webhook_fields:\n        job: ''\n", "must not contain empty field names or paths"},
+		{"    - type: webhook\n", "    - type: webhook\n      webhook_path: /es\n      webhook_format: elasticsearch_bulk\n    - type: webhook\n      name: other\n      webhook_path: /es/_bulk\n", "/es/_bulk is used twice"},
+		{"    - type: webhook\n", "    - type: webhook\n      max_lines_in_buffer: 100\n      buffer_overflow: spill\n", "'input.buffer_spill_directory' is required"},
+		{"    - type: webhook\n", "    - type: webhook\n      buffer_overflow: block\n", "requires 'input.max_lines_in_buffer'"},
+		{"    - type: webhook\n", "    - type: webhook\n      max_lines_in_buffer: 100\n      buffer_overflow: wait\n", "must be \"drop|spill|block\""},
+		{"    - type: webhook\n", "    - type: webhook\n      max_lines_in_buffer: 100\n      buffer_spill_directory: /tmp/spill\n", "can only be used with buffer_overflow \"spill\""},
+		{"    - type: webhook\n", "    - type: webhook\n      max_lines_in_buffer: 100\n      buffer_overflow: spill\n      buffer_spill_directory: /tmp/spill\n    - type: webhook\n      name: other\n      webhook_path: /other\n      max_lines_in_buffer: 100\n      buffer_overflow: spill\n      buffer_spill_directory: /tmp/spill\n", "use the same 'input.buffer_spill_directory'"},
+	} {
+		invalidCfg := strings.Replace(inputs_config, test.old, test.new, 1)
+		_, err := Unmarshal([]byte(invalidCfg))
+		if err == nil || !strings.Contains(err.Error(), test.expectedErr) {
+			t.Errorf("expected error containing %q, got %v", test.expectedErr, err)
+		}
+	}
+	// Rate limiting is supported by the poller as well.
+	pollingCfg := strings.Replace(inputs_config, "    - type: webhook\n", "    - type: file\n      name: polled\n      collectMode: poll\n      max_lines_rate_per_file: 100\n      path:\n      - /var/log/polled.log\n      position_file: /tmp/polled-position.json\n      position_sync_interval: 10s\n    - type: webhook\n", 1)
+	if _, err := Unmarshal([]byte(pollingCfg)); err != nil {
+		t.Fatalf("unexpected error for max_lines_rate_per_file with collectMode poll: %v", err)
+	}
+	spillCfg := strings.Replace(inputs_config, "    - type: webhook\n", "    - type: webhook\n      max_lines_in_buffer: 100\n      buffer_overflow: spill\n      buffer_spill_directory: /tmp/spill\n      buffer_spill_max_size: 1048576\n", 1)
+	if _, err := Unmarshal([]byte(spillCfg)); err != nil {
+		t.Fatalf("unexpected error for buffer_overflow spill: %v", err)
+	}
+}
+
 func loadOrFail(t *testing.T, cfgString string) *Config {
 	cfg, err := Unmarshal([]byte(cfgString))
 	if err != nil {
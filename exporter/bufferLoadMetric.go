@@ -16,6 +16,20 @@ var (
 		"value":    "max",
 		"interval": "1m",
 	}
+	// Shared by the buffers of all inputs, which are distinguished by the input label.
+	bufferLoad = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "grok_exporter_line_buffer_load",
+		Help: "Number of lines that are read from the logfile and waiting to be processed.",
+	}, []string{"input", "value", "interval"})
+	bufferDroppedLines = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "grok_exporter_line_buffer_dropped_lines_total",
+		Help: "Number of lines dropped because max_lines_in_buffer was reached, or because they could not be spilled to disk.",
+	}, []string{"input"})
+	bufferSpilledBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "grok_exporter_line_buffer_spilled_bytes_total",
+		Help: "Number of bytes written to buffer_spill_directory because max_lines_in_buffer was reached.",
+	}, []string{"input"})
+	registerBufferLoad sync.Once
 )
 
 // We measure the minimum and maximum buffer load in the last minute.
@@ -24,18 +38,21 @@ type bufferLoadMetric struct {
 	cur                            int64
 	min15s, min30s, min45s, min60s int64
 	max15s, max30s, max45s, max60s int64
-	bufferLoad                     *prometheus.GaugeVec
+	bufferLoad                     *prometheus.GaugeVec // curried with the input label
+	input                          string
 	mutex                          *sync.Cond
 	tick                           *time.Ticker
+	done                           chan struct{}
 	log                            logrus.FieldLogger
 	lineLimitSet                   bool
 }
 
-func NewBufferLoadMetric(log logrus.FieldLogger, lineLimitSet bool) *bufferLoadMetric {
+func NewBufferLoadMetric(log logrus.FieldLogger, lineLimitSet bool, input string) *bufferLoadMetric {
 	m := &bufferLoadMetric{
 		mutex:        sync.NewCond(&sync.Mutex{}),
 		log:          log,
 		lineLimitSet: lineLimitSet,
+		input:        input,
 	}
 	return m
 }
@@ -48,16 +65,23 @@ func (m *bufferLoadMetric) Start() {
 // The tickProcessed channel is just for testing, it signals to the test when a tick was processed.
 func (m *bufferLoadMetric) start(ticker *time.Ticker, tickProcessed chan struct{}) {
 	m.tick = ticker
-	m.bufferLoad = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "grok_exporter_line_buffer_load",
-		Help: "Number of lines that are read from the logfile and waiting to be processed.",
-	}, []string{"value", "interval"})
-	prometheus.MustRegister(m.bufferLoad)
+	m.done = make(chan struct{})
+	registerBufferLoad.Do(func() {
+		prometheus.MustRegister(bufferLoad, bufferDroppedLines, bufferSpilledBytes)
+	})
+	m.bufferLoad = bufferLoad.MustCurryWith(prometheus.Labels{"input": m.input})
+	bufferDroppedLines.WithLabelValues(m.input).Add(0)
+	bufferSpilledBytes.WithLabelValues(m.input).Add(0)
 	m.bufferLoad.With(minLabel).Set(0)
 	m.bufferLoad.With(maxLabel).Set(0)
 	go func() {
 		var ticksSinceLastLog = 0
-		for range m.tick.C {
+		for {
+			select {
+			case <-m.tick.C:
+			case <-m.done:
+				return
+			}
 			func() {
 				m.mutex.L.Lock()
 				defer m.mutex.L.Unlock()
@@ -95,7 +119,11 @@ func (m *bufferLoadMetric) start(ticker *time.Ticker, tickProcessed chan struct{
 
 func (m *bufferLoadMetric) Stop() {
 	m.tick.Stop()
-	prometheus.Unregister(m.bufferLoad)
+	close(m.done)
+	m.bufferLoad.Delete(minLabel)
+	m.bufferLoad.Delete(maxLabel)
+	bufferDroppedLines.DeleteLabelValues(m.input)
+	bufferSpilledBytes.DeleteLabelValues(m.input)
 }
 
 func (m *bufferLoadMetric) Inc() {
@@ -149,3 +177,11 @@ func (m *bufferLoadMetric) Set(value int64) {
 	m.updateMin()
 	m.updateMax()
 }
+
+func (m *bufferLoadMetric) Dropped(lines int) {
+	bufferDroppedLines.WithLabelValues(m.input).Add(float64(lines))
+}
+
+func (m *bufferLoadMetric) Spilled(bytes int) {
+	bufferSpilledBytes.WithLabelValues(m.input).Add(float64(bytes))
+}
@@ -7,7 +7,7 @@ import (
 )
 
 func TestBufferLoadMetric(t *testing.T) {
-	m := NewBufferLoadMetric(logrus.New(), false)
+	m := NewBufferLoadMetric(logrus.New(), false, "file")
 	c := make(chan time.Time)
 	tick := &time.Ticker{
 		C: c,
@@ -145,7 +145,7 @@ func expectValues(t *testing.T, m *bufferLoadMetric, min15s, min30s, min45s, min
 }
 
 func TestResetBufferLoadMetrics(t *testing.T) {
-	m := NewBufferLoadMetric(logrus.New(), false)
+	m := NewBufferLoadMetric(logrus.New(), false, "file")
 	c := make(chan time.Time)
 	tick := &time.Ticker{
 		C: c,
@@ -0,0 +1,99 @@
+// Copyright 2016-2018 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"path"
+	"strings"
+
+	configuration "github.com/sequix/grok_exporter/config/v2"
+)
+
+// Literal checks that are evaluated before the match pattern, because they are much cheaper than regular expressions.
+type LineFilter struct {
+	contains    []string          // the line must contain all of these
+	notContains []string          // the line must contain none of these
+	prefixes    []string          // the line must start with one of these
+	fields      map[string]string // field name -> shell pattern, see path.Match()
+}
+
+// Returns nil if cfg is nil. A nil filter matches all lines.
+func NewLineFilter(cfg *configuration.FilterConfig) *LineFilter {
+	if cfg == nil {
+		return nil
+	}
+	return &LineFilter{
+		contains:    cfg.Contains,
+		notContains: cfg.NotContains,
+		prefixes:    cfg.Prefix,
+		fields:      cfg.Fields,
+	}
+}
+
+func (f *LineFilter) Match(line string) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.prefixes) > 0 {
+		found := false
+		for _, prefix := range f.prefixes {
+			if strings.HasPrefix(line, prefix) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for _, s := range f.contains {
+		if !strings.Contains(line, s) {
+			return false
+		}
+	}
+	for _, s := range f.notContains {
+		if strings.Contains(line, s) {
+			return false
+		}
+	}
+	return true
+}
+
+// Checks the fields provided by the input, like the journald _SYSTEMD_UNIT.
+// Missing fields are treated as empty.
+func (f *LineFilter) MatchFields(fields map[string]string) bool {
+	if f == nil {
+		return true
+	}
+	for name, pattern := range f.fields {
+		// The patterns are validated in the configuration, so there is no error.
+		if matched, _ := path.Match(pattern, fields[name]); !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// Names of the fields used in the filter, to check that they are provided by the input.
+func (f *LineFilter) FieldNames() []string {
+	if f == nil {
+		return nil
+	}
+	result := make([]string, 0, len(f.fields))
+	for name := range f.fields {
+		result = append(result, name)
+	}
+	return result
+}
@@ -0,0 +1,75 @@
+// Copyright 2016-2018 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"testing"
+
+	configuration "github.com/sequix/grok_exporter/config/v2"
+)
+
+func TestLineFilter(t *testing.T) {
+	var filter *LineFilter
+	if !filter.Match("anything") {
+		t.Fatal("nil filter must match all lines")
+	}
+	filter = NewLineFilter(&configuration.FilterConfig{
+		Contains:    []string{"ERROR", "db"},
+		NotContains: []string{"healthcheck"},
+		Prefix:      []string{"2019-", "2020-"},
+	})
+	for line, expected := range map[string]bool{
+		"2019-01-01 ERROR db connection lost":        true,
+		"2020-01-01 ERROR db connection lost":        true,
+		"2018-01-01 ERROR db connection lost":        false,
+		"2019-01-01 ERROR cache miss":                false,
+		"2019-01-01 INFO db connected":               false,
+		"2019-01-01 ERROR db healthcheck failed":     false,
+		"[2019-01-01] ERROR db connection lost":      false,
+		"2019-01-01 ERROR db connection healthcheck": false,
+	} {
+		if filter.Match(line) != expected {
+			t.Errorf("%v: expected %v", line, expected)
+		}
+	}
+}
+
+func TestLineFilterFields(t *testing.T) {
+	var filter *LineFilter
+	if !filter.MatchFields(map[string]string{"_SYSTEMD_UNIT": "sshd.service"}) {
+		t.Fatal("nil filter must match all fields")
+	}
+	filter = NewLineFilter(&configuration.FilterConfig{
+		Fields: map[string]string{
+			"_SYSTEMD_UNIT": "nginx*.service",
+			"PRIORITY":      "[0-3]",
+		},
+	})
+	for _, test := range []struct {
+		fields   map[string]string
+		expected bool
+	}{
+		{map[string]string{"_SYSTEMD_UNIT": "nginx.service", "PRIORITY": "3"}, true},
+		{map[string]string{"_SYSTEMD_UNIT": "nginx-internal.service", "PRIORITY": "0"}, true},
+		{map[string]string{"_SYSTEMD_UNIT": "nginx.service", "PRIORITY": "6"}, false},
+		{map[string]string{"_SYSTEMD_UNIT": "sshd.service", "PRIORITY": "3"}, false},
+		{map[string]string{"_SYSTEMD_UNIT": "nginx.service"}, false},
+		{nil, false},
+	} {
+		if filter.MatchFields(test.fields) != test.expected {
+			t.Errorf("%v: expected %v", test.fields, test.expected)
+		}
+	}
+}
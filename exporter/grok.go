@@ -36,21 +36,29 @@ func Compile(pattern string, patterns *Patterns) (*oniguruma.Regex, error) {
 	return result, nil
 }
 
-func VerifyFieldNames(m *v2.MetricConfig, regex, deleteRegex *oniguruma.Regex) error {
+// The additionalFields are the names of the fields provided by the input, like the syslog hostname.
+func VerifyFieldNames(m *v2.MetricConfig, regex, deleteRegex *oniguruma.Regex, additionalFields []string) error {
+	hasField := matchFieldVerifier(m, regex)
 	for _, template := range m.LabelTemplates {
-		err := verifyFieldName(m.Name, template, regex)
+		err := verifyFieldName(m.Name, template, hasField, additionalFields)
+		if err != nil {
+			return err
+		}
+	}
+	for _, template := range m.ExemplarTemplates {
+		err := verifyFieldName(m.Name, template, hasField, additionalFields)
 		if err != nil {
 			return err
 		}
 	}
 	for _, template := range m.DeleteLabelTemplates {
-		err := verifyFieldName(m.Name, template, deleteRegex)
+		err := verifyFieldName(m.Name, template, deleteRegex.HasCaptureGroup, additionalFields)
 		if err != nil {
 			return err
 		}
 	}
 	if m.ValueTemplate != nil {
-		err := verifyFieldName(m.Name, m.ValueTemplate, regex)
+		err := verifyFieldName(m.Name, m.ValueTemplate, hasField, additionalFields)
 		if err != nil {
 			return err
 		}
@@ -58,10 +66,29 @@ func VerifyFieldNames(m *v2.MetricConfig, regex, deleteRegex *oniguruma.Regex) e
 	return nil
 }
 
-func verifyFieldName(metricName string, template template.Template, regex *oniguruma.Regex) error {
+// Returns a function checking if a field is provided by the match of the metric.
+func matchFieldVerifier(m *v2.MetricConfig, regex *oniguruma.Regex) func(name string) bool {
+	switch {
+	case m.Format == "logfmt" && len(m.Fields) == 0:
+		// Without declared fields, all keys of a logfmt line can be used.
+		return func(name string) bool {
+			return true
+		}
+	case m.Format != "" && m.Format != "grok":
+		// For structured formats, the fields are declared in the config instead of the match pattern.
+		return func(name string) bool {
+			_, exists := m.Fields[name]
+			return exists
+		}
+	default:
+		return regex.HasCaptureGroup
+	}
+}
+
+func verifyFieldName(metricName string, template template.Template, hasField func(name string) bool, additionalFields []string) error {
 	if template != nil {
 		for _, grokFieldName := range template.ReferencedGrokFields() {
-			if !regex.HasCaptureGroup(grokFieldName) {
+			if !hasField(grokFieldName) && !containsString(additionalFields, grokFieldName) {
 				return fmt.Errorf("%v: grok field %v not found in match pattern", metricName, grokFieldName)
 			}
 		}
@@ -105,7 +105,7 @@ func expect(t *testing.T, regex *oniguruma.Regex, config string, isErrorExpected
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = VerifyFieldNames(cfg, regex, nil)
+	err = VerifyFieldNames(cfg, regex, nil, nil)
 	if isErrorExpected && err == nil {
 		t.Fatal("Expected error, but got no error.")
 	}
@@ -15,13 +15,28 @@
 package exporter
 
 import (
+	"container/list"
 	"fmt"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
+// Label value used for all labels of the time series that collects observations beyond max_series.
+const OverflowLabelValue = "__overflow__"
+
 // Keep track of labels values for a metric.
+// The tracker is shared by all goroutines processing log lines for that metric, so it must be thread safe.
 type LabelValueTracker interface {
-	Observe(labels map[string]string) (bool, error)
+	// Returns the labels of the time series to be updated, and the time series that were evicted to make room for it.
+	// If the number of time series is limited, the returned labels may differ from the observed labels,
+	// or they may be nil if the observation is dropped.
+	Observe(labels map[string]string) (map[string]string, []map[string]string, error)
+	// Like Observe(), but update is called while the tracker is locked. That way the evicted time series are deleted
+	// and the observed time series is updated before another goroutine observes the same labels.
+	// If the observation is dropped, update is called with nil labels.
+	ObserveAndUpdate(labels map[string]string, update func(observed map[string]string, evicted []map[string]string)) error
 	DeleteByLabels(labels map[string]string) ([]map[string]string, error)
 	DeleteByRetention(retention time.Duration) []map[string]string
 }
@@ -30,37 +45,86 @@ type LabelValueTracker interface {
 //     myVec.WithLabelValues("404", "GET").Add(42)
 // then a labelValues with values = []{"404", "GET"} and the current timestamp is created.
 type observedLabelValues struct {
+	key        string // index key, see makeKey()
 	values     []string
 	lastUpdate time.Time
 }
 
 // Represents a list of labels for all time series ever observed (unless they are deleted).
+// The index finds the label values of a time series in constant time. The list is ordered by lastUpdate,
+// the least recently updated time series is at the front, so expired time series are found without scanning all values.
 type observedLabels struct {
+	mutex      *sync.Mutex
 	labelNames []string
-	values     []*observedLabelValues
+	index      map[string]*list.Element // key -> element with *observedLabelValues
+	values     *list.List
+	maxSeries  int    // 0 means no limit
+	policy     string // what to do with new label values when maxSeries is reached: drop, evict, or overflow
 }
 
 func NewLabelValueTracker(labelNames []string) LabelValueTracker {
+	return NewLimitedLabelValueTracker(labelNames, 0, "")
+}
+
+// The overflow time series is not counted for maxSeries, so there are up to maxSeries+1 time series with the overflow policy.
+func NewLimitedLabelValueTracker(labelNames []string, maxSeries int, policy string) LabelValueTracker {
 	names := make([]string, len(labelNames))
 	copy(names, labelNames)
 	return &observedLabels{
+		mutex:      &sync.Mutex{},
 		labelNames: names,
-		values:     make([]*observedLabelValues, 0),
+		index:      make(map[string]*list.Element),
+		values:     list.New(),
+		maxSeries:  maxSeries,
+		policy:     policy,
 	}
 }
 
-func (observed *observedLabels) Observe(labels map[string]string) (bool, error) {
+func (observed *observedLabels) Observe(labels map[string]string) (map[string]string, []map[string]string, error) {
+	var result map[string]string
+	var evicted []map[string]string
+	err := observed.ObserveAndUpdate(labels, func(o map[string]string, e []map[string]string) {
+		result, evicted = o, e
+	})
+	return result, evicted, err
+}
+
+func (observed *observedLabels) ObserveAndUpdate(labels map[string]string, update func(observed map[string]string, evicted []map[string]string)) error {
 	for _, err := range []error{
 		observed.assertLabelNamesExist(labels),
 		observed.assertLabelNamesComplete(labels),
-		observed.assertLabelValuesNotEmpty(labels),
 	} {
 		if err != nil {
-			return false, fmt.Errorf("error observing label values: %v", err)
+			return fmt.Errorf("error observing label values: %v", err)
 		}
 	}
 	values := observed.makeLabelValues(labels)
-	return observed.addOrUpdate(values), nil
+	observed.mutex.Lock()
+	defer observed.mutex.Unlock()
+	if observed.update(values) {
+		update(labels, nil)
+		return nil
+	}
+	if observed.maxSeries == 0 || observed.nSeries() < observed.maxSeries {
+		observed.add(values)
+		update(labels, nil)
+		return nil
+	}
+	switch observed.policy {
+	case "evict":
+		evicted := observed.remove(observed.values.Front())
+		observed.add(values)
+		update(labels, []map[string]string{observed.values2map(evicted.values)})
+	case "overflow":
+		overflowValues := observed.overflowValues()
+		if !observed.update(overflowValues) {
+			observed.add(overflowValues)
+		}
+		update(observed.values2map(overflowValues), nil)
+	default: // drop
+		update(nil, nil)
+	}
+	return nil
 }
 
 func (observed *observedLabels) DeleteByLabels(labels map[string]string) ([]map[string]string, error) {
@@ -74,38 +138,41 @@ func (observed *observedLabels) DeleteByLabels(labels map[string]string) ([]map[
 		}
 	}
 	values := observed.makeLabelValues(labels)
+	observed.mutex.Lock()
+	defer observed.mutex.Unlock()
 	deleted := make([]map[string]string, 0)
-	remaining := make([]*observedLabelValues, 0, len(observed.values))
-	for _, observedValues := range observed.values {
-		if equalsIgnoreEmpty(values, observedValues.values) {
-			deleted = append(deleted, observed.values2map(observedValues))
-		} else {
-			remaining = append(remaining, observedValues)
+	if len(labels) == len(observed.labelNames) {
+		// No wildcards, so at most one time series matches.
+		if elem, exists := observed.index[makeKey(values)]; exists {
+			deleted = append(deleted, observed.values2map(observed.remove(elem).values))
 		}
+		return deleted, nil
+	}
+	for elem := observed.values.Front(); elem != nil; {
+		next := elem.Next()
+		if equalsIgnoreEmpty(values, elem.Value.(*observedLabelValues).values) {
+			deleted = append(deleted, observed.values2map(observed.remove(elem).values))
+		}
+		elem = next
 	}
-	observed.values = remaining
 	return deleted, nil
 }
 
 func (observed *observedLabels) DeleteByRetention(retention time.Duration) []map[string]string {
 	retentionTime := time.Now().Add(-retention)
+	observed.mutex.Lock()
+	defer observed.mutex.Unlock()
 	deleted := make([]map[string]string, 0)
-	remaining := make([]*observedLabelValues, 0, len(observed.values))
-	for _, observedValues := range observed.values {
-		if observedValues.lastUpdate.Before(retentionTime) {
-			deleted = append(deleted, observed.values2map(observedValues))
-		} else {
-			remaining = append(remaining, observedValues)
-		}
+	for elem := observed.values.Front(); elem != nil && elem.Value.(*observedLabelValues).lastUpdate.Before(retentionTime); elem = observed.values.Front() {
+		deleted = append(deleted, observed.values2map(observed.remove(elem).values))
 	}
-	observed.values = remaining
 	return deleted
 }
 
-func (observed *observedLabels) values2map(observedValues *observedLabelValues) map[string]string {
+func (observed *observedLabels) values2map(values []string) map[string]string {
 	result := make(map[string]string)
-	for i := range observedValues.values {
-		result[observed.labelNames[i]] = observedValues.values[i]
+	for i := range values {
+		result[observed.labelNames[i]] = values[i]
 	}
 	return result
 }
@@ -126,8 +193,8 @@ func (observed *observedLabels) assertLabelNamesComplete(labels map[string]strin
 	return nil
 }
 
-// If we want to support empty label values, we must refactor DeleteByLabels(),
-// because currently empty label values represent wildcards for deleting.
+// Empty label values are observed like any other value, but they cannot be deleted by their labels,
+// because empty label values represent wildcards for deleting.
 func (observed *observedLabels) assertLabelValuesNotEmpty(labels map[string]string) error {
 	for name, val := range labels {
 		if len(val) == 0 {
@@ -145,39 +212,68 @@ func (observed *observedLabels) makeLabelValues(labels map[string]string) []stri
 	return result
 }
 
-func (observed *observedLabels) addOrUpdate(values []string) bool {
-	for _, observedValues := range observed.values {
-		if equals(values, observedValues.values) {
-			observedValues.lastUpdate = time.Now()
-			return false
-		}
+// Returns false if the values were not observed before.
+func (observed *observedLabels) update(values []string) bool {
+	elem, exists := observed.index[makeKey(values)]
+	if !exists {
+		return false
 	}
-	observed.values = append(observed.values, &observedLabelValues{
+	elem.Value.(*observedLabelValues).lastUpdate = time.Now()
+	observed.values.MoveToBack(elem)
+	return true
+}
+
+func (observed *observedLabels) add(values []string) {
+	key := makeKey(values)
+	observed.index[key] = observed.values.PushBack(&observedLabelValues{
+		key:        key,
 		values:     values,
 		lastUpdate: time.Now(),
 	})
-	return true
 }
 
-func equals(a, b []string) bool {
-	if len(a) != len(b) {
-		return false
-	}
-	for i := range a {
-		if a[i] != b[i] {
-			return false
+func (observed *observedLabels) remove(elem *list.Element) *observedLabelValues {
+	observedValues := observed.values.Remove(elem).(*observedLabelValues)
+	delete(observed.index, observedValues.key)
+	return observedValues
+}
+
+// Number of time series, not counting the overflow time series.
+func (observed *observedLabels) nSeries() int {
+	if observed.policy == "overflow" {
+		if _, exists := observed.index[makeKey(observed.overflowValues())]; exists {
+			return observed.values.Len() - 1
 		}
 	}
-	return true
+	return observed.values.Len()
+}
+
+func (observed *observedLabels) overflowValues() []string {
+	result := make([]string, len(observed.labelNames))
+	for i := range result {
+		result[i] = OverflowLabelValue
+	}
+	return result
+}
+
+// Label values may contain any character, so each value is prefixed with its length to make the key unique.
+func makeKey(values []string) string {
+	var sb strings.Builder
+	for _, value := range values {
+		sb.WriteString(strconv.Itoa(len(value)))
+		sb.WriteByte(':')
+		sb.WriteString(value)
+	}
+	return sb.String()
 }
 
-// test if the strings in 'a' are the same as the strings in 'b', but treat empty strings as a wildcard
+// test if the strings in 'a' are the same as the strings in 'b', but treat empty strings in 'a' as a wildcard
 func equalsIgnoreEmpty(a, b []string) bool {
 	if len(a) != len(b) {
 		return false
 	}
 	for i := range a {
-		if len(a[i]) > 0 && len(b[i]) > 0 && a[i] != b[i] {
+		if len(a[i]) > 0 && a[i] != b[i] {
 			return false
 		}
 	}
@@ -15,6 +15,7 @@
 package exporter
 
 import (
+	"fmt"
 	"testing"
 	"time"
 )
@@ -121,6 +122,73 @@ func TestDeleteByRetention(t *testing.T) {
 	verify(t, deleted, 0, tracker, 1, nil)
 }
 
+func TestMaxSeries(t *testing.T) {
+	for _, policy := range []string{"drop", "evict", "overflow"} {
+		tracker := NewLimitedLabelValueTracker([]string{"user", "status"}, 2, policy)
+		for _, user := range []string{"alice", "bob"} {
+			observed, evicted, err := tracker.Observe(map[string]string{"user": user, "status": "200"})
+			if err != nil || observed["user"] != user || len(evicted) != 0 {
+				t.Fatalf("%v: unexpected result for %v below the limit: %v %v %v", policy, user, observed, evicted, err)
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		tracker.Observe(map[string]string{"user": "alice", "status": "200"}) // bob is now the least recently updated
+		observed, evicted, err := tracker.Observe(map[string]string{"user": "carol", "status": "200"})
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", policy, err)
+		}
+		switch policy {
+		case "drop":
+			if observed != nil || len(evicted) != 0 {
+				t.Fatalf("drop: expected carol to be dropped, but got %v %v", observed, evicted)
+			}
+			verify(t, nil, 0, tracker, 2, nil)
+		case "evict":
+			if observed["user"] != "carol" || len(evicted) != 1 || evicted[0]["user"] != "bob" {
+				t.Fatalf("evict: expected bob to be evicted for carol, but got %v %v", observed, evicted)
+			}
+			verify(t, nil, 0, tracker, 2, nil)
+		case "overflow":
+			if observed["user"] != OverflowLabelValue || observed["status"] != OverflowLabelValue || len(evicted) != 0 {
+				t.Fatalf("overflow: expected carol to be collapsed into the overflow series, but got %v %v", observed, evicted)
+			}
+			tracker.Observe(map[string]string{"user": "dave", "status": "200"})
+			verify(t, nil, 0, tracker, 3, nil)
+			// Deleting a series makes room for a new one, the overflow series is not counted.
+			tracker.DeleteByLabels(map[string]string{"user": "bob"})
+			observed, _, _ = tracker.Observe(map[string]string{"user": "erin", "status": "200"})
+			if observed["user"] != "erin" {
+				t.Fatalf("overflow: expected erin to be observed, but got %v", observed)
+			}
+		}
+		// Known label values are always observed.
+		observed, _, _ = tracker.Observe(map[string]string{"user": "alice", "status": "200"})
+		if observed["user"] != "alice" {
+			t.Fatalf("%v: expected alice to be observed, but got %v", policy, observed)
+		}
+	}
+}
+
+func TestMaxSeriesEmptyLabelValues(t *testing.T) {
+	tracker := NewLimitedLabelValueTracker([]string{"user", "status"}, 2, "drop")
+	for _, user := range []string{"", "alice"} {
+		observed, _, err := tracker.Observe(map[string]string{"user": user, "status": "200"})
+		if err != nil || observed == nil {
+			t.Fatalf("unexpected result for user %q below the limit: %v %v", user, observed, err)
+		}
+	}
+	// Empty label values count towards max_series.
+	observed, _, err := tracker.Observe(map[string]string{"user": "", "status": "500"})
+	if err != nil || observed != nil {
+		t.Fatalf("expected the observation to be dropped, but got %v %v", observed, err)
+	}
+	// An empty label value is not matched by a non-empty value when deleting.
+	deleted, err := tracker.DeleteByLabels(map[string]string{"user": "alice"})
+	verify(t, deleted, 1, tracker, 1, err)
+	deleted, err = tracker.DeleteByLabels(map[string]string{"status": "200"})
+	verify(t, deleted, 1, tracker, 0, err)
+}
+
 func verify(t *testing.T, deleted []map[string]string, nDeleted int, tracker LabelValueTracker, nRemaining int, err error) {
 	if err != nil {
 		t.Fatal("unexpected error", err)
@@ -139,6 +207,51 @@ func nEntries(t *testing.T, tracker LabelValueTracker) int {
 		t.Fatal("Cannot cast tracker to *observedLabelValues")
 		return 0
 	} else {
-		return len(trackerInternal.values)
+		return trackerInternal.values.Len()
+	}
+}
+
+const nBenchmarkSeries = 10000
+
+func newBenchmarkTracker(b *testing.B) (LabelValueTracker, []map[string]string) {
+	tracker := NewLabelValueTracker([]string{"user", "status"})
+	labels := make([]map[string]string, nBenchmarkSeries)
+	for i := range labels {
+		labels[i] = map[string]string{
+			"user":   fmt.Sprintf("user%v", i),
+			"status": "200",
+		}
+		if _, _, err := tracker.Observe(labels[i]); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return tracker, labels
+}
+
+func BenchmarkObserve(b *testing.B) {
+	tracker, labels := newBenchmarkTracker(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tracker.Observe(labels[i%len(labels)])
+	}
+}
+
+func BenchmarkDeleteByLabels(b *testing.B) {
+	tracker, labels := newBenchmarkTracker(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		l := labels[i%len(labels)]
+		tracker.DeleteByLabels(l)
+		tracker.Observe(l)
+	}
+}
+
+func BenchmarkDeleteByRetention(b *testing.B) {
+	tracker, labels := newBenchmarkTracker(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Nothing expired, the tracker only needs to look at the least recently updated time series.
+		tracker.DeleteByRetention(time.Hour)
+		tracker.Observe(labels[i%len(labels)])
 	}
 }
@@ -22,13 +22,17 @@ import (
 	"github.com/sequix/grok_exporter/tailer/glob"
 	"github.com/sequix/grok_exporter/template"
 	"github.com/sequix/grok_exporter/util"
+	"math"
+	"reflect"
 	"strconv"
 	"time"
+	"unicode/utf8"
 )
 
 type Match struct {
-	Labels map[string]string
-	Value  float64
+	Labels        map[string]string
+	Value         float64
+	SeriesDropped int // number of time series dropped or evicted because of max_series
 }
 
 type Metric interface {
@@ -36,9 +40,10 @@ type Metric interface {
 	Collector() prometheus.Collector
 
 	// Returns the match if the line matched, and nil if the line didn't match.
-	ProcessMatch(line string) (*Match, error)
+	// The additionalFields are provided by the input and can be used in templates like grok fields.
+	ProcessMatch(line string, additionalFields map[string]string) (*Match, error)
 	// Returns the match if the delete pattern matched, nil otherwise.
-	ProcessDeleteMatch(line string) (*Match, error)
+	ProcessDeleteMatch(line string, additionalFields map[string]string) (*Match, error)
 	// Remove old metrics
 	ProcessRetention() error
 }
@@ -46,33 +51,87 @@ type Metric interface {
 // Allow metrics to use different sets of files.
 type PathMetric struct {
 	Metric
-	globs    []glob.Glob
-	excludes []glob.Glob
+	globs      []glob.Glob
+	excludes   []glob.Glob
+	filter     *LineFilter // nil if the metric has no filter
+	pathFields *PathFields // nil if the metric has no path_match
+	inputs     []string    // names of the inputs, empty for all inputs
 }
 
-func NewPathMatchMetric(m Metric, globs, excludes []glob.Glob) *PathMetric {
+func NewPathMatchMetric(m Metric, globs, excludes []glob.Glob, filter *LineFilter, pathFields *PathFields, inputs []string) *PathMetric {
 	return &PathMetric{
-		Metric:   m,
-		globs:    globs,
-		excludes: excludes,
+		Metric:     m,
+		globs:      globs,
+		excludes:   excludes,
+		filter:     filter,
+		pathFields: pathFields,
+		inputs:     inputs,
 	}
 }
 
+// Metrics without inputs match the lines of all inputs.
+func (pmm *PathMetric) MatchInput(input string) bool {
+	if len(pmm.inputs) == 0 {
+		return true
+	}
+	for _, name := range pmm.inputs {
+		if name == input {
+			return true
+		}
+	}
+	return false
+}
+
+// Metrics without path match all lines, including lines from inputs without files like syslog.
 func (pmm *PathMetric) MatchPath(p string) bool {
+	if len(pmm.globs) == 0 {
+		return !util.MatchGlobs(p, pmm.excludes)
+	}
 	return util.MatchGlobs(p, pmm.globs) && !util.MatchGlobs(p, pmm.excludes)
 }
 
+// Cheap pre-check before ProcessMatch(). Lines that don't pass the filter cannot match.
+func (pmm *PathMetric) MatchFilter(line string, fields map[string]string) bool {
+	return pmm.filter.Match(line) && pmm.filter.MatchFields(fields)
+}
+
+// Adds the fields extracted from the path with path_match to the fields provided by the input.
+// Returns false if the path does not match path_match, then the line cannot match.
+func (pmm *PathMetric) PathFields(p string, fields map[string]string) (map[string]string, bool) {
+	return pmm.pathFields.Extract(p, fields)
+}
+
+// Returns a copy of the metric that uses different regular expressions, but shares the collector
+// and the observed labels with the original metric. The oniguruma library is not thread safe,
+// so each goroutine processing log lines needs its own regular expressions.
+func (pmm *PathMetric) WithRegex(regex, deleteRegex *oniguruma.Regex) *PathMetric {
+	// All metric types are structs embedding metric, so a shallow copy of the struct is sufficient.
+	copied := reflect.New(reflect.TypeOf(pmm.Metric).Elem())
+	copied.Elem().Set(reflect.ValueOf(pmm.Metric).Elem())
+	m := copied.Interface().(Metric)
+	m.(regexMetric).setRegex(regex, deleteRegex)
+	return NewPathMatchMetric(m, pmm.globs, pmm.excludes, pmm.filter, pmm.pathFields, pmm.inputs)
+}
+
+// Implemented by all metric types through the embedded metric struct.
+type regexMetric interface {
+	setRegex(regex, deleteRegex *oniguruma.Regex)
+}
+
 // Common values for incMetric and observeMetric
 type metric struct {
 	name        string
 	regex       *oniguruma.Regex
 	deleteRegex *oniguruma.Regex
+	parser      lineParser // nil for the grok format, used instead of regex otherwise
 	retention   time.Duration
 }
 
 type observeMetric struct {
 	metric
-	valueTemplate template.Template
+	valueTemplate     template.Template // nil for counters without value, which count the matching lines
+	monotonic         bool              // true for counters, which reject negative values
+	exemplarTemplates []template.Template
 }
 
 type metricWithLabels struct {
@@ -84,16 +143,18 @@ type metricWithLabels struct {
 
 type observeMetricWithLabels struct {
 	metricWithLabels
-	valueTemplate template.Template
+	valueTemplate     template.Template // nil for counters without value, which count the matching lines
+	monotonic         bool              // true for counters, which reject negative values
+	exemplarTemplates []template.Template
 }
 
 type counterMetric struct {
-	metric
+	observeMetric
 	counter prometheus.Counter
 }
 
 type counterVecMetric struct {
-	metricWithLabels
+	observeMetricWithLabels
 	counterVec *prometheus.CounterVec
 }
 
@@ -169,91 +230,114 @@ func (m *summaryVecMetric) Collector() prometheus.Collector {
 	return m.summaryVec
 }
 
-func (m *metric) processMatch(line string, cb func()) (*Match, error) {
-	searchResult, err := m.regex.Search(line)
-	if err != nil {
-		return nil, fmt.Errorf("error processing metric %v: %v", m.Name(), err.Error())
-	}
-	defer searchResult.Free()
-	if searchResult.IsMatch() {
-		cb()
-		return &Match{
-			Value: 1.0,
-		}, nil
-	} else {
-		return nil, nil
+func (m *metric) setRegex(regex, deleteRegex *oniguruma.Regex) {
+	m.regex, m.deleteRegex = regex, deleteRegex
+}
+
+func (m *metric) match(line string) (matchResult, error) {
+	if m.parser != nil {
+		return m.parser.parse(line)
 	}
+	return m.regex.Search(line)
 }
 
-func (m *observeMetric) processMatch(line string, cb func(value float64)) (*Match, error) {
-	searchResult, err := m.regex.Search(line)
+func (m *observeMetric) processMatch(line string, additionalFields map[string]string, cb func(value float64, exemplar prometheus.Labels)) (*Match, error) {
+	searchResult, err := m.match(line)
 	if err != nil {
 		return nil, fmt.Errorf("error processing metric %v: %v", m.Name(), err.Error())
 	}
 	defer searchResult.Free()
 	if searchResult.IsMatch() {
-		floatVal, err := floatValue(m.Name(), searchResult, m.valueTemplate)
+		floatVal, err := floatValue(m.Name(), searchResult, m.valueTemplate, additionalFields)
 		if err != nil {
 			return nil, err
 		}
-		cb(floatVal)
-		return &Match{
-			Value: floatVal,
-		}, nil
-	} else {
-		return nil, nil
-	}
-}
-
-func (m *metricWithLabels) processMatch(line string, cb func(labels map[string]string)) (*Match, error) {
-	searchResult, err := m.regex.Search(line)
-	if err != nil {
-		return nil, fmt.Errorf("error while processing metric %v: %v", m.Name(), err.Error())
-	}
-	defer searchResult.Free()
-	if searchResult.IsMatch() {
-		labels, err := labelValues(m.Name(), searchResult, m.labelTemplates)
+		if m.monotonic {
+			if err = checkCounterValue(m.Name(), floatVal); err != nil {
+				return nil, err
+			}
+		}
+		exemplar, err := exemplarLabels(m.Name(), searchResult, m.exemplarTemplates, additionalFields)
 		if err != nil {
 			return nil, err
 		}
-		m.labelValueTracker.Observe(labels)
-		cb(labels)
+		cb(floatVal, exemplar)
 		return &Match{
-			Value:  1.0,
-			Labels: labels,
+			Value: floatVal,
 		}, nil
 	} else {
 		return nil, nil
 	}
 }
 
-func (m *observeMetricWithLabels) processMatch(line string, cb func(value float64, labels map[string]string)) (*Match, error) {
-	searchResult, err := m.regex.Search(line)
+func (m *observeMetricWithLabels) processMatch(line string, additionalFields map[string]string, vec deleterMetric, cb func(value float64, labels map[string]string, exemplar prometheus.Labels)) (*Match, error) {
+	searchResult, err := m.match(line)
 	if err != nil {
 		return nil, fmt.Errorf("error processing metric %v: %v", m.Name(), err.Error())
 	}
 	defer searchResult.Free()
 	if searchResult.IsMatch() {
-		floatVal, err := floatValue(m.Name(), searchResult, m.valueTemplate)
+		floatVal, err := floatValue(m.Name(), searchResult, m.valueTemplate, additionalFields)
 		if err != nil {
 			return nil, err
 		}
-		labels, err := labelValues(m.Name(), searchResult, m.labelTemplates)
+		if m.monotonic {
+			if err = checkCounterValue(m.Name(), floatVal); err != nil {
+				return nil, err
+			}
+		}
+		exemplar, err := exemplarLabels(m.Name(), searchResult, m.exemplarTemplates, additionalFields)
 		if err != nil {
 			return nil, err
 		}
-		m.labelValueTracker.Observe(labels)
-		cb(floatVal, labels)
+		labels, err := labelValues(m.Name(), searchResult, m.labelTemplates, additionalFields)
+		if err != nil {
+			return nil, err
+		}
+		labels, dropped := m.observeLabels(labels, vec, func(labels map[string]string) {
+			cb(floatVal, labels, exemplar)
+		})
 		return &Match{
-			Value:  floatVal,
-			Labels: labels,
+			Value:         floatVal,
+			Labels:        labels,
+			SeriesDropped: dropped,
 		}, nil
 	} else {
 		return nil, nil
 	}
 }
 
-func (m *metric) ProcessDeleteMatch(line string) (*Match, error) {
+// Applies the max_series limit and calls cb with the labels of the time series to be updated, unless the observation is dropped.
+// Returns the labels passed to cb, nil if the observation is dropped, and the number of time series that were dropped or evicted.
+// Evicted time series are deleted and cb is called while the tracker is locked, so the time series in vec stay in sync with the tracker.
+func (m *metricWithLabels) observeLabels(labels map[string]string, vec deleterMetric, cb func(labels map[string]string)) (map[string]string, int) {
+	var result map[string]string
+	dropped := 0
+	err := m.labelValueTracker.ObserveAndUpdate(labels, func(observed map[string]string, evicted []map[string]string) {
+		for _, e := range evicted {
+			vec.Delete(e)
+		}
+		result, dropped = observed, len(evicted)
+		if observed == nil {
+			dropped = 1
+			return
+		}
+		for name, value := range observed {
+			if labels[name] != value {
+				dropped = 1 // collapsed into the overflow time series
+				break
+			}
+		}
+		cb(observed)
+	})
+	if err != nil {
+		// The labels don't match the labels of the metric, so the time series cannot be tracked for max_series.
+		return nil, 1
+	}
+	return result, dropped
+}
+
+func (m *metric) ProcessDeleteMatch(line string, additionalFields map[string]string) (*Match, error) {
 	if m.deleteRegex == nil {
 		return nil, nil
 	}
@@ -267,7 +351,7 @@ func (m *metric) ProcessRetention() error {
 	return fmt.Errorf("error processing metric %v: retention is currently only supported for metrics with labels.", m.Name())
 }
 
-func (m *metricWithLabels) processDeleteMatch(line string, vec deleterMetric) (*Match, error) {
+func (m *metricWithLabels) processDeleteMatch(line string, additionalFields map[string]string, vec deleterMetric) (*Match, error) {
 	if m.deleteRegex == nil {
 		return nil, nil
 	}
@@ -277,7 +361,7 @@ func (m *metricWithLabels) processDeleteMatch(line string, vec deleterMetric) (*
 	}
 	defer searchResult.Free()
 	if searchResult.IsMatch() {
-		deleteLabels, err := labelValues(m.Name(), searchResult, m.deleteLabelTemplates)
+		deleteLabels, err := labelValues(m.Name(), searchResult, m.deleteLabelTemplates, additionalFields)
 		if err != nil {
 			return nil, err
 		}
@@ -305,28 +389,28 @@ func (m *metricWithLabels) processRetention(vec deleterMetric) error {
 	return nil
 }
 
-func (m *counterMetric) ProcessMatch(line string) (*Match, error) {
-	return m.processMatch(line, func() {
-		m.counter.Inc()
+func (m *counterMetric) ProcessMatch(line string, additionalFields map[string]string) (*Match, error) {
+	return m.processMatch(line, additionalFields, func(value float64, exemplar prometheus.Labels) {
+		m.counter.(prometheus.ExemplarAdder).AddWithExemplar(value, exemplar)
 	})
 }
 
-func (m *counterVecMetric) ProcessMatch(line string) (*Match, error) {
-	return m.processMatch(line, func(labels map[string]string) {
-		m.counterVec.With(labels).Inc()
+func (m *counterVecMetric) ProcessMatch(line string, additionalFields map[string]string) (*Match, error) {
+	return m.processMatch(line, additionalFields, m.counterVec, func(value float64, labels map[string]string, exemplar prometheus.Labels) {
+		m.counterVec.With(labels).(prometheus.ExemplarAdder).AddWithExemplar(value, exemplar)
 	})
 }
 
-func (m *counterVecMetric) ProcessDeleteMatch(line string) (*Match, error) {
-	return m.processDeleteMatch(line, m.counterVec)
+func (m *counterVecMetric) ProcessDeleteMatch(line string, additionalFields map[string]string) (*Match, error) {
+	return m.processDeleteMatch(line, additionalFields, m.counterVec)
 }
 
 func (m *counterVecMetric) ProcessRetention() error {
 	return m.processRetention(m.counterVec)
 }
 
-func (m *gaugeMetric) ProcessMatch(line string) (*Match, error) {
-	return m.processMatch(line, func(value float64) {
+func (m *gaugeMetric) ProcessMatch(line string, additionalFields map[string]string) (*Match, error) {
+	return m.processMatch(line, additionalFields, func(value float64, _ prometheus.Labels) {
 		if m.cumulative {
 			m.gauge.Add(value)
 		} else {
@@ -335,8 +419,8 @@ func (m *gaugeMetric) ProcessMatch(line string) (*Match, error) {
 	})
 }
 
-func (m *gaugeVecMetric) ProcessMatch(line string) (*Match, error) {
-	return m.processMatch(line, func(value float64, labels map[string]string) {
+func (m *gaugeVecMetric) ProcessMatch(line string, additionalFields map[string]string) (*Match, error) {
+	return m.processMatch(line, additionalFields, m.gaugeVec, func(value float64, labels map[string]string, _ prometheus.Labels) {
 		if m.cumulative {
 			m.gaugeVec.With(labels).Add(value)
 		} else {
@@ -345,48 +429,48 @@ func (m *gaugeVecMetric) ProcessMatch(line string) (*Match, error) {
 	})
 }
 
-func (m *gaugeVecMetric) ProcessDeleteMatch(line string) (*Match, error) {
-	return m.processDeleteMatch(line, m.gaugeVec)
+func (m *gaugeVecMetric) ProcessDeleteMatch(line string, additionalFields map[string]string) (*Match, error) {
+	return m.processDeleteMatch(line, additionalFields, m.gaugeVec)
 }
 
 func (m *gaugeVecMetric) ProcessRetention() error {
 	return m.processRetention(m.gaugeVec)
 }
 
-func (m *histogramMetric) ProcessMatch(line string) (*Match, error) {
-	return m.processMatch(line, func(value float64) {
-		m.histogram.Observe(value)
+func (m *histogramMetric) ProcessMatch(line string, additionalFields map[string]string) (*Match, error) {
+	return m.processMatch(line, additionalFields, func(value float64, exemplar prometheus.Labels) {
+		m.histogram.(prometheus.ExemplarObserver).ObserveWithExemplar(value, exemplar)
 	})
 }
 
-func (m *histogramVecMetric) ProcessMatch(line string) (*Match, error) {
-	return m.processMatch(line, func(value float64, labels map[string]string) {
-		m.histogramVec.With(labels).Observe(value)
+func (m *histogramVecMetric) ProcessMatch(line string, additionalFields map[string]string) (*Match, error) {
+	return m.processMatch(line, additionalFields, m.histogramVec, func(value float64, labels map[string]string, exemplar prometheus.Labels) {
+		m.histogramVec.With(labels).(prometheus.ExemplarObserver).ObserveWithExemplar(value, exemplar)
 	})
 }
 
-func (m *histogramVecMetric) ProcessDeleteMatch(line string) (*Match, error) {
-	return m.processDeleteMatch(line, m.histogramVec)
+func (m *histogramVecMetric) ProcessDeleteMatch(line string, additionalFields map[string]string) (*Match, error) {
+	return m.processDeleteMatch(line, additionalFields, m.histogramVec)
 }
 
 func (m *histogramVecMetric) ProcessRetention() error {
 	return m.processRetention(m.histogramVec)
 }
 
-func (m *summaryMetric) ProcessMatch(line string) (*Match, error) {
-	return m.processMatch(line, func(value float64) {
+func (m *summaryMetric) ProcessMatch(line string, additionalFields map[string]string) (*Match, error) {
+	return m.processMatch(line, additionalFields, func(value float64, _ prometheus.Labels) {
 		m.summary.Observe(value)
 	})
 }
 
-func (m *summaryVecMetric) ProcessMatch(line string) (*Match, error) {
-	return m.processMatch(line, func(value float64, labels map[string]string) {
+func (m *summaryVecMetric) ProcessMatch(line string, additionalFields map[string]string) (*Match, error) {
+	return m.processMatch(line, additionalFields, m.summaryVec, func(value float64, labels map[string]string, _ prometheus.Labels) {
 		m.summaryVec.With(labels).Observe(value)
 	})
 }
 
-func (m *summaryVecMetric) ProcessDeleteMatch(line string) (*Match, error) {
-	return m.processDeleteMatch(line, m.summaryVec)
+func (m *summaryVecMetric) ProcessDeleteMatch(line string, additionalFields map[string]string) (*Match, error) {
+	return m.processDeleteMatch(line, additionalFields, m.summaryVec)
 }
 
 func (m *summaryVecMetric) ProcessRetention() error {
@@ -398,6 +482,7 @@ func newMetric(cfg *configuration.MetricConfig, regex, deleteRegex *oniguruma.Re
 		name:        cfg.Name,
 		regex:       regex,
 		deleteRegex: deleteRegex,
+		parser:      newLineParser(cfg),
 		retention:   cfg.Retention,
 	}
 }
@@ -407,21 +492,23 @@ func newMetricWithLabels(cfg *configuration.MetricConfig, regex, deleteRegex *on
 		metric:               newMetric(cfg, regex, deleteRegex),
 		labelTemplates:       cfg.LabelTemplates,
 		deleteLabelTemplates: cfg.DeleteLabelTemplates,
-		labelValueTracker:    NewLabelValueTracker(prometheusLabels(cfg.LabelTemplates)),
+		labelValueTracker:    NewLimitedLabelValueTracker(prometheusLabels(cfg.LabelTemplates), cfg.MaxSeries, cfg.MaxSeriesPolicy),
 	}
 }
 
 func newObserveMetric(cfg *configuration.MetricConfig, regex, deleteRegex *oniguruma.Regex) observeMetric {
 	return observeMetric{
-		metric:        newMetric(cfg, regex, deleteRegex),
-		valueTemplate: cfg.ValueTemplate,
+		metric:            newMetric(cfg, regex, deleteRegex),
+		valueTemplate:     cfg.ValueTemplate,
+		exemplarTemplates: cfg.ExemplarTemplates,
 	}
 }
 
 func newObserveMetricWithLabels(cfg *configuration.MetricConfig, regex, deleteRegex *oniguruma.Regex) observeMetricWithLabels {
 	return observeMetricWithLabels{
-		metricWithLabels: newMetricWithLabels(cfg, regex, deleteRegex),
-		valueTemplate:    cfg.ValueTemplate,
+		metricWithLabels:  newMetricWithLabels(cfg, regex, deleteRegex),
+		valueTemplate:     cfg.ValueTemplate,
+		exemplarTemplates: cfg.ExemplarTemplates,
 	}
 }
 
@@ -431,15 +518,19 @@ func NewCounterMetric(cfg *configuration.MetricConfig, regex *oniguruma.Regex, d
 		Help: cfg.Help,
 	}
 	if len(cfg.Labels) == 0 {
-		return &counterMetric{
-			metric:  newMetric(cfg, regex, deleteRegex),
-			counter: prometheus.NewCounter(counterOpts),
+		m := &counterMetric{
+			observeMetric: newObserveMetric(cfg, regex, deleteRegex),
+			counter:       prometheus.NewCounter(counterOpts),
 		}
+		m.monotonic = true
+		return m
 	} else {
-		return &counterVecMetric{
-			metricWithLabels: newMetricWithLabels(cfg, regex, deleteRegex),
-			counterVec:       prometheus.NewCounterVec(counterOpts, prometheusLabels(cfg.LabelTemplates)),
+		m := &counterVecMetric{
+			observeMetricWithLabels: newObserveMetricWithLabels(cfg, regex, deleteRegex),
+			counterVec:              prometheus.NewCounterVec(counterOpts, prometheusLabels(cfg.LabelTemplates)),
 		}
+		m.monotonic = true
+		return m
 	}
 }
 
@@ -505,10 +596,10 @@ func NewSummaryMetric(cfg *configuration.MetricConfig, regex *oniguruma.Regex, d
 	}
 }
 
-func labelValues(metricName string, searchResult *oniguruma.SearchResult, templates []template.Template) (map[string]string, error) {
+func labelValues(metricName string, searchResult matchResult, templates []template.Template, additionalFields map[string]string) (map[string]string, error) {
 	result := make(map[string]string, len(templates))
 	for _, t := range templates {
-		value, err := evalTemplate(searchResult, t)
+		value, err := evalTemplate(searchResult, t, additionalFields)
 		if err != nil {
 			return nil, fmt.Errorf("error processing metric %v: %v", metricName, err.Error())
 		}
@@ -517,8 +608,45 @@ func labelValues(metricName string, searchResult *oniguruma.SearchResult, templa
 	return result, nil
 }
 
-func floatValue(metricName string, searchResult *oniguruma.SearchResult, valueTemplate template.Template) (float64, error) {
-	stringVal, err := evalTemplate(searchResult, valueTemplate)
+// Exemplar labels with empty values are omitted, like a trace id that is missing in the log line.
+// Returns nil if there are no exemplar labels, in which case no exemplar is stored.
+func exemplarLabels(metricName string, searchResult matchResult, templates []template.Template, additionalFields map[string]string) (prometheus.Labels, error) {
+	if len(templates) == 0 {
+		return nil, nil
+	}
+	values, err := labelValues(metricName, searchResult, templates, additionalFields)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		result prometheus.Labels
+		runes  int
+	)
+	for name, value := range values {
+		if len(value) == 0 {
+			continue
+		}
+		if !utf8.ValidString(value) {
+			return nil, fmt.Errorf("error processing metric %v: exemplar label %v is not valid UTF-8.", metricName, name)
+		}
+		runes += utf8.RuneCountInString(name) + utf8.RuneCountInString(value)
+		if result == nil {
+			result = make(prometheus.Labels, len(values))
+		}
+		result[name] = value
+	}
+	// The client library panics if the exemplar is too long.
+	if runes > prometheus.ExemplarMaxRunes {
+		return nil, fmt.Errorf("error processing metric %v: exemplar labels have %v runes, which exceeds the limit of %v runes.", metricName, runes, prometheus.ExemplarMaxRunes)
+	}
+	return result, nil
+}
+
+func floatValue(metricName string, searchResult matchResult, valueTemplate template.Template, additionalFields map[string]string) (float64, error) {
+	if valueTemplate == nil {
+		return 1.0, nil
+	}
+	stringVal, err := evalTemplate(searchResult, valueTemplate, additionalFields)
 	if err != nil {
 		return 0, fmt.Errorf("error processing metric %v: %v", metricName, err.Error())
 	}
@@ -529,9 +657,25 @@ func floatValue(metricName string, searchResult *oniguruma.SearchResult, valueTe
 	return floatVal, nil
 }
 
-func evalTemplate(searchResult *oniguruma.SearchResult, t template.Template) (string, error) {
+// Counters cannot decrease, and a single NaN or infinite value would make them NaN or infinite forever.
+func checkCounterValue(metricName string, value float64) error {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return fmt.Errorf("error processing metric %v: value %v is not a finite number, but counters must stay finite.", metricName, value)
+	}
+	if value < 0 {
+		return fmt.Errorf("error processing metric %v: value %v is negative, but counters cannot decrease.", metricName, value)
+	}
+	return nil
+}
+
+// Additional fields provided by the input take precedence over the fields of the match.
+func evalTemplate(searchResult matchResult, t template.Template, additionalFields map[string]string) (string, error) {
 	grokValues := make(map[string]string, len(t.ReferencedGrokFields()))
 	for _, field := range t.ReferencedGrokFields() {
+		if value, ok := additionalFields[field]; ok {
+			grokValues[field] = value
+			continue
+		}
 		value, err := searchResult.GetCaptureGroupByName(field)
 		if err != nil {
 			return "", err
@@ -32,10 +32,10 @@ func TestCounterVec(t *testing.T) {
 		},
 	})
 	counter := NewCounterMetric(counterCfg, regex, nil)
-	counter.ProcessMatch("some unrelated line")
-	counter.ProcessMatch("2016-04-26 10:19:57 H=(85.214.241.101) [36.224.138.227] F=<z2007tw@yahoo.com.tw> rejected RCPT <alan.a168@msa.hinet.net>: relay not permitted")
-	counter.ProcessMatch("2016-04-26 12:31:39 H=(186-90-8-31.genericrev.cantv.net) [186.90.8.31] F=<Hans.Krause9@cantv.net> rejected RCPT <ug2seeng-admin@example.com>: Unrouteable address")
-	counter.ProcessMatch("2016-04-26 10:19:57 H=(85.214.241.101) [36.224.138.227] F=<z2007tw@yahoo.com.tw> rejected RCPT <alan.a168@msa.hinet.net>: relay not permitted")
+	counter.ProcessMatch("some unrelated line", nil)
+	counter.ProcessMatch("2016-04-26 10:19:57 H=(85.214.241.101) [36.224.138.227] F=<z2007tw@yahoo.com.tw> rejected RCPT <alan.a168@msa.hinet.net>: relay not permitted", nil)
+	counter.ProcessMatch("2016-04-26 12:31:39 H=(186-90-8-31.genericrev.cantv.net) [186.90.8.31] F=<Hans.Krause9@cantv.net> rejected RCPT <ug2seeng-admin@example.com>: Unrouteable address", nil)
+	counter.ProcessMatch("2016-04-26 10:19:57 H=(85.214.241.101) [36.224.138.227] F=<z2007tw@yahoo.com.tw> rejected RCPT <alan.a168@msa.hinet.net>: relay not permitted", nil)
 
 	switch c := counter.Collector().(type) {
 	case *prometheus.CounterVec:
@@ -60,10 +60,10 @@ func TestCounter(t *testing.T) {
 	})
 	counter := NewCounterMetric(counterCfg, regex, nil)
 
-	counter.ProcessMatch("some unrelated line")
-	counter.ProcessMatch("2016-04-26 10:19:57 H=(85.214.241.101) [36.224.138.227] F=<z2007tw@yahoo.com.tw> rejected RCPT <alan.a168@msa.hinet.net>: relay not permitted")
-	counter.ProcessMatch("2016-04-26 12:31:39 H=(186-90-8-31.genericrev.cantv.net) [186.90.8.31] F=<Hans.Krause9@cantv.net> rejected RCPT <ug2seeng-admin@example.com>: Unrouteable address")
-	counter.ProcessMatch("2016-04-26 10:19:57 H=(85.214.241.101) [36.224.138.227] F=<z2007tw@yahoo.com.tw> rejected RCPT <alan.a168@msa.hinet.net>: relay not permitted")
+	counter.ProcessMatch("some unrelated line", nil)
+	counter.ProcessMatch("2016-04-26 10:19:57 H=(85.214.241.101) [36.224.138.227] F=<z2007tw@yahoo.com.tw> rejected RCPT <alan.a168@msa.hinet.net>: relay not permitted", nil)
+	counter.ProcessMatch("2016-04-26 12:31:39 H=(186-90-8-31.genericrev.cantv.net) [186.90.8.31] F=<Hans.Krause9@cantv.net> rejected RCPT <ug2seeng-admin@example.com>: Unrouteable address", nil)
+	counter.ProcessMatch("2016-04-26 10:19:57 H=(85.214.241.101) [36.224.138.227] F=<z2007tw@yahoo.com.tw> rejected RCPT <alan.a168@msa.hinet.net>: relay not permitted", nil)
 
 	switch c := counter.Collector().(type) {
 	case prometheus.Counter:
@@ -98,8 +98,8 @@ func TestGauge(t *testing.T) {
 	})
 	gauge := NewGaugeMetric(gaugeCfg, regex, nil)
 
-	gauge.ProcessMatch("Temperature in Berlin: 32")
-	gauge.ProcessMatch("Temperature in Moscow: -5")
+	gauge.ProcessMatch("Temperature in Berlin: 32", nil)
+	gauge.ProcessMatch("Temperature in Moscow: -5", nil)
 
 	switch c := gauge.Collector().(type) {
 	case prometheus.Gauge:
@@ -122,8 +122,8 @@ func TestGaugeCumulative(t *testing.T) {
 	})
 	gauge := NewGaugeMetric(gaugeCfg, regex, nil)
 
-	gauge.ProcessMatch("Temperature in Berlin: 32")
-	gauge.ProcessMatch("Temperature in Moscow: -5")
+	gauge.ProcessMatch("Temperature in Berlin: 32", nil)
+	gauge.ProcessMatch("Temperature in Moscow: -5", nil)
 
 	switch c := gauge.Collector().(type) {
 	case prometheus.Gauge:
@@ -148,9 +148,9 @@ func TestGaugeVec(t *testing.T) {
 	})
 	gauge := NewGaugeMetric(gaugeCfg, regex, nil)
 
-	gauge.ProcessMatch("Temperature in Berlin: 32")
-	gauge.ProcessMatch("Temperature in Moscow: -5")
-	gauge.ProcessMatch("Temperature in Berlin: 31")
+	gauge.ProcessMatch("Temperature in Berlin: 32", nil)
+	gauge.ProcessMatch("Temperature in Moscow: -5", nil)
+	gauge.ProcessMatch("Temperature in Berlin: 31", nil)
 
 	switch c := gauge.Collector().(type) {
 	case *prometheus.GaugeVec:
@@ -184,3 +184,262 @@ func newMetricConfig(t *testing.T, cfg *configuration.MetricConfig) *configurati
 	}
 	return cfg
 }
+
+func TestJsonGaugeVec(t *testing.T) {
+	gaugeCfg := newMetricConfig(t, &configuration.MetricConfig{
+		Name:   "temperature",
+		Format: "json",
+		Fields: map[string]string{
+			"city":        "location.city",
+			"temperature": "temperature",
+		},
+		Value: "{{.temperature}}",
+		Labels: map[string]string{
+			"city": "{{.city}}",
+		},
+	})
+	err := VerifyFieldNames(gaugeCfg, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gauge := NewGaugeMetric(gaugeCfg, nil, nil)
+
+	gauge.ProcessMatch(`{"location": {"city": "Berlin"}, "temperature": 32}`, nil)
+	gauge.ProcessMatch(`{"location": {"city": "Moscow"}, "temperature": -5}`, nil)
+	gauge.ProcessMatch(`{"location": {"city": "Berlin"}, "temperature": 31}`, nil)
+	gauge.ProcessMatch(`Temperature in Berlin: 30`, nil)
+
+	switch c := gauge.Collector().(type) {
+	case *prometheus.GaugeVec:
+		m := io_prometheus_client.Metric{}
+		c.WithLabelValues("Berlin").Write(&m)
+		if *m.Gauge.Value != float64(31) {
+			t.Errorf("Expected 31 as last observed value in Berlin, but got %v.", *m.Gauge.Value)
+		}
+		c.WithLabelValues("Moscow").Write(&m)
+		if *m.Gauge.Value != float64(-5) {
+			t.Errorf("Expected -5 as last observed value in Moscow, but got %v.", *m.Gauge.Value)
+		}
+	default:
+		t.Errorf("Unexpected type of metric: %v", reflect.TypeOf(c))
+	}
+
+	gaugeCfg.Value = "{{.humidity}}"
+	err = gaugeCfg.InitTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if VerifyFieldNames(gaugeCfg, nil, nil, nil) == nil {
+		t.Error("Expected error for undeclared field humidity.")
+	}
+}
+
+func TestAdditionalFields(t *testing.T) {
+	counterCfg := newMetricConfig(t, &configuration.MetricConfig{
+		Name:   "log_lines_total",
+		Format: "json",
+		Fields: map[string]string{
+			"level": "level",
+		},
+		Labels: map[string]string{
+			"hostname": "{{.hostname}}",
+			"level":    "{{.level}}",
+		},
+	})
+	if VerifyFieldNames(counterCfg, nil, nil, nil) == nil {
+		t.Error("Expected error for field hostname, which is neither declared nor provided by the input.")
+	}
+	err := VerifyFieldNames(counterCfg, nil, nil, []string{"hostname"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter := NewCounterMetric(counterCfg, nil, nil)
+
+	counter.ProcessMatch(`{"level": "info"}`, map[string]string{"hostname": "a"})
+	counter.ProcessMatch(`{"level": "info"}`, map[string]string{"hostname": "b"})
+	counter.ProcessMatch(`{"level": "info"}`, map[string]string{"hostname": "a"})
+
+	switch c := counter.Collector().(type) {
+	case *prometheus.CounterVec:
+		m := io_prometheus_client.Metric{}
+		c.With(prometheus.Labels{"hostname": "a", "level": "info"}).Write(&m)
+		if *m.Counter.Value != float64(2) {
+			t.Errorf("Expected 2 matches for hostname a, but got %v matches.", *m.Counter.Value)
+		}
+	default:
+		t.Errorf("Unexpected type of metric: %v", reflect.TypeOf(c))
+	}
+}
+
+func TestCounterValue(t *testing.T) {
+	counterCfg := newMetricConfig(t, &configuration.MetricConfig{
+		Name:   "bytes_sent_total",
+		Format: "logfmt",
+		Value:  "{{.bytes}}",
+	})
+	counter := NewCounterMetric(counterCfg, nil, nil)
+
+	counter.ProcessMatch(`path=/a bytes=1024`, nil)
+	counter.ProcessMatch(`path=/b bytes=0.5`, nil)
+	_, err := counter.ProcessMatch(`path=/c bytes=-100`, nil)
+	if err == nil {
+		t.Error("Expected error for negative counter value.")
+	}
+	_, err = counter.ProcessMatch(`path=/d bytes=unknown`, nil)
+	if err == nil {
+		t.Error("Expected error for invalid counter value.")
+	}
+	for _, value := range []string{"NaN", "Inf", "+Inf", "-Inf"} {
+		_, err = counter.ProcessMatch(`path=/e bytes=`+value, nil)
+		if err == nil {
+			t.Errorf("Expected error for counter value %v.", value)
+		}
+	}
+
+	switch c := counter.Collector().(type) {
+	case prometheus.Counter:
+		m := io_prometheus_client.Metric{}
+		c.Write(&m)
+		if *m.Counter.Value != float64(1024.5) {
+			t.Errorf("Expected 1024.5 bytes, but got %v.", *m.Counter.Value)
+		}
+	default:
+		t.Errorf("Unexpected type of metric: %v", reflect.TypeOf(c))
+	}
+
+	counterCfg.Labels = map[string]string{"path": "{{.path}}"}
+	counter = NewCounterMetric(newMetricConfig(t, counterCfg), nil, nil)
+
+	counter.ProcessMatch(`path=/a bytes=1024`, nil)
+	counter.ProcessMatch(`path=/a bytes=2048`, nil)
+	_, err = counter.ProcessMatch(`path=/a bytes=-1`, nil)
+	if err == nil {
+		t.Error("Expected error for negative counter value.")
+	}
+	for _, value := range []string{"NaN", "+Inf"} {
+		_, err = counter.ProcessMatch(`path=/a bytes=`+value, nil)
+		if err == nil {
+			t.Errorf("Expected error for counter value %v.", value)
+		}
+	}
+
+	switch c := counter.Collector().(type) {
+	case *prometheus.CounterVec:
+		m := io_prometheus_client.Metric{}
+		c.WithLabelValues("/a").Write(&m)
+		if *m.Counter.Value != float64(3072) {
+			t.Errorf("Expected 3072 bytes for path /a, but got %v.", *m.Counter.Value)
+		}
+	default:
+		t.Errorf("Unexpected type of metric: %v", reflect.TypeOf(c))
+	}
+}
+
+func TestExemplar(t *testing.T) {
+	histogramCfg := newMetricConfig(t, &configuration.MetricConfig{
+		Name:    "request_duration_seconds",
+		Format:  "logfmt",
+		Value:   "{{.duration}}",
+		Buckets: []float64{0.1, 1},
+		Exemplar: map[string]string{
+			"trace_id": "{{.trace}}",
+		},
+	})
+	histogram := NewHistogramMetric(histogramCfg, nil, nil)
+
+	histogram.ProcessMatch(`duration=0.05 trace=abc`, nil)
+	histogram.ProcessMatch(`duration=0.5 trace=def`, nil)
+	histogram.ProcessMatch(`duration=0.6`, nil)
+	_, err := histogram.ProcessMatch(`duration=0.7 trace=0123456789012345678901234567890123456789012345678901234567890123456789`, nil)
+	if err == nil {
+		t.Error("Expected error for exemplar exceeding the length limit.")
+	}
+
+	m := io_prometheus_client.Metric{}
+	histogram.Collector().(prometheus.Histogram).Write(&m)
+	expectExemplar(t, m.Histogram.Bucket[0].Exemplar, "abc")
+	expectExemplar(t, m.Histogram.Bucket[1].Exemplar, "def")
+
+	counterCfg := newMetricConfig(t, &configuration.MetricConfig{
+		Name:   "requests_total",
+		Format: "logfmt",
+		Labels: map[string]string{
+			"path": "{{.path}}",
+		},
+		Exemplar: map[string]string{
+			"trace_id": "{{.trace}}",
+		},
+	})
+	counter := NewCounterMetric(counterCfg, nil, nil)
+
+	counter.ProcessMatch(`path=/a trace=abc`, nil)
+	counter.ProcessMatch(`path=/a`, nil)
+
+	m = io_prometheus_client.Metric{}
+	counter.Collector().(*prometheus.CounterVec).WithLabelValues("/a").(prometheus.Counter).Write(&m)
+	if *m.Counter.Value != float64(2) {
+		t.Errorf("Expected 2 requests, but got %v.", *m.Counter.Value)
+	}
+	expectExemplar(t, m.Counter.Exemplar, "abc")
+}
+
+func expectExemplar(t *testing.T, exemplar *io_prometheus_client.Exemplar, traceId string) {
+	if exemplar == nil {
+		t.Fatalf("Expected exemplar with trace_id %v, but got no exemplar.", traceId)
+	}
+	if len(exemplar.Label) != 1 || exemplar.Label[0].GetName() != "trace_id" || exemplar.Label[0].GetValue() != traceId {
+		t.Errorf("Expected exemplar with trace_id %v, but got %v.", traceId, exemplar.Label)
+	}
+}
+
+func TestMatchInput(t *testing.T) {
+	all := NewPathMatchMetric(nil, nil, nil, nil, nil, nil)
+	webhook := NewPathMatchMetric(nil, nil, nil, nil, nil, []string{"alerts", "events"})
+	for input, expected := range map[string]bool{"alerts": true, "events": true, "file": false} {
+		if !all.MatchInput(input) {
+			t.Errorf("metric without inputs must match input %v", input)
+		}
+		if webhook.MatchInput(input) != expected {
+			t.Errorf("input %v: expected %v", input, expected)
+		}
+	}
+}
+
+func TestWithRegex(t *testing.T) {
+	patterns := InitPatterns()
+	if err := patterns.AddPattern(`NAME \w+`); err != nil {
+		t.Fatal(err)
+	}
+	compile := func() *oniguruma.Regex {
+		regex, err := Compile("login %{NAME:user}", patterns)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return regex
+	}
+	counterCfg := newMetricConfig(t, &configuration.MetricConfig{
+		Name: "logins_total",
+		Labels: map[string]string{
+			"user": "{{.user}}",
+		},
+	})
+	original := NewPathMatchMetric(NewCounterMetric(counterCfg, compile(), nil), nil, nil, nil, nil, []string{"app"})
+	regex := compile()
+	copied := original.WithRegex(regex, nil)
+	if copied.Metric.(*counterVecMetric).regex != regex || original.Metric.(*counterVecMetric).regex == regex {
+		t.Fatal("expected only the copy to use the new regex")
+	}
+	if copied.Collector() != original.Collector() || !copied.MatchInput("app") || copied.MatchInput("other") {
+		t.Fatal("expected the copy to share the collector and the inputs with the original metric")
+	}
+	for _, m := range []*PathMetric{original, copied} {
+		if _, err := m.ProcessMatch("login alice", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := io_prometheus_client.Metric{}
+	original.Collector().(*prometheus.CounterVec).WithLabelValues("alice").Write(&m)
+	if *m.Counter.Value != float64(2) {
+		t.Fatalf("Expected 2 matches, but got %v matches.", *m.Counter.Value)
+	}
+}
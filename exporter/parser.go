@@ -0,0 +1,231 @@
+// Copyright 2016-2018 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	configuration "github.com/sequix/grok_exporter/config/v2"
+)
+
+// Result of matching a log line. Implemented by *oniguruma.SearchResult for grok metrics,
+// and by fieldValues for metrics with a structured log format.
+type matchResult interface {
+	IsMatch() bool
+	GetCaptureGroupByName(name string) (string, error)
+	Free()
+}
+
+// Extracts the fields from log lines in a structured log format.
+// Parsers don't have any state, so they can be used by multiple goroutines.
+type lineParser interface {
+	parse(line string) (matchResult, error)
+}
+
+// Field values extracted by a lineParser, nil if the line did not match.
+type fieldValues map[string]string
+
+func (v fieldValues) IsMatch() bool {
+	return v != nil
+}
+
+// Missing fields are empty, like grok fields in optional parts of a match pattern.
+func (v fieldValues) GetCaptureGroupByName(name string) (string, error) {
+	return v[name], nil
+}
+
+func (v fieldValues) Free() {}
+
+// Returns nil for the grok format, which is matched with regular expressions.
+func newLineParser(cfg *configuration.MetricConfig) lineParser {
+	switch cfg.Format {
+	case "json":
+		return newJsonParser(cfg.Fields)
+	case "logfmt":
+		return &logfmtParser{fields: cfg.Fields}
+	default:
+		return nil
+	}
+}
+
+// Maps field names to paths in JSON objects, like 'request.headers.user_agent'.
+// Numbers in the path are used as array indexes.
+type jsonParser struct {
+	paths map[string][]string
+}
+
+func newJsonParser(fields map[string]string) *jsonParser {
+	paths := make(map[string][]string, len(fields))
+	for name, path := range fields {
+		paths[name] = strings.Split(path, ".")
+	}
+	return &jsonParser{
+		paths: paths,
+	}
+}
+
+// A line matches if it is a JSON object containing all configured fields.
+// Lines that are not valid JSON are not an error, because JSON logs are often mixed with plain text.
+func (p *jsonParser) parse(line string) (matchResult, error) {
+	var obj map[string]interface{}
+	decoder := json.NewDecoder(strings.NewReader(line))
+	decoder.UseNumber()
+	if err := decoder.Decode(&obj); err != nil || obj == nil {
+		return fieldValues(nil), nil
+	}
+	result := make(fieldValues, len(p.paths))
+	for name, path := range p.paths {
+		value, ok := jsonLookup(obj, path)
+		if !ok {
+			return fieldValues(nil), nil
+		}
+		str, err := jsonString(value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read field %v: %v", name, err)
+		}
+		result[name] = str
+	}
+	return result, nil
+}
+
+func jsonLookup(value interface{}, path []string) (interface{}, bool) {
+	for _, key := range path {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if value, ok = v[key]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			value = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// Strings are returned without quotes, numbers as they appear in the log line,
+// objects and arrays as compact JSON.
+func jsonString(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	default:
+		var buf bytes.Buffer
+		encoder := json.NewEncoder(&buf)
+		encoder.SetEscapeHTML(false)
+		if err := encoder.Encode(v); err != nil {
+			return "", err
+		}
+		return strings.TrimSuffix(buf.String(), "\n"), nil
+	}
+}
+
+// Splits lines like 'level=info msg="request done" dur=12ms' into keys and values.
+// All keys are available as fields. Fields maps additional field names to keys,
+// which is useful for keys that cannot be used in templates, like 'http.status'.
+type logfmtParser struct {
+	fields map[string]string
+}
+
+// A line matches if it contains at least one key=value pair and all configured keys.
+func (p *logfmtParser) parse(line string) (matchResult, error) {
+	values, ok := parseLogfmt(line)
+	if !ok {
+		return fieldValues(nil), nil
+	}
+	for name, key := range p.fields {
+		value, exists := values[key]
+		if !exists {
+			return fieldValues(nil), nil
+		}
+		values[name] = value
+	}
+	return values, nil
+}
+
+// Keys without '=' have an empty value. Quoted values may contain Go escape sequences.
+// Returns false if the line is malformed or doesn't contain any key=value pair.
+func parseLogfmt(line string) (fieldValues, bool) {
+	var (
+		result    = make(fieldValues)
+		hasValues = false
+		i         = 0
+	)
+	for {
+		for i < len(line) && line[i] <= ' ' {
+			i++
+		}
+		if i == len(line) {
+			return result, hasValues
+		}
+		start := i
+		for i < len(line) && line[i] > ' ' && line[i] != '=' && line[i] != '"' {
+			i++
+		}
+		key := line[start:i]
+		if len(key) == 0 {
+			return nil, false
+		}
+		if i == len(line) || line[i] != '=' {
+			if i < len(line) && line[i] == '"' {
+				return nil, false
+			}
+			result[key] = ""
+			continue
+		}
+		i++ // skip '='
+		hasValues = true
+		if i < len(line) && line[i] == '"' {
+			end := i + 1
+			for end < len(line) && line[end] != '"' {
+				if line[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(line) {
+				return nil, false
+			}
+			value, err := strconv.Unquote(line[i : end+1])
+			if err != nil {
+				return nil, false
+			}
+			result[key] = value
+			i = end + 1
+		} else {
+			start = i
+			for i < len(line) && line[i] > ' ' {
+				i++
+			}
+			result[key] = line[start:i]
+		}
+	}
+}
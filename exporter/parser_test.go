@@ -0,0 +1,107 @@
+// Copyright 2016-2018 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"testing"
+)
+
+func expectFields(t *testing.T, parser lineParser, line string, expected map[string]string) {
+	result, err := parser.parse(line)
+	if err != nil {
+		t.Fatalf("%v: unexpected error: %v", line, err)
+	}
+	if expected == nil {
+		if result.IsMatch() {
+			t.Fatalf("%v: expected no match", line)
+		}
+		return
+	}
+	if !result.IsMatch() {
+		t.Fatalf("%v: expected match", line)
+	}
+	for name, expectedValue := range expected {
+		value, err := result.GetCaptureGroupByName(name)
+		if err != nil {
+			t.Fatalf("%v: %v", line, err)
+		}
+		if value != expectedValue {
+			t.Fatalf("%v: expected %v=%q, but got %q", line, name, expectedValue, value)
+		}
+	}
+}
+
+func TestJsonParser(t *testing.T) {
+	parser := newJsonParser(map[string]string{
+		"method":   "request.method",
+		"duration": "duration",
+		"first":    "tags.0",
+	})
+	expectFields(t, parser, `{"request": {"method": "GET"}, "duration": 0.0120, "tags": ["a", "b"]}`, map[string]string{
+		"method":   "GET",
+		"duration": "0.0120",
+		"first":    "a",
+	})
+	expectFields(t, parser, `{"request": {"method": "GET"}, "duration": 12, "tags": [{"a": "<b>"}]}`, map[string]string{
+		"duration": "12",
+		"first":    `{"a":"<b>"}`,
+	})
+	expectFields(t, parser, `{"request": {"method": "GET"}, "duration": null, "tags": [true]}`, map[string]string{
+		"duration": "",
+		"first":    "true",
+	})
+	// missing fields
+	expectFields(t, parser, `{"request": {"method": "GET"}, "duration": 12}`, nil)
+	expectFields(t, parser, `{"request": "GET", "duration": 12, "tags": ["a"]}`, nil)
+	expectFields(t, parser, `{"request": {"method": "GET"}, "duration": 12, "tags": []}`, nil)
+	// not a JSON object
+	expectFields(t, parser, `2019-01-01 12:00:00 GET /index.html`, nil)
+	expectFields(t, parser, `["a", "b"]`, nil)
+	expectFields(t, parser, `null`, nil)
+}
+
+func TestLogfmtParser(t *testing.T) {
+	parser := &logfmtParser{}
+	expectFields(t, parser, `level=info msg="request done" dur=12ms path=/x`, map[string]string{
+		"level": "info",
+		"msg":   "request done",
+		"dur":   "12ms",
+		"path":  "/x",
+		"other": "",
+	})
+	expectFields(t, parser, `msg="say \"hi\"\tnow" debug empty= `, map[string]string{
+		"msg":   "say \"hi\"\tnow",
+		"debug": "",
+		"empty": "",
+	})
+	expectFields(t, parser, `a=1 a=2`, map[string]string{
+		"a": "2",
+	})
+	// no key=value pairs
+	expectFields(t, parser, `just some text`, nil)
+	expectFields(t, parser, ``, nil)
+	// malformed
+	expectFields(t, parser, `msg="unterminated`, nil)
+	expectFields(t, parser, `=value`, nil)
+	expectFields(t, parser, `key"=value`, nil)
+
+	parser = &logfmtParser{fields: map[string]string{"status": "http.status"}}
+	expectFields(t, parser, `http.status=404 method=GET`, map[string]string{
+		"status":      "404",
+		"http.status": "404",
+		"method":      "GET",
+	})
+	expectFields(t, parser, `method=GET`, nil)
+}
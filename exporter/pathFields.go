@@ -0,0 +1,88 @@
+// Copyright 2016-2018 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Template field containing the path of the file the line was read from. It is available in all metrics.
+const PathField = "__path__"
+
+// Extracts template fields from the path of the file the line was read from,
+// like the pod name from /var/log/pods/<namespace>_<pod>_<uid>/<container>/0.log.
+// The fields are the named capture groups of the path_match regular expression.
+type PathFields struct {
+	regex *regexp.Regexp
+}
+
+// Returns nil if pattern is empty. A nil PathFields matches all paths and extracts no fields.
+func NewPathFields(pattern string) (*PathFields, error) {
+	if len(pattern) == 0 {
+		return nil, nil
+	}
+	regex, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid path_match %q: %v", pattern, err)
+	}
+	return &PathFields{regex: regex}, nil
+}
+
+// Names of the fields that can be used in templates, including PathField.
+func (p *PathFields) Names() []string {
+	result := []string{PathField}
+	if p == nil {
+		return result
+	}
+	for _, name := range p.regex.SubexpNames() {
+		if len(name) > 0 {
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+// Adds the captured fields to a copy of fields. Returns false if the path does not match.
+// The fields are not copied if there is nothing to add.
+func (p *PathFields) Extract(path string, fields map[string]string) (map[string]string, bool) {
+	if p == nil {
+		return fields, true
+	}
+	match := p.regex.FindStringSubmatch(path)
+	if match == nil {
+		return nil, false
+	}
+	result := make(map[string]string, len(fields)+len(match))
+	for name, value := range fields {
+		result[name] = value
+	}
+	for i, name := range p.regex.SubexpNames() {
+		if len(name) > 0 {
+			result[name] = match[i]
+		}
+	}
+	return result, true
+}
+
+// Returns a copy of the fields provided by the input with PathField added.
+func WithPathField(fields map[string]string, path string) map[string]string {
+	result := make(map[string]string, len(fields)+1)
+	for name, value := range fields {
+		result[name] = value
+	}
+	result[PathField] = path
+	return result
+}
@@ -0,0 +1,105 @@
+// Copyright 2016-2018 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	io_prometheus_client "github.com/prometheus/client_model/go"
+
+	configuration "github.com/sequix/grok_exporter/config/v2"
+)
+
+func TestPathFields(t *testing.T) {
+	var pathFields *PathFields
+	fields, ok := pathFields.Extract("/var/log/app.log", map[string]string{"a": "b"})
+	if !ok || !reflect.DeepEqual(fields, map[string]string{"a": "b"}) {
+		t.Fatalf("nil path fields must match all paths and keep the fields, got %v", fields)
+	}
+	if _, err := NewPathFields("(?P<pod>"); err == nil {
+		t.Fatal("expected error for invalid regular expression")
+	}
+	pathFields, err := NewPathFields(`^/var/log/pods/(?P<namespace>[^_/]+)_(?P<pod>[^_/]+)_[^/]+/(?P<container>[^/]+)/`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(pathFields.Names(), []string{PathField, "namespace", "pod", "container"}) {
+		t.Fatalf("unexpected names %v", pathFields.Names())
+	}
+	lineFields := WithPathField(nil, "/var/log/pods/default_web-1_1234/nginx/0.log")
+	fields, ok = pathFields.Extract("/var/log/pods/default_web-1_1234/nginx/0.log", lineFields)
+	expected := map[string]string{
+		PathField:   "/var/log/pods/default_web-1_1234/nginx/0.log",
+		"namespace": "default",
+		"pod":       "web-1",
+		"container": "nginx",
+	}
+	if !ok || !reflect.DeepEqual(fields, expected) {
+		t.Fatalf("expected %v, got %v", expected, fields)
+	}
+	if len(lineFields) != 1 {
+		t.Fatalf("the input fields must not be modified, got %v", lineFields)
+	}
+	if _, ok = pathFields.Extract("/var/log/syslog", lineFields); ok {
+		t.Fatal("expected path not to match")
+	}
+}
+
+func TestPathFieldLabels(t *testing.T) {
+	counterCfg := newMetricConfig(t, &configuration.MetricConfig{
+		Name:      "log_lines_total",
+		Format:    "json",
+		Fields:    map[string]string{"level": "level"},
+		PathMatch: `/(?P<service>[^/]+)\.log$`,
+		Labels: map[string]string{
+			"service": "{{.service}}",
+			"file":    "{{.__path__}}",
+		},
+	})
+	pathFields, err := NewPathFields(counterCfg.PathMatch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if VerifyFieldNames(counterCfg, nil, nil, nil) == nil {
+		t.Error("Expected error for the fields from the path, which are not declared without path_match.")
+	}
+	if err = VerifyFieldNames(counterCfg, nil, nil, pathFields.Names()); err != nil {
+		t.Fatal(err)
+	}
+	counter := NewPathMatchMetric(NewCounterMetric(counterCfg, nil, nil), nil, nil, nil, pathFields, nil)
+
+	for _, path := range []string{"/var/log/web.log", "/var/log/web.log", "/var/log/db.log"} {
+		fields, ok := counter.PathFields(path, WithPathField(nil, path))
+		if !ok {
+			t.Fatalf("%v: expected path to match", path)
+		}
+		if _, err = counter.ProcessMatch(`{"level": "info"}`, fields); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	switch c := counter.Collector().(type) {
+	case *prometheus.CounterVec:
+		m := io_prometheus_client.Metric{}
+		c.With(prometheus.Labels{"service": "web", "file": "/var/log/web.log"}).Write(&m)
+		if *m.Counter.Value != float64(2) {
+			t.Errorf("Expected 2 matches for service web, but got %v matches.", *m.Counter.Value)
+		}
+	default:
+		t.Errorf("Unexpected type of metric: %v", reflect.TypeOf(c))
+	}
+}
@@ -18,14 +18,18 @@ import (
 	"flag"
 	"fmt"
 	"github.com/sequix/grok_exporter/log"
+	"net/http"
 	"os"
+	"os/signal"
+	"sort"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 
-	"github.com/sequix/grok_exporter/config"
 	"github.com/sequix/grok_exporter/config/v2"
 	"github.com/sequix/grok_exporter/exporter"
 	"github.com/sequix/grok_exporter/oniguruma"
@@ -54,16 +58,12 @@ func main() {
 		return
 	}
 	validateCommandLineOrExit()
-	cfg, warn, err := config.LoadConfigFile(*configPath)
+	cfg, warn, err := loadConfig(*configPath)
 	exitOnError(err)
 	if len(warn) > 0 && !*showConfig {
 		// warning is suppressed when '-showconfig' is used
 		fmt.Fprintf(os.Stderr, "%v\n", warn)
 	}
-	cfg.LoadEnvironments()
-	if len(*logLevel) > 0 {
-		cfg.Global.LogLevel = *logLevel
-	}
 	if *showConfig {
 		fmt.Printf("%v\n", cfg)
 		return
@@ -75,23 +75,44 @@ func main() {
 	for _, m := range metrics {
 		prometheus.MustRegister(m.Collector())
 	}
-	nLinesTotal, nMatchesByMetric, procTimeMicrosecondsByMetric, nErrorsByMetric := initSelfMonitoring(metrics)
+	selfMonitoring := initSelfMonitoring(metrics, inputNames(cfg))
 
 	logger, err := log.Init(cfg)
 	exitOnError(err)
 
-	tail, err := startTailer(cfg, logger)
+	workers, err := newWorkerPool(cfg, patterns, metrics)
+	exitOnError(err)
+	workers.start(selfMonitoring, logger)
+
+	inputs := newInputChannels()
+	running, err := startInputs(cfg, patterns, inputs, logger)
 	exitOnError(err)
 
+	st := &state{
+		cfg:      cfg,
+		patterns: patterns,
+		metrics:  metrics,
+		workers:  workers,
+		inputs:   running,
+	}
+
 	// gather up the handlers with which to start the webserver
+	reloadRequests := make(chan chan error)
 	httpHandlers := []exporter.HttpServerPathHandler{}
 	httpHandlers = append(httpHandlers, exporter.HttpServerPathHandler{
 		Path:    cfg.Server.Path,
-		Handler: prometheus.Handler()})
-	if cfg.Input.Type == "webhook" {
-		httpHandlers = append(httpHandlers, exporter.HttpServerPathHandler{
-			Path:    cfg.Input.WebhookPath,
-			Handler: tailer.WebhookHandler()})
+		Handler: metricsHandler()})
+	httpHandlers = append(httpHandlers, exporter.HttpServerPathHandler{
+		Path:    reloadPath,
+		Handler: reloadHandler(reloadRequests)})
+	for _, input := range cfg.AllInputs() {
+		if input.Type == "webhook" {
+			for _, path := range tailer.WebhookPaths(input) {
+				httpHandlers = append(httpHandlers, exporter.HttpServerPathHandler{
+					Path:    path,
+					Handler: tailer.WebhookHandler(input.WebhookPath)})
+			}
+		}
 	}
 
 	fmt.Print(startMsg(cfg, httpHandlers))
@@ -99,61 +120,43 @@ func main() {
 
 	retentionTicker := time.NewTicker(cfg.Global.RetentionCheckInterval)
 
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+
 	for {
 		select {
 		case err := <-serverErrors:
 			exitOnError(fmt.Errorf("server error: %v", err.Error()))
-		case err := <-tail.Errors():
+		case inputErr := <-inputs.errors:
+			err := inputErr.err
 			if err.Type() == fswatcher.Structured {
 				errS := err.(*fswatcher.StructuredError)
-				logger.WithField("err", errS.Cause()).WithFields(errS.KVs).Error(errS.Error())
+				logger.WithField("input", inputErr.input).WithField("err", errS.Cause()).WithFields(errS.KVs).Error(errS.Error())
 				continue
 			}
-			logger.WithField("err", err).Error(err.Error())
-		case line := <-tail.Lines():
-			matched := false
-			for _, metric := range metrics {
-				start := time.Now()
-				if !metric.MatchPath(line.File) {
-					continue
-				}
-				match, err := metric.ProcessMatch(line.Line)
-				if err != nil {
-					logger.WithFields(map[string]interface{}{
-						"line": line.Line,
-						"err":  err,
-					}).Warn("process matching, skip log line")
-					nErrorsByMetric.WithLabelValues(metric.Name()).Inc()
-				}
-				if match != nil {
-					nMatchesByMetric.WithLabelValues(metric.Name()).Inc()
-					procTimeMicrosecondsByMetric.WithLabelValues(metric.Name()).Add(float64(time.Since(start).Nanoseconds() / int64(1000)))
-					matched = true
-				}
-				_, err = metric.ProcessDeleteMatch(line.Line)
-				if err != nil {
-					logger.WithFields(map[string]interface{}{
-						"line": line.Line,
-						"err":  err,
-					}).Warn("process delete match, skip log line")
-					nErrorsByMetric.WithLabelValues(metric.Name()).Inc()
-				}
-				// TODO: create metric to monitor number of matching delete_patterns
-			}
-			if matched {
-				nLinesTotal.WithLabelValues(number_of_lines_matched_label).Inc()
-			} else {
-				nLinesTotal.WithLabelValues(number_of_lines_ignored_label).Inc()
-			}
+			logger.WithField("input", inputErr.input).WithField("err", err).Error(err.Error())
+		case line := <-inputs.lines:
+			st.workers.process(line)
 		case <-retentionTicker.C:
-			for _, metric := range metrics {
+			for _, metric := range st.metrics {
 				err = metric.ProcessRetention()
 				if err != nil {
 					fmt.Fprintf(os.Stderr, "WARNING: error while processing retention on metric %v: %v", metric.Name(), err)
-					nErrorsByMetric.WithLabelValues(metric.Name()).Inc()
+					// Retention is not related to an input, so the input label is empty.
+					selfMonitoring.nErrorsByMetric.WithLabelValues(metric.Name(), "").Inc()
 				}
 			}
 			// TODO: create metric to monitor number of metrics cleaned up via retention
+		case <-sighup:
+			st, _ = reloadAndReport(st, inputs, selfMonitoring, logger)
+			retentionTicker.Stop()
+			retentionTicker = time.NewTicker(st.cfg.Global.RetentionCheckInterval)
+		case result := <-reloadRequests:
+			var err error
+			st, err = reloadAndReport(st, inputs, selfMonitoring, logger)
+			retentionTicker.Stop()
+			retentionTicker = time.NewTicker(st.cfg.Global.RetentionCheckInterval)
+			result <- err
 		}
 	}
 }
@@ -216,53 +219,106 @@ func initPatterns(cfg *v2.Config) (*exporter.Patterns, error) {
 func createMetrics(cfg *v2.Config, patterns *exporter.Patterns) ([]*exporter.PathMetric, error) {
 	result := make([]*exporter.PathMetric, 0, len(cfg.Metrics))
 	for _, m := range cfg.Metrics {
-		var (
-			regex, deleteRegex *oniguruma.Regex
-			err                error
-		)
-		regex, err = exporter.Compile(m.Match, patterns)
+		metric, err := createMetric(m, patterns, metricInputFields(m, cfg))
 		if err != nil {
-			return nil, fmt.Errorf("failed to initialize metric %v: %v", m.Name, err.Error())
+			return nil, err
 		}
-		if len(m.DeleteMatch) > 0 {
-			deleteRegex, err = exporter.Compile(m.DeleteMatch, patterns)
-			if err != nil {
-				return nil, fmt.Errorf("failed to initialize metric %v: %v", m.Name, err.Error())
+		result = append(result, metric)
+	}
+	return result, nil
+}
+
+// The additionalFields are the names of the fields provided by the inputs, see metricInputFields().
+func createMetric(m v2.MetricConfig, patterns *exporter.Patterns, additionalFields []string) (*exporter.PathMetric, error) {
+	regex, deleteRegex, err := compileRegexes(m, patterns)
+	if err != nil {
+		return nil, err
+	}
+	pathFields, err := exporter.NewPathFields(m.PathMatch)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize metric %v: %v", m.Name, err.Error())
+	}
+	fields := append(append([]string{}, additionalFields...), pathFields.Names()...)
+	err = exporter.VerifyFieldNames(&m, regex, deleteRegex, fields)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize metric %v: %v", m.Name, err.Error())
+	}
+	filter := exporter.NewLineFilter(m.Filter)
+	err = verifyFilterFieldNames(filter, fields)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize metric %v: %v", m.Name, err.Error())
+	}
+	path, err := globsFromPathes(m.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize metric %v: %v", m.Name, err.Error())
+	}
+	excludes, err := globsFromPathes(m.Excludes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize metric %v: %v", m.Name, err.Error())
+	}
+	switch m.Type {
+	case "counter":
+		mt := exporter.NewCounterMetric(&m, regex, deleteRegex)
+		return exporter.NewPathMatchMetric(mt, path, excludes, filter, pathFields, m.Inputs), nil
+	case "gauge":
+		mt := exporter.NewGaugeMetric(&m, regex, deleteRegex)
+		return exporter.NewPathMatchMetric(mt, path, excludes, filter, pathFields, m.Inputs), nil
+	case "histogram":
+		mt := exporter.NewHistogramMetric(&m, regex, deleteRegex)
+		return exporter.NewPathMatchMetric(mt, path, excludes, filter, pathFields, m.Inputs), nil
+	case "summary":
+		mt := exporter.NewSummaryMetric(&m, regex, deleteRegex)
+		return exporter.NewPathMatchMetric(mt, path, excludes, filter, pathFields, m.Inputs), nil
+	default:
+		return nil, fmt.Errorf("Failed to initialize metrics: Metric type %v is not supported.", m.Type)
+	}
+}
+
+// The filter is evaluated before the match, so only the fields provided by the input can be used.
+func verifyFilterFieldNames(filter *exporter.LineFilter, fields []string) error {
+	for _, name := range filter.FieldNames() {
+		found := false
+		for _, field := range fields {
+			if name == field {
+				found = true
+				break
 			}
 		}
-		err = exporter.VerifyFieldNames(&m, regex, deleteRegex)
-		if err != nil {
-			return nil, fmt.Errorf("failed to initialize metric %v: %v", m.Name, err.Error())
+		if !found {
+			return fmt.Errorf("filter field %v is not provided by the input", name)
 		}
-		path, err := globsFromPathes(m.Path)
+	}
+	return nil
+}
+
+// The match regex is nil for structured formats like json, which don't have a match pattern.
+func compileRegexes(m v2.MetricConfig, patterns *exporter.Patterns) (regex, deleteRegex *oniguruma.Regex, err error) {
+	if len(m.Match) > 0 {
+		regex, err = exporter.Compile(m.Match, patterns)
 		if err != nil {
-			return nil, fmt.Errorf("failed to initialize metric %v: %v", m.Name, err.Error())
+			return nil, nil, fmt.Errorf("failed to initialize metric %v: %v", m.Name, err.Error())
 		}
-		excludes, err := globsFromPathes(m.Excludes)
+	}
+	if len(m.DeleteMatch) > 0 {
+		deleteRegex, err = exporter.Compile(m.DeleteMatch, patterns)
 		if err != nil {
-			return nil, fmt.Errorf("failed to initialize metric %v: %v", m.Name, err.Error())
-		}
-		switch m.Type {
-		case "counter":
-			mt := exporter.NewCounterMetric(&m, regex, deleteRegex)
-			result = append(result, exporter.NewPathMatchMetric(mt, path, excludes))
-		case "gauge":
-			mt := exporter.NewGaugeMetric(&m, regex, deleteRegex)
-			result = append(result, exporter.NewPathMatchMetric(mt, path, excludes))
-		case "histogram":
-			mt := exporter.NewHistogramMetric(&m, regex, deleteRegex)
-			result = append(result, exporter.NewPathMatchMetric(mt, path, excludes))
-		case "summary":
-			mt := exporter.NewSummaryMetric(&m, regex, deleteRegex)
-			result = append(result, exporter.NewPathMatchMetric(mt, path, excludes))
-		default:
-			return nil, fmt.Errorf("Failed to initialize metrics: Metric type %v is not supported.", m.Type)
+			return nil, nil, fmt.Errorf("failed to initialize metric %v: %v", m.Name, err.Error())
 		}
 	}
-	return result, nil
+	return regex, deleteRegex, nil
+}
+
+type selfMonitoring struct {
+	nLinesTotal                  *prometheus.CounterVec
+	nMatchesByMetric             *prometheus.CounterVec
+	nFilteredByMetric            *prometheus.CounterVec
+	procTimeMicrosecondsByMetric *prometheus.CounterVec
+	nErrorsByMetric              *prometheus.CounterVec
+	nSeriesDroppedByMetric       *prometheus.CounterVec
+	configLastReloadSuccessful   prometheus.Gauge
 }
 
-func initSelfMonitoring(metrics []*exporter.PathMetric) (*prometheus.CounterVec, *prometheus.CounterVec, *prometheus.CounterVec, *prometheus.CounterVec) {
+func initSelfMonitoring(metrics []*exporter.PathMetric, inputs []string) *selfMonitoring {
 	buildInfo := prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "grok_exporter_build_info",
 		Help: "A metric with a constant '1' value labeled by version, builddate, branch, revision, goversion, and platform on which grok_exporter was built.",
@@ -270,36 +326,170 @@ func initSelfMonitoring(metrics []*exporter.PathMetric) (*prometheus.CounterVec,
 	nLinesTotal := prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "grok_exporter_lines_total",
 		Help: "Total number of log lines processed by grok_exporter.",
-	}, []string{"status"})
+	}, []string{"status", "input"})
 	nMatchesByMetric := prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "grok_exporter_lines_matching_total",
 		Help: "Number of lines matched for each metric. Note that one line can be matched by multiple metrics.",
-	}, []string{"metric"})
+	}, []string{"metric", "input"})
+	nFilteredByMetric := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "grok_exporter_lines_filtered_total",
+		Help: "Number of lines skipped by the filter of each metric before the match pattern was evaluated.",
+	}, []string{"metric", "input"})
 	procTimeMicrosecondsByMetric := prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "grok_exporter_lines_processing_time_microseconds_total",
 		Help: "Processing time in microseconds for each metric. Divide by grok_exporter_lines_matching_total to get the averge processing time for one log line.",
-	}, []string{"metric"})
+	}, []string{"metric", "input"})
 	nErrorsByMetric := prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "grok_exporter_line_processing_errors_total",
 		Help: "Number of errors for each metric. If this is > 0 there is an error in the configuration file. Check grok_exporter's console output.",
-	}, []string{"metric"})
+	}, []string{"metric", "input"})
+	nSeriesDroppedByMetric := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "grok_exporter_series_dropped_total",
+		Help: "Number of time series dropped, evicted, or collapsed into the overflow time series, because the metric reached max_series.",
+	}, []string{"metric", "input"})
+	configLastReloadSuccessful := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "grok_exporter_config_last_reload_successful",
+		Help: "Whether the last configuration reload attempt was successful. If this is 0, grok_exporter keeps running with the previous configuration.",
+	})
 
 	prometheus.MustRegister(buildInfo)
 	prometheus.MustRegister(nLinesTotal)
 	prometheus.MustRegister(nMatchesByMetric)
+	prometheus.MustRegister(nFilteredByMetric)
 	prometheus.MustRegister(procTimeMicrosecondsByMetric)
 	prometheus.MustRegister(nErrorsByMetric)
+	prometheus.MustRegister(nSeriesDroppedByMetric)
+	prometheus.MustRegister(configLastReloadSuccessful)
 
 	buildInfo.WithLabelValues(exporter.Version, exporter.BuildDate, exporter.Branch, exporter.Revision, exporter.GoVersion, exporter.Platform).Set(1)
-	// Initializing a value with zero makes the label appear. Otherwise the label is not shown until the first value is observed.
-	nLinesTotal.WithLabelValues(number_of_lines_matched_label).Add(0)
-	nLinesTotal.WithLabelValues(number_of_lines_ignored_label).Add(0)
+	configLastReloadSuccessful.Set(1)
+	result := &selfMonitoring{
+		nLinesTotal:                  nLinesTotal,
+		nMatchesByMetric:             nMatchesByMetric,
+		nFilteredByMetric:            nFilteredByMetric,
+		procTimeMicrosecondsByMetric: procTimeMicrosecondsByMetric,
+		nErrorsByMetric:              nErrorsByMetric,
+		nSeriesDroppedByMetric:       nSeriesDroppedByMetric,
+		configLastReloadSuccessful:   configLastReloadSuccessful,
+	}
+	result.addInputs(inputs)
+	result.addMetrics(metrics, inputs)
+	return result
+}
+
+func (s *selfMonitoring) addInputs(inputs []string) {
+	for _, input := range inputs {
+		// Initializing a value with zero makes the label appear. Otherwise the label is not shown until the first value is observed.
+		s.nLinesTotal.WithLabelValues(number_of_lines_matched_label, input).Add(0)
+		s.nLinesTotal.WithLabelValues(number_of_lines_ignored_label, input).Add(0)
+	}
+}
+
+func (s *selfMonitoring) removeInputs(inputs []string) {
+	for _, input := range inputs {
+		s.nLinesTotal.DeleteLabelValues(number_of_lines_matched_label, input)
+		s.nLinesTotal.DeleteLabelValues(number_of_lines_ignored_label, input)
+	}
+}
+
+// Only the inputs that the metric reads get a label value.
+func (s *selfMonitoring) addMetrics(metrics []*exporter.PathMetric, inputs []string) {
+	for _, metric := range metrics {
+		for _, input := range inputs {
+			if !metric.MatchInput(input) {
+				continue
+			}
+			s.nMatchesByMetric.WithLabelValues(metric.Name(), input).Add(0)
+			s.nFilteredByMetric.WithLabelValues(metric.Name(), input).Add(0)
+			s.procTimeMicrosecondsByMetric.WithLabelValues(metric.Name(), input).Add(0)
+			s.nErrorsByMetric.WithLabelValues(metric.Name(), input).Add(0)
+			s.nSeriesDroppedByMetric.WithLabelValues(metric.Name(), input).Add(0)
+		}
+	}
+}
+
+func (s *selfMonitoring) removeMetrics(metrics []*exporter.PathMetric, inputs []string) {
 	for _, metric := range metrics {
-		nMatchesByMetric.WithLabelValues(metric.Name()).Add(0)
-		procTimeMicrosecondsByMetric.WithLabelValues(metric.Name()).Add(0)
-		nErrorsByMetric.WithLabelValues(metric.Name()).Add(0)
+		for _, input := range inputs {
+			s.nMatchesByMetric.DeleteLabelValues(metric.Name(), input)
+			s.nFilteredByMetric.DeleteLabelValues(metric.Name(), input)
+			s.procTimeMicrosecondsByMetric.DeleteLabelValues(metric.Name(), input)
+			s.nErrorsByMetric.DeleteLabelValues(metric.Name(), input)
+			s.nSeriesDroppedByMetric.DeleteLabelValues(metric.Name(), input)
+		}
+	}
+}
+
+func inputNames(cfg *v2.Config) []string {
+	result := make([]string, 0, len(cfg.Inputs))
+	for _, input := range cfg.AllInputs() {
+		result = append(result, input.Name)
+	}
+	return result
+}
+
+// Names of the fields that all inputs read by the metric add to fswatcher.Line.Fields.
+func metricInputFields(m v2.MetricConfig, cfg *v2.Config) []string {
+	var result []string
+	first := true
+	for _, input := range cfg.AllInputs() {
+		if len(m.Inputs) > 0 && !contains(m.Inputs, input.Name) {
+			continue
+		}
+		fields := inputFields(input)
+		if first {
+			result = fields
+			first = false
+			continue
+		}
+		intersection := make([]string, 0, len(result))
+		for _, field := range result {
+			if contains(fields, field) {
+				intersection = append(intersection, field)
+			}
+		}
+		result = intersection
 	}
-	return nLinesTotal, nMatchesByMetric, procTimeMicrosecondsByMetric, nErrorsByMetric
+	return result
+}
+
+func contains(list []string, s string) bool {
+	for _, elem := range list {
+		if elem == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Names of the fields that the input adds to fswatcher.Line.Fields.
+func inputFields(cfg *v2.InputConfig) []string {
+	switch cfg.Type {
+	case "syslog":
+		return tailer.SyslogFields
+	case "kubernetes":
+		return tailer.KubernetesFields
+	case "journald":
+		return tailer.JournaldFields
+	case "webhook":
+		result := make([]string, 0, len(cfg.WebhookFields))
+		for name := range cfg.WebhookFields {
+			result = append(result, name)
+		}
+		sort.Strings(result)
+		return result
+	default:
+		return nil
+	}
+}
+
+// Like promhttp.Handler(), but serves the OpenMetrics format if the scraper negotiates it,
+// because exemplars are only exposed in the OpenMetrics format.
+func metricsHandler() http.Handler {
+	return promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{
+			EnableOpenMetrics: true,
+		}))
 }
 
 func startServer(cfg v2.ServerConfig, httpHandlers []exporter.HttpServerPathHandler) chan error {
@@ -322,68 +512,146 @@ func startServer(cfg v2.ServerConfig, httpHandlers []exporter.HttpServerPathHand
 	return serverErrors
 }
 
-func startTailer(cfg *v2.Config, logger logrus.FieldLogger) (fswatcher.Interface, error) {
+// Starts the tailer for cfg. For file inputs, pos is used to store the read offsets, for journald the cursor.
+// If pos is nil, a new position store is created. The lines and errors are forwarded to channels.
+func startInput(cfg *v2.InputConfig, patterns *exporter.Patterns, pos position.Interface, channels *inputChannels, logger logrus.FieldLogger) (*input, error) {
+	var (
+		multilineCfg *tailer.MultilineConfig
+		err          error
+	)
+	logger = logger.WithField("input", cfg.Name)
+	if cfg.Multiline != nil {
+		multilineCfg, err = createMultilineConfig(cfg, patterns)
+		if err != nil {
+			return nil, err
+		}
+	}
+	newPos := false
+	if (cfg.Type == "file" || cfg.Type == "kubernetes" || cfg.Type == "journald" && cfg.JournaldSource != "stdin") && pos == nil {
+		pos, err = position.New(logger, cfg.PositionFile, cfg.SyncInterval)
+		if err != nil {
+			return nil, err
+		}
+		newPos = true
+	}
+	tail, err := startTailer(cfg, multilineCfg, pos, logger)
+	if err != nil {
+		if newPos {
+			pos.Stop()
+		}
+		return nil, err
+	}
+	result := newInput(cfg, pos, tail)
+	go result.forward(channels)
+	return result, nil
+}
+
+func createMultilineConfig(input *v2.InputConfig, patterns *exporter.Patterns) (*tailer.MultilineConfig, error) {
+	cfg := input.Multiline
+	result := &tailer.MultilineConfig{
+		MaxLines:     cfg.MaxLines,
+		MaxWait:      cfg.MaxWait,
+		SourceFields: tailer.MultilineSourceFields(input),
+	}
+	var err error
+	if len(cfg.Start) > 0 {
+		result.Start, err = exporter.Compile(cfg.Start, patterns)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize multiline start pattern: %v", err.Error())
+		}
+	}
+	if len(cfg.Continue) > 0 {
+		result.Continue, err = exporter.Compile(cfg.Continue, patterns)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize multiline continue pattern: %v", err.Error())
+		}
+	}
+	return result, nil
+}
+
+// If multilineCfg is not nil, multi-line events are merged before the lines are buffered.
+func startTailer(cfg *v2.InputConfig, multilineCfg *tailer.MultilineConfig, pos position.Interface, logger logrus.FieldLogger) (fswatcher.Interface, error) {
 	var tail fswatcher.Interface
 
-	gs, err := globsFromPathes(cfg.Input.Path)
+	gs, err := globsFromPathes(cfg.Path)
 	if err != nil {
 		return nil, err
 	}
 
-	excludes, err := globsFromPathes(cfg.Input.Excludes)
+	excludes, err := globsFromPathes(cfg.Excludes)
 	if err != nil {
 		return nil, err
 	}
 
 	switch {
-	case cfg.Input.Type == "file":
-		pos, err := position.New(logger, cfg.Input.PositionFile, cfg.Input.SyncInterval)
-		if err != nil {
-			return nil, err
-		}
-		if cfg.Input.CollectMode == "mixed" {
-			logger.Infof("Start watching %v, excludes %v", cfg.Input.Path, cfg.Input.Excludes)
+	case cfg.Type == "file" || cfg.Type == "kubernetes":
+		if cfg.CollectMode == "mixed" {
+			logger.Infof("Start watching %v, excludes %v", cfg.Path, cfg.Excludes)
 			tail, err = fswatcher.RunFileTailer(
 				gs,
 				excludes,
 				pos,
-				cfg.Input.MaxLineSize,
-				cfg.Input.MaxLinesRatePerFile,
-				cfg.Input.PollInterval,
-				cfg.Input.IdleTimeout,
+				cfg.MaxLineSize,
+				fswatcher.NewRateLimit(cfg.MaxLinesRatePerFile, cfg.Name),
+				cfg.PollInterval,
+				cfg.IdleTimeout,
 				logger,
 			)
-		} else if cfg.Input.CollectMode == "poll" {
-			logger.Infof("Start polling for %q", cfg.Input.Path)
+		} else if cfg.CollectMode == "poll" {
+			logger.Infof("Start polling for %q", cfg.Path)
 			tail, err = fswatcher.RunPollingFileTailer(
 				gs,
 				excludes,
 				pos,
-				cfg.Input.PollInterval,
-				cfg.Input.IdleTimeout,
+				fswatcher.NewRateLimit(cfg.MaxLinesRatePerFile, cfg.Name),
+				cfg.PollInterval,
+				cfg.IdleTimeout,
 				logger,
 			)
 		} else {
-			return nil, fmt.Errorf("unknown collect mode %q", cfg.Input.CollectMode)
+			return nil, fmt.Errorf("unknown collect mode %q", cfg.CollectMode)
 		}
 		if err != nil {
 			return nil, err
 		}
-	case cfg.Input.Type == "stdin":
+		if cfg.Type == "kubernetes" {
+			tail = tailer.KubernetesTailer(tail, cfg.KubernetesMetadataFile, logger)
+		}
+	case cfg.Type == "stdin":
 		tail = tailer.RunStdinTailer()
-	case cfg.Input.Type == "webhook":
-		tail = tailer.InitWebhookTailer(&cfg.Input)
+	case cfg.Type == "webhook":
+		tail = tailer.InitWebhookTailer(cfg)
+	case cfg.Type == "syslog":
+		tail, err = tailer.RunSyslogTailer(cfg, logger)
+		if err != nil {
+			return nil, err
+		}
+	case cfg.Type == "journald":
+		tail = tailer.RunJournaldTailer(cfg, pos, logger)
 	default:
-		return nil, fmt.Errorf("Config error: Input type '%v' unknown.", cfg.Input.Type)
+		return nil, fmt.Errorf("Config error: Input type '%v' unknown.", cfg.Type)
+	}
+	if multilineCfg != nil {
+		tail = tailer.MultilineTailer(tail, multilineCfg, logger)
+	}
+	bufferLoadMetric := exporter.NewBufferLoadMetric(logger, cfg.MaxLinesInBuffer > 0, cfg.Name)
+	buffered, err := tailer.BufferedTailerWithMetrics(tail, bufferLoadMetric, logger, tailer.BufferConfig{
+		MaxLines:     cfg.MaxLinesInBuffer,
+		Overflow:     cfg.BufferOverflow,
+		SpillDir:     cfg.BufferSpillDirectory,
+		SpillMaxSize: cfg.BufferSpillMaxSize,
+	})
+	if err != nil {
+		tail.Close()
+		return nil, err
 	}
-	bufferLoadMetric := exporter.NewBufferLoadMetric(logger, cfg.Input.MaxLinesInBuffer > 0)
-	return tailer.BufferedTailerWithMetrics(tail, bufferLoadMetric, logger, cfg.Input.MaxLinesInBuffer), nil
+	return buffered, nil
 }
 
 func globsFromPathes(pathes []string) ([]glob.Glob, error) {
 	gs := make([]glob.Glob, 0, len(pathes))
 	for _, path := range pathes {
-		g, err := glob.FromPath(path)
+		g, err := glob.Parse(path)
 		if err != nil {
 			return nil, err
 		}
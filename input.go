@@ -0,0 +1,142 @@
+// Copyright 2016-2018 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"github.com/sequix/grok_exporter/config/v2"
+	"github.com/sequix/grok_exporter/exporter"
+	"github.com/sequix/grok_exporter/tailer/fswatcher"
+	"github.com/sequix/grok_exporter/tailer/position"
+)
+
+// A running input, see startInput().
+type input struct {
+	cfg        *v2.InputConfig
+	pos        position.Interface // nil unless the input stores read positions
+	tail       fswatcher.Interface
+	pending    *fswatcher.Line // the line that forward() was sending when the input was stopped
+	done       chan struct{}
+	terminated chan struct{}
+}
+
+// An error reported by the tailer of an input.
+type inputError struct {
+	input string
+	err   fswatcher.Error
+}
+
+// The lines and errors of all inputs are merged, so that the main loop processes them like the lines of a single input.
+// The channels are never closed, they are used by the inputs after a config reload as well.
+type inputChannels struct {
+	lines  chan *fswatcher.Line
+	errors chan inputError
+}
+
+func newInputChannels() *inputChannels {
+	return &inputChannels{
+		lines:  make(chan *fswatcher.Line),
+		errors: make(chan inputError),
+	}
+}
+
+func newInput(cfg *v2.InputConfig, pos position.Interface, tail fswatcher.Interface) *input {
+	return &input{
+		cfg:        cfg,
+		pos:        pos,
+		tail:       tail,
+		done:       make(chan struct{}),
+		terminated: make(chan struct{}),
+	}
+}
+
+// Starts all inputs of cfg. If an input cannot be started, the inputs that were already started are stopped.
+func startInputs(cfg *v2.Config, patterns *exporter.Patterns, channels *inputChannels, logger logrus.FieldLogger) ([]*input, error) {
+	result := make([]*input, 0, len(cfg.Inputs))
+	for _, inputCfg := range cfg.AllInputs() {
+		in, err := startInput(inputCfg, patterns, nil, channels, logger)
+		if err != nil {
+			for _, started := range result {
+				started.stop(nil)
+				started.stopPositions()
+			}
+			return nil, err
+		}
+		result = append(result, in)
+	}
+	return result, nil
+}
+
+// Sets the input name and forwards the lines and errors of the tailer until the input is stopped.
+func (in *input) forward(channels *inputChannels) {
+	defer close(in.terminated)
+	for {
+		select {
+		case line, ok := <-in.tail.Lines():
+			if !ok {
+				return
+			}
+			line.Input = in.cfg.Name
+			select {
+			case channels.lines <- line:
+			case <-in.done:
+				in.pending = line
+				return
+			}
+		case err, ok := <-in.tail.Errors():
+			if !ok {
+				return
+			}
+			select {
+			case channels.errors <- inputError{input: in.cfg.Name, err: err}:
+			case <-in.done:
+				return
+			}
+		case <-in.done:
+			return
+		}
+	}
+}
+
+// Stops forwarding and closes the tailer. The position store keeps running, so that it can be passed to a new input.
+// The positions of the lines that were read but not forwarded yet may already be stored, so these lines are passed to process,
+// including the lines that the tailer passes on while it is closed. If process is nil, these lines are discarded.
+func (in *input) stop(process func(line *fswatcher.Line)) {
+	close(in.done)
+	<-in.terminated
+	if in.pending != nil && process != nil {
+		process(in.pending)
+	}
+	closed := make(chan struct{})
+	go func() {
+		stopTailer(in.tail)
+		close(closed)
+	}()
+	for line := range in.tail.Lines() {
+		if process != nil {
+			line.Input = in.cfg.Name
+			process(line)
+		}
+	}
+	<-closed
+}
+
+// Stop() syncs the positions to the position file, so a new position store continues where we stopped.
+func (in *input) stopPositions() {
+	if in.pos != nil {
+		in.pos.Stop()
+	}
+}
@@ -0,0 +1,355 @@
+// Copyright 2016-2018 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+
+	"github.com/sequix/grok_exporter/config"
+	"github.com/sequix/grok_exporter/config/v2"
+	"github.com/sequix/grok_exporter/exporter"
+	"github.com/sequix/grok_exporter/tailer/fswatcher"
+	"github.com/sequix/grok_exporter/tailer/position"
+)
+
+const reloadPath = "/-/reload"
+
+// Everything that is replaced when the config file is reloaded.
+type state struct {
+	cfg      *v2.Config
+	patterns *exporter.Patterns
+	metrics  []*exporter.PathMetric
+	workers  *workerPool
+	inputs   []*input
+}
+
+func loadConfig(path string) (*v2.Config, string, error) {
+	cfg, warn, err := config.LoadConfigFile(path)
+	if err != nil {
+		return nil, warn, err
+	}
+	cfg.LoadEnvironments()
+	if len(*logLevel) > 0 {
+		cfg.Global.LogLevel = *logLevel
+	}
+	return cfg, warn, nil
+}
+
+// POST /-/reload triggers a reload in the main loop and waits for the result.
+func reloadHandler(requests chan chan error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "only POST requests are allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// Buffered, so that the main loop doesn't block if the client is gone before the reload is done.
+		result := make(chan error, 1)
+		select {
+		case requests <- result:
+		case <-r.Context().Done():
+			return
+		}
+		var err error
+		select {
+		case err = <-result:
+		case <-r.Context().Done():
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to reload config: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// Reloads the config file. If the reload fails, the current state is returned unchanged.
+func reloadAndReport(cur *state, channels *inputChannels, selfMonitoring *selfMonitoring, logger logrus.FieldLogger) (*state, error) {
+	logger.WithField("config", *configPath).Info("reloading config")
+	next, err := reload(cur, channels, logger)
+	if err != nil {
+		logger.WithField("err", err).Error("failed to reload config, keep running with the previous config")
+		selfMonitoring.configLastReloadSuccessful.Set(0)
+		return cur, err
+	}
+	// Lines that are already queued are processed with the previous metrics before the new workers start.
+	cur.workers.stop()
+	next.workers.start(selfMonitoring, logger)
+	curInputs, nextInputs := inputNames(cur.cfg), inputNames(next.cfg)
+	selfMonitoring.removeMetrics(removedMetrics(cur.metrics, next.metrics), curInputs)
+	selfMonitoring.removeMetrics(next.metrics, removedInputs(curInputs, nextInputs))
+	selfMonitoring.removeInputs(removedInputs(curInputs, nextInputs))
+	selfMonitoring.addInputs(nextInputs)
+	selfMonitoring.addMetrics(next.metrics, nextInputs)
+	selfMonitoring.configLastReloadSuccessful.Set(1)
+	logger.Info("config reloaded")
+	return next, nil
+}
+
+func reload(cur *state, channels *inputChannels, logger logrus.FieldLogger) (*state, error) {
+	cfg, warn, err := loadConfig(*configPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(warn) > 0 {
+		logger.Warn(warn)
+	}
+	inputsChanged, err := checkInputChanges(cur.cfg, cfg)
+	if err != nil {
+		return nil, err
+	}
+	patterns, err := initPatterns(cfg)
+	if err != nil {
+		return nil, err
+	}
+	metrics, err := reuseOrCreateMetrics(cur, cfg, patterns)
+	if err != nil {
+		return nil, err
+	}
+	workers, err := newWorkerPool(cfg, patterns, metrics)
+	if err != nil {
+		return nil, err
+	}
+	err = swapMetrics(cur.metrics, metrics)
+	if err != nil {
+		return nil, err
+	}
+	next := &state{
+		cfg:      cfg,
+		patterns: patterns,
+		metrics:  metrics,
+		workers:  workers,
+		inputs:   cur.inputs,
+	}
+	if inputsChanged {
+		next.inputs, err = restartInputs(cur, cfg, patterns, channels, logger)
+		if err != nil {
+			// The metrics were registered successfully before, so rolling back cannot fail.
+			swapMetrics(metrics, cur.metrics)
+			return nil, err
+		}
+	}
+	for _, section := range []struct {
+		name     string
+		old, new interface{}
+	}{
+		{"server", cur.cfg.Server, cfg.Server},
+		{"log_rotate", &cur.cfg.LogRotate, &cfg.LogRotate},
+		{"global.log_level", cur.cfg.Global.LogLevel, cfg.Global.LogLevel},
+		{"global.log_to", cur.cfg.Global.LogTo, cfg.Global.LogTo},
+	} {
+		if !reflect.DeepEqual(section.old, section.new) {
+			logger.Warnf("changes to '%v' are ignored until grok_exporter is restarted", section.name)
+		}
+	}
+	return next, nil
+}
+
+// Metrics that did not change keep their current state, all other metrics are created from scratch.
+func reuseOrCreateMetrics(cur *state, cfg *v2.Config, patterns *exporter.Patterns) ([]*exporter.PathMetric, error) {
+	patternsChanged := !reflect.DeepEqual(cur.patterns, patterns)
+	result := make([]*exporter.PathMetric, 0, len(cfg.Metrics))
+	for _, m := range cfg.Metrics {
+		if !patternsChanged {
+			if old := findUnchangedMetric(cur, m); old != nil {
+				result = append(result, old)
+				continue
+			}
+		}
+		metric, err := createMetric(m, patterns, metricInputFields(m, cfg))
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, metric)
+	}
+	return result, nil
+}
+
+func findUnchangedMetric(cur *state, m v2.MetricConfig) *exporter.PathMetric {
+	for i, oldCfg := range cur.cfg.Metrics {
+		if oldCfg.Name == m.Name && metricConfigString(oldCfg) == metricConfigString(m) {
+			return cur.metrics[i]
+		}
+	}
+	return nil
+}
+
+// YAML representation of the metric config. The parsed templates are not included.
+func metricConfigString(m v2.MetricConfig) string {
+	out, err := yaml.Marshal(m)
+	if err != nil {
+		return fmt.Sprintf("ERROR: Failed to marshal metric config: %v", err.Error())
+	}
+	return string(out)
+}
+
+// Unregisters the collectors of the old metrics and registers the collectors of the new metrics.
+// Collectors that are present in both lists remain untouched.
+// If a new collector cannot be registered, the old collectors are restored.
+func swapMetrics(oldMetrics, newMetrics []*exporter.PathMetric) error {
+	for _, m := range removedMetrics(oldMetrics, newMetrics) {
+		prometheus.Unregister(m.Collector())
+	}
+	added := removedMetrics(newMetrics, oldMetrics)
+	for i, m := range added {
+		err := prometheus.Register(m.Collector())
+		if err != nil {
+			for _, registered := range added[:i] {
+				prometheus.Unregister(registered.Collector())
+			}
+			for _, m := range removedMetrics(oldMetrics, newMetrics) {
+				prometheus.MustRegister(m.Collector())
+			}
+			return fmt.Errorf("failed to register metric %v: %v", m.Name(), err)
+		}
+	}
+	return nil
+}
+
+// Returns the metrics from a that are not in b.
+func removedMetrics(a, b []*exporter.PathMetric) []*exporter.PathMetric {
+	result := make([]*exporter.PathMetric, 0)
+	for _, m := range a {
+		found := false
+		for _, other := range b {
+			if m == other {
+				found = true
+				break
+			}
+		}
+		if !found {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+// Returns true if inputs were added, removed, or changed. Only inputs of type file can be reloaded.
+func checkInputChanges(cur, next *v2.Config) (bool, error) {
+	changed := false
+	for _, name := range append(inputNames(cur), removedInputs(inputNames(next), inputNames(cur))...) {
+		curInput, nextInput := findInput(cur, name), findInput(next, name)
+		if curInput != nil && nextInput != nil && reflect.DeepEqual(*curInput, *nextInput) {
+			continue
+		}
+		if curInput != nil && curInput.Type != "file" || nextInput != nil && nextInput.Type != "file" {
+			return false, fmt.Errorf("changes to input '%v' can only be reloaded for input type file, restart grok_exporter to apply them", name)
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+// Returns nil if there is no input with that name.
+func findInput(cfg *v2.Config, name string) *v2.InputConfig {
+	for _, input := range cfg.AllInputs() {
+		if input.Name == name {
+			return input
+		}
+	}
+	return nil
+}
+
+// Returns the input names from a that are not in b.
+func removedInputs(a, b []string) []string {
+	result := make([]string, 0)
+	for _, name := range a {
+		if !contains(b, name) {
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+// Stops the inputs that were changed or removed, and starts the inputs that were changed or added. Other inputs keep running.
+// The lines that the stopped inputs have read, but not passed to the main loop yet, are processed by the current workers.
+// The position store of an input is kept if the position file did not change, so that no log lines are processed twice.
+// If a new input cannot be started, the previous inputs are restarted and cur is updated accordingly.
+func restartInputs(cur *state, cfg *v2.Config, patterns *exporter.Patterns, channels *inputChannels, logger logrus.FieldLogger) ([]*input, error) {
+	positions := make(map[string]position.Interface) // input name -> position store to continue with
+	stopped := make([]*input, 0)
+	for _, in := range cur.inputs {
+		nextCfg := findInput(cfg, in.cfg.Name)
+		if nextCfg != nil && reflect.DeepEqual(*in.cfg, *nextCfg) {
+			continue
+		}
+		in.stop(cur.workers.process)
+		stopped = append(stopped, in)
+		if nextCfg != nil && in.cfg.PositionFile == nextCfg.PositionFile && in.cfg.SyncInterval == nextCfg.SyncInterval {
+			positions[in.cfg.Name] = in.pos
+		} else {
+			in.stopPositions()
+		}
+	}
+	result := make([]*input, 0, len(cfg.Inputs))
+	started := make([]*input, 0)
+	for _, inputCfg := range cfg.AllInputs() {
+		if in := findRunningInput(cur.inputs, inputCfg.Name); in != nil && reflect.DeepEqual(*in.cfg, *inputCfg) {
+			result = append(result, in)
+			continue
+		}
+		in, err := startInput(inputCfg, patterns, positions[inputCfg.Name], channels, logger)
+		if err != nil {
+			for _, in := range started {
+				in.stop(cur.workers.process)
+				if in.pos != positions[in.cfg.Name] {
+					in.stopPositions()
+				}
+			}
+			for _, in := range stopped {
+				restarted, restartErr := startInput(in.cfg, cur.patterns, positions[in.cfg.Name], channels, logger)
+				if restartErr != nil {
+					exitOnError(fmt.Errorf("%v: failed to restart the previous input %v: %v", err, in.cfg.Name, restartErr))
+				}
+				for i := range cur.inputs {
+					if cur.inputs[i] == in {
+						cur.inputs[i] = restarted
+					}
+				}
+			}
+			return nil, err
+		}
+		started = append(started, in)
+		result = append(result, in)
+	}
+	return result, nil
+}
+
+// Returns nil if there is no running input with that name.
+func findRunningInput(inputs []*input, name string) *input {
+	for _, in := range inputs {
+		if in.cfg.Name == name {
+			return in
+		}
+	}
+	return nil
+}
+
+func stopTailer(tail fswatcher.Interface) {
+	// Close() may block while the tailer is sending errors, so we keep consuming them until the tailer is closed.
+	errors := tail.Errors()
+	go func() {
+		for range errors {
+		}
+	}()
+	tail.Close()
+}
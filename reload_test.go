@@ -0,0 +1,321 @@
+// Copyright 2016-2018 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+const reloadTestConfig = `
+global:
+    config_version: 2
+inputs:
+    - name: app
+      type: file
+      path:
+      - %v
+      readall: true
+      position_file: %v
+      position_sync_interval: 10s
+%v
+grok:
+    additional_patterns:
+    - 'GREETING hello'
+metrics:
+    - type: counter
+      name: reload_test_unchanged_total
+      help: Counts hello lines.
+      match: 'hello'
+    - type: counter
+      name: reload_test_changed_total
+      help: Counts hello lines.
+      match: '%v'
+%v
+`
+
+func TestReloadKeepsUnchangedMetrics(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	writeReloadTestConfig(t, dir, "", "hello", "")
+	channels := newInputChannels()
+	cur := startTestState(t, channels)
+	for _, m := range cur.metrics {
+		if _, err := m.ProcessMatch("hello", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeReloadTestConfig(t, dir, "", "hello|hi", "")
+	next, err := reload(cur, channels, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopTestState(next)
+	if next.metrics[0] != cur.metrics[0] || next.metrics[1] == cur.metrics[1] {
+		t.Fatal("expected the unchanged metric to be reused and the changed metric to be replaced")
+	}
+	if next.inputs[0] != cur.inputs[0] {
+		t.Fatal("expected the unchanged input to keep running")
+	}
+	expectCounterValue(t, "reload_test_unchanged_total", 1)
+	expectCounterValue(t, "reload_test_changed_total", 0)
+}
+
+func TestReloadRollbackOnError(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	writeReloadTestConfig(t, dir, "", "hello", "")
+	channels := newInputChannels()
+	cur := startTestState(t, channels)
+	defer stopTestState(cur)
+	running := cur.inputs[0]
+
+	// The new position file is corrupt, so the changed input cannot be started.
+	corrupt := filepath.Join(dir, "corrupt.json")
+	if err := ioutil.WriteFile(corrupt, []byte("not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	writeReloadTestConfig(t, dir, "", "hello", "    - type: counter\n      name: reload_test_added_total\n      help: Added by the reload.\n      match: 'hello'\n")
+	cfg, err := ioutil.ReadFile(*configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg = []byte(strings.Replace(string(cfg), filepath.Join(dir, "positions.json"), corrupt, 1))
+	if err = ioutil.WriteFile(*configPath, cfg, 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = reload(cur, channels, testLogger())
+	if err == nil {
+		t.Fatal("expected the reload to fail because of the corrupt position file")
+	}
+	if _, registered := counterValue(t, "reload_test_added_total"); registered {
+		t.Fatal("the metric of the failed reload is still registered")
+	}
+	expectCounterValue(t, "reload_test_unchanged_total", 0)
+	if cur.inputs[0] == running || cur.inputs[0].cfg != running.cfg {
+		t.Fatal("expected the previous input to be restarted with the previous config")
+	}
+
+	// The restarted input continues reading the log file.
+	appendLog(t, dir, "hello")
+	select {
+	case line := <-channels.lines:
+		if line.Line != "hello" || line.Input != "app" {
+			t.Fatalf("unexpected line %q from input %q", line.Line, line.Input)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout while waiting for the restarted input")
+	}
+}
+
+// The lines that the changed input has read, but that were not passed to the main loop yet, are processed before the input is replaced.
+func TestReloadProcessesLinesOfStoppedInput(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	writeReloadTestConfig(t, dir, "", "hello", "")
+	channels := newInputChannels()
+	cur := startTestState(t, channels)
+	cur.workers = newTestWorkerPool(t, cur.cfg, cur.patterns, cur.metrics)
+	cur.workers.start(testSelfMonitoring, testLogger())
+
+	for i := 0; i < 3; i++ {
+		appendLog(t, dir, "hello")
+	}
+	// The main loop is busy with the reload, so only the first line is passed on.
+	select {
+	case line := <-channels.lines:
+		cur.workers.process(line)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout while waiting for the first line")
+	}
+	time.Sleep(500 * time.Millisecond) // the other lines are read, but not passed on
+
+	cfg, err := ioutil.ReadFile(*configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg = []byte(strings.Replace(string(cfg), "position_sync_interval: 10s", "position_sync_interval: 20s", 1))
+	if err = ioutil.WriteFile(*configPath, cfg, 0644); err != nil {
+		t.Fatal(err)
+	}
+	next, err := reload(cur, channels, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopTestState(next)
+	if next.inputs[0] == cur.inputs[0] {
+		t.Fatal("expected the changed input to be restarted")
+	}
+	cur.workers.stop()
+	expectCounterValue(t, "reload_test_unchanged_total", 3)
+}
+
+func TestReloadRejectsNonFileInputChanges(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	writeReloadTestConfig(t, dir, "    - name: hook\n      type: webhook\n      webhook_path: /reload-test\n", "hello", "")
+	channels := newInputChannels()
+	cur := startTestState(t, channels)
+	defer stopTestState(cur)
+
+	writeReloadTestConfig(t, dir, "    - name: hook\n      type: webhook\n      webhook_path: /reload-test-changed\n", "hello", "")
+	_, err := reload(cur, channels, testLogger())
+	if err == nil || !strings.Contains(err.Error(), "changes to input 'hook' can only be reloaded for input type file") {
+		t.Fatalf("expected an error for the changed webhook input, but got %v", err)
+	}
+}
+
+func TestReloadHandler(t *testing.T) {
+	requests := make(chan chan error)
+	go func() {
+		result := <-requests
+		result <- fmt.Errorf("invalid config")
+	}()
+	w := httptest.NewRecorder()
+	reloadHandler(requests).ServeHTTP(w, httptest.NewRequest(http.MethodPost, reloadPath, nil))
+	if w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), "invalid config") {
+		t.Fatalf("unexpected response %v %q", w.Code, w.Body.String())
+	}
+
+	// Nobody reads the requests, so the handler must return when the client is gone.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		reloadHandler(requests).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, reloadPath, nil).WithContext(ctx))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reload handler blocked after the request was canceled")
+	}
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "grok_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func writeReloadTestConfig(t *testing.T, dir, additionalInputs, match, additionalMetrics string) {
+	path := filepath.Join(dir, "config.yml")
+	cfg := fmt.Sprintf(reloadTestConfig, filepath.Join(dir, "app.log"), filepath.Join(dir, "positions.json"), additionalInputs, match, additionalMetrics)
+	if err := ioutil.WriteFile(path, []byte(cfg), 0644); err != nil {
+		t.Fatal(err)
+	}
+	*configPath = path
+}
+
+func appendLog(t *testing.T, dir, line string) {
+	f, err := os.OpenFile(filepath.Join(dir, "app.log"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err = f.WriteString(line + "\n"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testLogger() logrus.FieldLogger {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	return logger
+}
+
+// Like main(), but the workers are not started, because the tests process the lines themselves.
+func startTestState(t *testing.T, channels *inputChannels) *state {
+	cfg, _, err := loadConfig(*configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patterns, err := initPatterns(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics, err := createMetrics(cfg, patterns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = swapMetrics(nil, metrics); err != nil {
+		t.Fatal(err)
+	}
+	workers, err := newWorkerPool(cfg, patterns, metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputs, err := startInputs(cfg, patterns, channels, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &state{
+		cfg:      cfg,
+		patterns: patterns,
+		metrics:  metrics,
+		workers:  workers,
+		inputs:   inputs,
+	}
+}
+
+func stopTestState(st *state) {
+	for _, in := range st.inputs {
+		if in.cfg.Type != "file" {
+			continue // webhook tailers are never closed, so their inputs cannot be stopped
+		}
+		in.stop(nil)
+		in.stopPositions()
+	}
+	st.workers.stop()
+	swapMetrics(st.metrics, nil)
+}
+
+// Returns false if the counter is not registered.
+func counterValue(t *testing.T, name string) (float64, bool) {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() == name {
+			return family.GetMetric()[0].GetCounter().GetValue(), true
+		}
+	}
+	return 0, false
+}
+
+func expectCounterValue(t *testing.T, name string, expected float64) {
+	value, registered := counterValue(t, name)
+	if !registered {
+		t.Fatalf("%v is not registered", name)
+	}
+	if value != expected {
+		t.Fatalf("expected %v to be %v, but got %v", name, expected, value)
+	}
+}
@@ -22,9 +22,10 @@ import (
 
 // implements fswatcher.Interface
 type bufferedTailer struct {
-	out  chan *fswatcher.Line
-	orig fswatcher.Interface
-	done chan struct{}
+	out        chan *fswatcher.Line
+	orig       fswatcher.Interface
+	buffer     lineBuffer
+	terminated chan struct{} // closed when the producer stopped, i.e. the bufferLoadMetric is unregistered
 }
 
 func (b *bufferedTailer) Lines() chan *fswatcher.Line {
@@ -35,13 +36,28 @@ func (b *bufferedTailer) Errors() chan fswatcher.Error {
 	return b.orig.Errors()
 }
 
+// The lines that the original tailer passes on while it is closed, like pending multi-line events, are still buffered,
+// because their positions may already be stored. Close() returns when the original tailer is closed.
+// The buffered lines remain available in Lines() until it is closed, with buffer_overflow spill they are kept in the spill directory instead.
 func (b *bufferedTailer) Close() {
+	// Unblocks the producer if buffer_overflow is block, so that it can read the remaining lines until the original tailer is closed.
+	b.buffer.StopBlocking()
 	b.orig.Close()
-	close(b.done)
+	<-b.terminated
+}
+
+// What the buffered tailer does when MaxLines is reached.
+type BufferConfig struct {
+	MaxLines         int    // 0 means unlimited
+	Overflow         string // "drop" (default) clears the buffer, "spill" writes lines to SpillDir, "block" blocks the tailer
+	SpillDir         string
+	SpillMaxSize     int64 // in bytes, 0 means unlimited
+	spillSegmentSize int64 // 0 means defaultSpillSegmentSize, smaller segments are used in tests
 }
 
 func BufferedTailer(orig fswatcher.Interface) fswatcher.Interface {
-	return BufferedTailerWithMetrics(orig, &noopMetric{}, log.New(), 0)
+	result, _ := BufferedTailerWithMetrics(orig, &noopMetric{}, log.New(), BufferConfig{})
+	return result
 }
 
 // Wrapper around a tailer that consumes the lines channel quickly.
@@ -49,6 +65,9 @@ func BufferedTailer(orig fswatcher.Interface) fswatcher.Interface {
 // and does not need to wait until the lines are processed.
 // The number of buffered lines are exposed as a Prometheus metric, if lines are constantly
 // produced faster than they are consumed, we will eventually run out of memory.
+// Therefore, the number of lines can be limited, see BufferConfig for what happens when the limit is reached.
+// An error is returned if the spill directory cannot be read.
+// The lines channel must be consumed until it is closed, see Close().
 //
 // ---
 // The buffered tailer prevents the following error (this can be reproduced on Windows,
@@ -103,26 +122,55 @@ func BufferedTailer(orig fswatcher.Interface) fswatcher.Interface {
 //
 // To minimize the risk, use the buffered tailer to make sure file system events are handled
 // as quickly as possible without waiting for the grok patterns to be processed.
-func BufferedTailerWithMetrics(orig fswatcher.Interface, bufferLoadMetric BufferLoadMetric, log logrus.FieldLogger, maxLinesInBuffer int) fswatcher.Interface {
-	buffer := NewLineBuffer()
+func BufferedTailerWithMetrics(orig fswatcher.Interface, bufferLoadMetric BufferLoadMetric, log logrus.FieldLogger, cfg BufferConfig) (fswatcher.Interface, error) {
+	var (
+		buffer           lineBuffer
+		maxLinesInBuffer int // only for "drop", the other modes are implemented in boundedLineBuffer
+	)
+	switch {
+	case cfg.MaxLines > 0 && cfg.Overflow == "spill":
+		segmentSize := cfg.spillSegmentSize
+		if segmentSize == 0 {
+			segmentSize = defaultSpillSegmentSize
+		}
+		spill, err := openSpillQueue(cfg.SpillDir, segmentSize)
+		if err != nil {
+			return nil, err
+		}
+		if spill.Len() > 0 {
+			log.Infof("Reading %v lines spilled to %v before the last shutdown.", spill.Len(), cfg.SpillDir)
+			bufferLoadMetric.Set(int64(spill.Len()))
+		}
+		buffer = newBoundedLineBuffer(cfg.MaxLines, spill, cfg.SpillMaxSize, bufferLoadMetric, log)
+	case cfg.MaxLines > 0 && cfg.Overflow == "block":
+		buffer = newBoundedLineBuffer(cfg.MaxLines, nil, 0, bufferLoadMetric, log)
+	default:
+		buffer = NewLineBuffer()
+		maxLinesInBuffer = cfg.MaxLines
+	}
 	out := make(chan *fswatcher.Line)
-	done := make(chan struct{})
+	terminated := make(chan struct{})
 
 	// producer
 	go func() {
+		defer close(terminated)
 		bufferLoadMetric.Start()
 		for {
 			line, ok := <-orig.Lines()
 			if ok {
 				if maxLinesInBuffer > 0 && buffer.Len() > maxLinesInBuffer-1 {
 					log.Warnf("Line buffer reached limit of %v lines. Dropping lines in buffer.", maxLinesInBuffer)
+					bufferLoadMetric.Dropped(buffer.Len())
 					buffer.Clear()
 					bufferLoadMetric.Set(0)
 				}
-				buffer.Push(line)
-				bufferLoadMetric.Inc()
+				if buffer.Push(line) {
+					bufferLoadMetric.Inc()
+				} else {
+					bufferLoadMetric.Dropped(1)
+				}
 			} else {
-				buffer.Close()
+				buffer.Finish()
 				bufferLoadMetric.Stop()
 				return
 			}
@@ -134,22 +182,20 @@ func BufferedTailerWithMetrics(orig fswatcher.Interface, bufferLoadMetric Buffer
 		for {
 			line := buffer.BlockingPop()
 			if line == nil {
-				// buffer closed
+				// buffer closed or finished
 				close(out)
 				return
 			}
 			bufferLoadMetric.Dec()
-			select {
-			case out <- line:
-			case <-done:
-			}
+			out <- line
 		}
 	}()
 	return &bufferedTailer{
-		out:  out,
-		orig: orig,
-		done: done,
-	}
+		out:        out,
+		orig:       orig,
+		buffer:     buffer,
+		terminated: terminated,
+	}, nil
 }
 
 type BufferLoadMetric interface {
@@ -157,13 +203,17 @@ type BufferLoadMetric interface {
 	Inc()            // put a log line into the buffer
 	Dec()            // take a log line from the buffer
 	Set(value int64) // set the current number of lines in the buffer
+	Dropped(lines int)
+	Spilled(bytes int) // bytes written to the spill directory
 	Stop()
 }
 
 type noopMetric struct{}
 
-func (m *noopMetric) Start()          {}
-func (m *noopMetric) Inc()            {}
-func (m *noopMetric) Dec()            {}
-func (m *noopMetric) Set(value int64) {}
-func (m *noopMetric) Stop()           {}
+func (m *noopMetric) Start()            {}
+func (m *noopMetric) Inc()              {}
+func (m *noopMetric) Dec()              {}
+func (m *noopMetric) Set(value int64)   {}
+func (m *noopMetric) Dropped(lines int) {}
+func (m *noopMetric) Spilled(bytes int) {}
+func (m *noopMetric) Stop()             {}
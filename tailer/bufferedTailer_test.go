@@ -18,15 +18,20 @@ import (
 	"fmt"
 	"github.com/sequix/grok_exporter/tailer/fswatcher"
 	"github.com/sirupsen/logrus"
+	"io/ioutil"
 	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 const nTestLines = 10000
 
-var log = logrus.New()
+var testLogger = logrus.New()
 
 type sourceTailer struct {
 	lines chan *fswatcher.Line
@@ -48,7 +53,7 @@ func (tail *sourceTailer) Close() {
 func TestLineBufferSequential_withMetrics(t *testing.T) {
 	src := &sourceTailer{lines: make(chan *fswatcher.Line)}
 	metric := &peakLoadMetric{}
-	buffered := BufferedTailerWithMetrics(src, metric, log, 0)
+	buffered, _ := BufferedTailerWithMetrics(src, metric, testLogger, BufferConfig{})
 	for i := 1; i <= nTestLines; i++ {
 		src.lines <- &fswatcher.Line{Line: fmt.Sprintf("This is line number %v.", i)}
 	}
@@ -82,7 +87,7 @@ func TestLineBufferSequential_withMetrics(t *testing.T) {
 func TestLineBufferParallel_withMetrics(t *testing.T) {
 	src := &sourceTailer{lines: make(chan *fswatcher.Line)}
 	metric := &peakLoadMetric{}
-	buffered := BufferedTailerWithMetrics(src, metric, log, 0)
+	buffered, _ := BufferedTailerWithMetrics(src, metric, testLogger, BufferConfig{})
 	var wg sync.WaitGroup
 	go func() {
 		start := time.Now()
@@ -134,8 +139,11 @@ func TestLineBufferParallel_withMetrics(t *testing.T) {
 
 type peakLoadMetric struct {
 	startCalled, stopCalled bool
+	mutex                   sync.Mutex // Inc() is called by the producer, Dec() by the consumer
 	peakLoad                int64
 	currentLoad             int64
+	dropped                 int64 // updated atomically, lines may be dropped by the producer and the consumer
+	spilled                 int64
 }
 
 func (m *peakLoadMetric) Start() {
@@ -143,6 +151,8 @@ func (m *peakLoadMetric) Start() {
 }
 
 func (m *peakLoadMetric) Inc() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 	m.currentLoad++
 	if m.peakLoad < m.currentLoad {
 		m.peakLoad = m.currentLoad
@@ -150,13 +160,238 @@ func (m *peakLoadMetric) Inc() {
 }
 
 func (m *peakLoadMetric) Dec() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 	m.currentLoad--
 }
 
 func (m *peakLoadMetric) Set(value int64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 	m.currentLoad = value
 }
 
+func (m *peakLoadMetric) Dropped(lines int) {
+	atomic.AddInt64(&m.dropped, int64(lines))
+}
+
+func (m *peakLoadMetric) Spilled(bytes int) {
+	atomic.AddInt64(&m.spilled, int64(bytes))
+}
+
 func (m *peakLoadMetric) Stop() {
 	m.stopCalled = true
 }
+
+func TestBufferOverflowDrop(t *testing.T) {
+	src := &sourceTailer{lines: make(chan *fswatcher.Line)}
+	metric := &peakLoadMetric{}
+	buffered, err := BufferedTailerWithMetrics(src, metric, testLogger, BufferConfig{MaxLines: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 20; i++ {
+		src.lines <- &fswatcher.Line{Line: fmt.Sprintf("line %v", i)}
+	}
+	buffered.Close()
+	if atomic.LoadInt64(&metric.dropped) == 0 {
+		t.Fatal("expected dropped lines")
+	}
+}
+
+func TestBufferOverflowSpill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grok_exporter_spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := BufferConfig{MaxLines: 5, Overflow: "spill", SpillDir: dir, spillSegmentSize: 100}
+	src := &sourceTailer{lines: make(chan *fswatcher.Line)}
+	metric := &peakLoadMetric{}
+	buffered, err := BufferedTailerWithMetrics(src, metric, testLogger, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 50; i++ {
+		src.lines <- &fswatcher.Line{Line: fmt.Sprintf("line %v", i), Fields: map[string]string{"n": fmt.Sprint(i)}}
+	}
+	if segments := spillSegments(t, dir); segments < 2 {
+		t.Fatalf("expected the spilled lines in more than one segment, got %v", segments)
+	}
+	for i := 1; i <= 50; i++ {
+		line := <-buffered.Lines()
+		if line.Line != fmt.Sprintf("line %v", i) || line.Fields["n"] != fmt.Sprint(i) {
+			t.Fatalf("expected line %v, got %+v", i, line)
+		}
+	}
+	if atomic.LoadInt64(&metric.spilled) == 0 || atomic.LoadInt64(&metric.dropped) != 0 {
+		t.Fatalf("expected spilled bytes and no dropped lines, got %v spilled bytes and %v dropped lines", metric.spilled, metric.dropped)
+	}
+	if segments := spillSegments(t, dir); segments != 0 {
+		t.Fatalf("expected the segments to be removed after all lines were read, got %v segments", segments)
+	}
+
+	// The spilled lines are kept on Close() and read by the next buffered tailer.
+	for i := 1; i <= 30; i++ {
+		src.lines <- &fswatcher.Line{Line: fmt.Sprintf("line %v", i)}
+	}
+	for i := 1; i <= 10; i++ {
+		<-buffered.Lines()
+	}
+	buffered.Close()
+	src = &sourceTailer{lines: make(chan *fswatcher.Line)}
+	buffered, err = BufferedTailerWithMetrics(src, &peakLoadMetric{}, testLogger, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer buffered.Close()
+	first := <-buffered.Lines()
+	var next int
+	// The consumer may have taken line 11 from the buffer before it was closed.
+	if first.Line == "line 11" {
+		next = 12
+	} else if first.Line == "line 12" {
+		next = 13
+	} else {
+		t.Fatalf("expected line 11 or 12 after restart, got %q", first.Line)
+	}
+	for i := next; i <= 30; i++ {
+		if line := <-buffered.Lines(); line.Line != fmt.Sprintf("line %v", i) {
+			t.Fatalf("expected line %v after restart, got %q", i, line.Line)
+		}
+	}
+}
+
+func TestBufferOverflowSpillMaxSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grok_exporter_spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := &sourceTailer{lines: make(chan *fswatcher.Line)}
+	metric := &peakLoadMetric{}
+	// Each line is spilled as {"line":"line 10"} and a newline, i.e. 19 bytes.
+	buffered, err := BufferedTailerWithMetrics(src, metric, testLogger, BufferConfig{MaxLines: 1, Overflow: "spill", SpillDir: dir, SpillMaxSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer buffered.Close()
+	for i := 10; i < 30; i++ {
+		src.lines <- &fswatcher.Line{Line: fmt.Sprintf("line %v", i)}
+	}
+	if spilled := atomic.LoadInt64(&metric.spilled); spilled > 100 || spilled == 0 {
+		t.Fatalf("expected at most 100 spilled bytes, got %v", spilled)
+	}
+	if dropped := atomic.LoadInt64(&metric.dropped); dropped == 0 {
+		t.Fatal("expected dropped lines")
+	}
+	prev := 9
+	for i := 0; i < 6; i++ {
+		line := <-buffered.Lines()
+		var n int
+		if _, err := fmt.Sscanf(line.Line, "line %d", &n); err != nil || n <= prev {
+			t.Fatalf("expected lines in order, got %q after line %v", line.Line, prev)
+		}
+		prev = n
+	}
+}
+
+func TestBufferOverflowBlock(t *testing.T) {
+	src := &sourceTailer{lines: make(chan *fswatcher.Line)}
+	metric := &peakLoadMetric{}
+	buffered, err := BufferedTailerWithMetrics(src, metric, testLogger, BufferConfig{MaxLines: 5, Overflow: "block"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sent int64
+	go func() {
+		for i := 1; i <= 20; i++ {
+			src.lines <- &fswatcher.Line{Line: fmt.Sprintf("line %v", i)}
+			atomic.AddInt64(&sent, 1)
+		}
+	}()
+	time.Sleep(200 * time.Millisecond)
+	// 5 lines in the buffer, 1 taken by the consumer, and 1 taken by the producer that is blocked.
+	if n := atomic.LoadInt64(&sent); n > 7 {
+		t.Fatalf("expected the tailer to be blocked, but %v lines were sent", n)
+	}
+	for i := 1; i <= 20; i++ {
+		if line := <-buffered.Lines(); line.Line != fmt.Sprintf("line %v", i) {
+			t.Fatalf("expected line %v, got %q", i, line.Line)
+		}
+	}
+	if dropped := atomic.LoadInt64(&metric.dropped); dropped != 0 {
+		t.Fatalf("expected no dropped lines, got %v", dropped)
+	}
+	buffered.Close()
+}
+
+// Like the multiline tailer, passes on the last lines when it is closed.
+type flushOnCloseTailer struct {
+	sourceTailer
+	last []string
+}
+
+func (tail *flushOnCloseTailer) Close() {
+	for _, line := range tail.last {
+		tail.lines <- &fswatcher.Line{Line: line}
+	}
+	close(tail.lines)
+}
+
+// The lines passed on while the original tailer is closed are buffered, in spill mode the remaining lines are spilled.
+func TestBufferedTailerKeepsLinesOnClose(t *testing.T) {
+	for _, overflow := range []string{"drop", "block", "spill"} {
+		dir, err := ioutil.TempDir("", "grok_exporter_spill")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		cfg := BufferConfig{MaxLines: 2, Overflow: overflow}
+		if overflow == "drop" {
+			cfg.MaxLines = 0
+		} else if overflow == "spill" {
+			cfg.SpillDir = dir
+		}
+		src := &flushOnCloseTailer{sourceTailer{make(chan *fswatcher.Line)}, []string{"line 5", "line 6", "line 7"}}
+		metric := &peakLoadMetric{}
+		buffered, err := BufferedTailerWithMetrics(src, metric, testLogger, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// With buffer_overflow block, the consumer takes one line, two lines are buffered, and the producer waits with the fourth line.
+		for i := 1; i <= 4; i++ {
+			src.lines <- &fswatcher.Line{Line: fmt.Sprintf("line %v", i)}
+		}
+		buffered.Close()
+		var received []string
+		for line := range buffered.Lines() {
+			received = append(received, line.Line)
+		}
+		if overflow == "spill" {
+			src = &flushOnCloseTailer{sourceTailer: sourceTailer{make(chan *fswatcher.Line)}}
+			buffered, err = BufferedTailerWithMetrics(src, &peakLoadMetric{}, testLogger, cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for len(received) < 7 {
+				received = append(received, (<-buffered.Lines()).Line)
+			}
+			buffered.Close()
+		}
+		if strings.Join(received, "|") != "line 1|line 2|line 3|line 4|line 5|line 6|line 7" {
+			t.Fatalf("%v: unexpected lines %q", overflow, received)
+		}
+		if dropped := atomic.LoadInt64(&metric.dropped); dropped != 0 {
+			t.Fatalf("%v: expected no dropped lines, got %v", overflow, dropped)
+		}
+	}
+}
+
+func spillSegments(t *testing.T, dir string) int {
+	matches, err := filepath.Glob(filepath.Join(dir, "*"+spillSegmentSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(matches)
+}
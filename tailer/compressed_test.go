@@ -0,0 +1,111 @@
+package tailer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/sirupsen/logrus"
+
+	"github.com/sequix/grok_exporter/tailer/fswatcher"
+	"github.com/sequix/grok_exporter/tailer/glob"
+	"github.com/sequix/grok_exporter/tailer/position"
+)
+
+func TestCompressedFiles(t *testing.T) {
+	for _, polling := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "grok_exporter_compressed")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		writeCompressed(t, filepath.Join(dir, "app.log.1.gz"), "gz line 1\ngz line 2\n")
+		writeCompressed(t, filepath.Join(dir, "app.log.2.zst"), "zst line 1\nzst line 2")
+		pos := position.NewMemPos()
+
+		tailer := runTestFileTailer(t, filepath.Join(dir, "app.log.*"), pos, nil, polling)
+		lines := make(map[string]string)
+		for i := 0; i < 4; i++ {
+			select {
+			case line := <-tailer.Lines():
+				lines[line.Line] = filepath.Base(line.File)
+			case err := <-tailer.Errors():
+				t.Fatalf("polling=%v: unexpected error: %v", polling, err)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("polling=%v: timeout waiting for line %v, got %v", polling, i+1, lines)
+			}
+		}
+		for line, file := range map[string]string{
+			"gz line 1":  "app.log.1.gz",
+			"gz line 2":  "app.log.1.gz",
+			"zst line 1": "app.log.2.zst",
+			"zst line 2": "app.log.2.zst",
+		} {
+			if lines[line] != file {
+				t.Fatalf("polling=%v: expected %q from %v, got %v", polling, line, file, lines)
+			}
+		}
+		tailer.Close()
+
+		// After a restart, the files must not be read again.
+		tailer = runTestFileTailer(t, filepath.Join(dir, "app.log.*"), pos, nil, polling)
+		select {
+		case line := <-tailer.Lines():
+			t.Fatalf("polling=%v: compressed file was read twice: got %q", polling, line.Line)
+		case err := <-tailer.Errors():
+			t.Fatalf("polling=%v: unexpected error: %v", polling, err)
+		case <-time.After(300 * time.Millisecond):
+		}
+		tailer.Close()
+	}
+}
+
+func runTestFileTailer(t *testing.T, pattern string, pos position.Interface, rateLimit *fswatcher.RateLimit, polling bool) fswatcher.Interface {
+	parsedGlob, err := glob.Parse(pattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	var tailer fswatcher.Interface
+	if polling {
+		tailer, err = fswatcher.RunPollingFileTailer([]glob.Glob{parsedGlob}, []glob.Glob{}, pos, rateLimit, 10*time.Millisecond, 0, logger)
+	} else {
+		tailer, err = fswatcher.RunFileTailer([]glob.Glob{parsedGlob}, []glob.Glob{}, pos, 0, rateLimit, 250*time.Millisecond, 0, logger)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tailer
+}
+
+func writeCompressed(t *testing.T, path string, content string) {
+	var (
+		buf bytes.Buffer
+		w   io.WriteCloser
+		err error
+	)
+	if filepath.Ext(path) == ".zst" {
+		w, err = zstd.NewWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		w = gzip.NewWriter(&buf)
+	}
+	if _, err = w.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
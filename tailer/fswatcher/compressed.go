@@ -0,0 +1,173 @@
+package fswatcher
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/sirupsen/logrus"
+
+	"github.com/sequix/grok_exporter/tailer/position"
+	"github.com/sequix/grok_exporter/util"
+)
+
+// How long to wait before checking again if a compressed file is still being written.
+const compressedFileRetryInterval = time.Second
+
+var errStopped = errors.New("compressed file reader stopped")
+
+// Rotated logs compressed by logrotate, like app.log.1.gz, are not followed like other files.
+// They are read once from the beginning. When the file was read completely, its size is stored as offset,
+// so that it is not read again after a restart.
+type compressedFile struct {
+	path       string
+	devIno     string
+	pos        position.Interface
+	lines      chan *Line
+	errors     chan Error
+	logger     logrus.FieldLogger
+	done       chan struct{}
+	terminated chan struct{}
+}
+
+func isCompressed(path string) bool {
+	return strings.HasSuffix(path, ".gz") || strings.HasSuffix(path, ".zst")
+}
+
+// Returns nil if the file was already read.
+func newCompressedFile(path string, pos position.Interface, lines chan *Line, errs chan Error, logger logrus.FieldLogger) (*compressedFile, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	devIno, err := util.DevInodeNoFromFileInfo(fi)
+	if err != nil {
+		return nil, err
+	}
+	if offset := pos.ResumeOffset(devIno, path); offset > 0 && offset >= fi.Size() {
+		return nil, nil
+	}
+	return &compressedFile{
+		path:       path,
+		devIno:     devIno,
+		pos:        pos,
+		lines:      lines,
+		errors:     errs,
+		logger:     logger.WithField("path", path),
+		done:       make(chan struct{}),
+		terminated: make(chan struct{}),
+	}, nil
+}
+
+func (c *compressedFile) run() {
+	defer close(c.terminated)
+	size, err := c.waitUntilComplete()
+	if err != nil {
+		if err != errStopped {
+			c.sendError(NewErrorf(NotSpecified, err, "reading compressed file %s", c.path))
+		}
+		return
+	}
+	c.logger.Info("reading compressed file")
+	if err = c.readLines(); err != nil {
+		if err != errStopped {
+			c.sendError(NewErrorf(NotSpecified, err, "reading compressed file %s", c.path))
+		}
+		return
+	}
+	c.pos.SetOffset(c.devIno, size)
+}
+
+func (c *compressedFile) stop() {
+	close(c.done)
+	<-c.terminated
+}
+
+// The compressed file is usually created while the compression is still running.
+// Lines are not sent before the file can be decompressed completely, so that no line is sent twice.
+// Returns the size of the complete file.
+func (c *compressedFile) waitUntilComplete() (int64, error) {
+	lastSize := int64(-1)
+	for {
+		fi, err := os.Stat(c.path)
+		if err != nil {
+			return 0, err
+		}
+		if fi.Size() > 0 {
+			err = c.decompress(func(r io.Reader) error {
+				_, err := io.Copy(ioutil.Discard, r)
+				return err
+			})
+			if err == nil {
+				return fi.Size(), nil
+			}
+			if err != io.ErrUnexpectedEOF && err != io.EOF || fi.Size() == lastSize {
+				// The file is corrupt, or it is incomplete but no longer written.
+				return 0, err
+			}
+			lastSize = fi.Size()
+		}
+		select {
+		case <-time.After(compressedFileRetryInterval):
+		case <-c.done:
+			return 0, errStopped
+		}
+	}
+}
+
+func (c *compressedFile) readLines() error {
+	return c.decompress(func(r io.Reader) error {
+		reader := bufio.NewReader(r)
+		for {
+			line, err := reader.ReadString('\n')
+			if len(line) > 0 {
+				select {
+				case c.lines <- &Line{Line: strings.TrimRight(line, "\r\n"), File: c.path}:
+				case <-c.done:
+					return errStopped
+				}
+			}
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	})
+}
+
+func (c *compressedFile) decompress(read func(r io.Reader) error) error {
+	f, err := os.Open(c.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if strings.HasSuffix(c.path, ".zst") {
+		r, err := zstd.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		return read(r)
+	}
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return read(r)
+}
+
+func (c *compressedFile) sendError(err Error) {
+	select {
+	case c.errors <- err:
+	case <-c.done:
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"io"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/sequix/grok_exporter/tailer/position"
 	"github.com/sequix/grok_exporter/util"
@@ -19,6 +20,8 @@ type file struct {
 	pos        position.Interface
 	devIno     string
 	path       string
+	offset     int64        // offset after the last line that was read
+	limiter    *rateLimiter // nil if the lines are not limited
 	done       chan struct{}
 	terminated chan struct{}
 }
@@ -34,7 +37,7 @@ func (p *poller) newFile(path string) (*file, error) {
 		return nil, err
 	}
 
-	offset := p.pos.GetOffset(devIno)
+	offset := p.pos.ResumeOffset(devIno, path)
 	p.logger.Debug(fmt.Sprintf("new file %s at %d", path, offset))
 
 	if _, err := f.Seek(offset, io.SeekStart); err != nil {
@@ -47,6 +50,8 @@ func (p *poller) newFile(path string) (*file, error) {
 		devIno:     devIno,
 		path:       path,
 		pos:        p.pos,
+		offset:     offset,
+		limiter:    p.limiter(path),
 		File:       f,
 		Reader:     bufio.NewReader(f),
 		done:       make(chan struct{}),
@@ -68,15 +73,37 @@ func (f *file) run() {
 				return
 			}
 		} else {
+			// The offset is stored after the line was passed on, so if the file is stopped while waiting,
+			// the line is read again on the next poll.
+			if delay := f.limiter.reserve(); delay > 0 && !f.sleep(delay) {
+				return
+			}
 			select {
 			case f.lines <- line:
 			case <-f.done:
+				f.limiter.cancel()
 				return
 			}
+			f.pos.SetOffset(f.devIno, f.offset)
 		}
 	}
 }
 
+// Returns false if the file was stopped while sleeping.
+func (f *file) sleep(delay time.Duration) bool {
+	start := time.Now()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	defer func() { f.limiter.paused(time.Since(start)) }()
+	select {
+	case <-timer.C:
+		return true
+	case <-f.done:
+		f.limiter.cancel()
+		return false
+	}
+}
+
 func (f *file) finalize() {
 	if err := f.Close(); err != nil {
 		f.errors <- NewErrorf(NotSpecified, err, "close file %s", f.path)
@@ -96,12 +123,8 @@ func (f *file) readline() (*Line, error) {
 		return nil, err
 	}
 
-	// 更新文件偏移
-	offset, err := f.Seek(0, io.SeekCurrent)
-	if err != nil {
-		return nil, err
-	}
-	f.pos.SetOffset(f.devIno, offset)
+	// 更新文件偏移，bufio.Reader 会预读，所以不能用 f.Seek(0, io.SeekCurrent)
+	f.offset += int64(len(lineStr))
 
 	return &Line{
 		Line: strings.TrimRight(lineStr, "\r\n"),
@@ -15,8 +15,10 @@
 package fswatcher
 
 type Line struct {
-	Line string
-	File string
+	Line   string
+	File   string
+	Fields map[string]string // additional fields provided by the input, like the syslog hostname
+	Input  string            // name of the input that read the line, set when the lines of all inputs are merged
 }
 
 type Interface interface {
@@ -22,6 +22,9 @@ type poller struct {
 	pollInterval time.Duration
 	pollingDirs  map[string]struct{}
 	pollingFiles map[string]*file
+	compressed   map[string]*compressedFile // read only once, so they are not restarted on each poll. nil if already read.
+	rateLimit    *RateLimit
+	limiters     map[string]*rateLimiter // kept across polls, so that the limit applies to the file and not to each poll
 	lines        chan *Line
 	errors       chan Error
 	done         chan struct{}
@@ -32,6 +35,7 @@ func RunPollingFileTailer(
 	globs []glob.Glob,
 	excludes []glob.Glob,
 	pos position.Interface,
+	rateLimit *RateLimit,
 	pollInterval time.Duration,
 	// TODO file idle timeout
 	fileIdleTimeout time.Duration,
@@ -50,6 +54,9 @@ func RunPollingFileTailer(
 		pollInterval: pollInterval,
 		pollingDirs:  dirs,
 		pollingFiles: make(map[string]*file),
+		compressed:   make(map[string]*compressedFile),
+		rateLimit:    rateLimit,
+		limiters:     make(map[string]*rateLimiter),
 		lines:        make(chan *Line),
 		errors:       make(chan Error),
 		done:         make(chan struct{}),
@@ -85,6 +92,14 @@ func (p *poller) run() {
 			p.startFiles()
 		case <-p.done:
 			p.stopFiles()
+			for _, c := range p.compressed {
+				if c != nil {
+					c.stop()
+				}
+			}
+			for _, l := range p.limiters {
+				l.close()
+			}
 			close(p.lines)
 			close(p.errors)
 			return
@@ -95,17 +110,49 @@ func (p *poller) run() {
 // 重新listdir，获取所有需要监听的文件
 func (p *poller) relist() {
 	newPollingFiles := make(map[string]*file)
+	newCompressed := make(map[string]*compressedFile)
+	dirs := make([]string, 0, len(p.pollingDirs))
 	for dir := range p.pollingDirs {
+		dirs = append(dirs, dir)
+	}
+	// New subdirectories are appended to dirs, so that they are listed in this poll as well.
+	for i := 0; i < len(dirs); i++ {
+		dir := dirs[i]
 		fis, err := ioutil.ReadDir(dir)
 		if err != nil {
+			if os.IsNotExist(err) && !isBaseDir(dir, p.globs) {
+				p.logger.Debug(fmt.Sprintf("dir %s removed", dir))
+				delete(p.pollingDirs, dir)
+				continue
+			}
 			p.errors <- NewError(NotSpecified, err, fmt.Sprintf("read dir %s", dir))
 			continue
 		}
 		for _, fi := range fis {
 			path := filepath.Join(dir, fi.Name())
+			if fi.IsDir() {
+				if _, existing := p.pollingDirs[path]; !existing && matchDir(path, p.globs) {
+					p.logger.Debug(fmt.Sprintf("new dir %s", path))
+					p.pollingDirs[path] = struct{}{}
+					dirs = append(dirs, path)
+				}
+				continue
+			}
 			if !(util.MatchGlobs(path, p.globs) && !util.MatchGlobs(path, p.excludes)) {
 				continue
 			}
+			if isCompressed(path) {
+				c, ok := p.compressed[path]
+				if !ok {
+					c, err = p.newCompressedFile(path)
+					if err != nil {
+						p.errors <- NewErrorf(NotSpecified, err, "open file %s", path)
+						continue
+					}
+				}
+				newCompressed[path] = c
+				continue
+			}
 			f, ok := p.pollingFiles[path]
 			if !ok {
 				f, err = p.newFile(path)
@@ -121,7 +168,42 @@ func (p *poller) relist() {
 			newPollingFiles[path] = f
 		}
 	}
+	for path, c := range p.compressed {
+		if _, exists := newCompressed[path]; !exists && c != nil {
+			c.stop()
+		}
+	}
+	for path, l := range p.limiters {
+		if _, exists := newPollingFiles[path]; !exists {
+			l.close()
+			delete(p.limiters, path)
+		}
+	}
 	p.pollingFiles = newPollingFiles
+	p.compressed = newCompressed
+}
+
+// Returns nil if the lines are not limited.
+func (p *poller) limiter(path string) *rateLimiter {
+	if p.rateLimit == nil {
+		return nil
+	}
+	l, ok := p.limiters[path]
+	if !ok {
+		l = p.rateLimit.newLimiter(path)
+		p.limiters[path] = l
+	}
+	return l
+}
+
+func (p *poller) newCompressedFile(path string) (*compressedFile, error) {
+	c, err := newCompressedFile(path, p.pos, p.lines, p.errors, p.logger)
+	if err != nil || c == nil {
+		return c, err
+	}
+	p.logger.Debug(fmt.Sprintf("new compressed file %s", path))
+	go c.run()
+	return c, nil
 }
 
 func (p *poller) startFiles() {
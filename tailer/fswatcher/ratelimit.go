@@ -0,0 +1,136 @@
+// Copyright 2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fswatcher
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	throttledSeconds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "grok_exporter_file_throttled_seconds_total",
+		Help: "Time that reading a file was paused because of max_lines_rate_per_file.",
+	}, []string{"input", "path"})
+	registerThrottledSeconds sync.Once
+)
+
+// Limits the number of lines per second read from each file of an input.
+// Unlike the leaky bucket of the tail library, which skips the lines written during a cool-off period,
+// reading is paused until the next line may be read, so no lines are lost.
+// The offset of a line is stored after the line was passed on, so a stopped tailer continues with the first line that was not passed on.
+type RateLimit struct {
+	linesPerSecond float64
+	throttled      *prometheus.CounterVec // curried with the input, labeled by the path
+	mutex          sync.Mutex
+	limiters       map[string]*rateLimiter // path -> most recent limiter, which owns the path's metric
+}
+
+// Returns nil if maxLinesPerSecond is 0, i.e. if the number of lines is not limited.
+func NewRateLimit(maxLinesPerSecond uint16, input string) *RateLimit {
+	if maxLinesPerSecond == 0 {
+		return nil
+	}
+	registerThrottledSeconds.Do(func() {
+		prometheus.MustRegister(throttledSeconds)
+	})
+	return &RateLimit{
+		linesPerSecond: float64(maxLinesPerSecond),
+		throttled:      throttledSeconds.MustCurryWith(prometheus.Labels{"input": input}),
+		limiters:       make(map[string]*rateLimiter),
+	}
+}
+
+// Returns nil if r is nil.
+func (r *RateLimit) newLimiter(path string) *rateLimiter {
+	if r == nil {
+		return nil
+	}
+	throttled := r.throttled.WithLabelValues(path)
+	throttled.Add(0)
+	l := &rateLimiter{
+		owner:          r,
+		path:           path,
+		linesPerSecond: r.linesPerSecond,
+		tokens:         r.linesPerSecond,
+		last:           time.Now(),
+		throttled:      throttled,
+	}
+	r.mutex.Lock()
+	r.limiters[path] = l
+	r.mutex.Unlock()
+	return l
+}
+
+// Token bucket for a single file, allowing bursts of up to one second's worth of lines.
+// Not thread safe, a file is read by a single goroutine at a time.
+type rateLimiter struct {
+	owner          *RateLimit
+	path           string
+	linesPerSecond float64
+	tokens         float64
+	last           time.Time
+	throttled      prometheus.Counter
+}
+
+// Returns how long to wait before the next line may be read, 0 if it may be read immediately.
+// If the line is not read after all, because the caller stopped while waiting, cancel() must be called.
+func (l *rateLimiter) reserve() time.Duration {
+	if l == nil {
+		return 0
+	}
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.linesPerSecond
+	if l.tokens > l.linesPerSecond {
+		l.tokens = l.linesPerSecond
+	}
+	l.last = now
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.linesPerSecond * float64(time.Second))
+}
+
+// Gives back the line counted by reserve(). The poller stops its files on each poll,
+// so without this the lines that were never read would delay the file further and further.
+func (l *rateLimiter) cancel() {
+	if l != nil {
+		l.tokens++
+	}
+}
+
+// Records the time that reading was paused.
+func (l *rateLimiter) paused(d time.Duration) {
+	if l != nil {
+		l.throttled.Add(d.Seconds())
+	}
+}
+
+// Removes the metric of a file that is no longer read. When a file is replaced, the tailer of the new file
+// may start before the tailer of the old file is closed, so the metric is kept if a newer limiter exists for the path.
+func (l *rateLimiter) close() {
+	if l == nil {
+		return
+	}
+	l.owner.mutex.Lock()
+	defer l.owner.mutex.Unlock()
+	if l.owner.limiters[l.path] == l {
+		delete(l.owner.limiters, l.path)
+		l.owner.throttled.DeleteLabelValues(l.path)
+	}
+}
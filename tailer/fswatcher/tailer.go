@@ -3,7 +3,6 @@ package fswatcher
 import (
 	"github.com/sirupsen/logrus"
 	"os"
-	"strings"
 	"sync/atomic"
 	"time"
 
@@ -14,8 +13,6 @@ import (
 	"github.com/sequix/grok_exporter/util"
 )
 
-// TODO 不掉数据的速率限制（但会增加内存消耗）
-
 // tailer 包装 hpcloud、tail，以 Fan-In 模式将多路输入压入lines chan
 // Fan-In模式：https://github.com/tmrts/go-patterns/blob/master/messaging/fan_in.md
 type tailer struct {
@@ -24,11 +21,18 @@ type tailer struct {
 	path        string
 	devIno      string
 	pos         position.Interface
+	limiter     *rateLimiter // nil if the lines are not limited
+	maxLineSize int
 	outputLines chan *Line
 	errors      chan Error
 	readAt      atomic.Value
 	done        chan bool // deliver whether delete position or not
 	terminated  chan struct{}
+
+	// The offset after the last line that was passed on, see advance().
+	offset         int64
+	lastLineTime   time.Time
+	newlinePending bool
 }
 
 func (w *watcher) newTailer(path string) (*tailer, error) {
@@ -43,7 +47,7 @@ func (w *watcher) newTailer(path string) (*tailer, error) {
 	}
 
 	cfg := deepcopy.Copy(w.tailConfig).(tail.Config)
-	cfg.Location.Offset = w.pos.GetOffset(devIno)
+	cfg.Location.Offset = w.pos.ResumeOffset(devIno, path)
 	cfg.Logger = w.logger.WithField("path", path)
 
 	// 若使用inotify，在下述场景中，无法拿到该文件的内容
@@ -70,6 +74,9 @@ func (w *watcher) newTailer(path string) (*tailer, error) {
 		path:        path,
 		devIno:      devIno,
 		pos:         w.pos,
+		limiter:     w.rateLimit.newLimiter(path),
+		maxLineSize: cfg.MaxLineSize,
+		offset:      cfg.Location.Offset,
 		outputLines: w.lines,
 		errors:      w.errors,
 		done:        make(chan bool),
@@ -87,22 +94,25 @@ func (t *tailer) run() {
 				continue
 			}
 			if event.Err != nil {
-				if strings.Contains(event.Err.Error(), "Too much log activity") {
-					// 读取速度过快，冷却1s
-					continue
-				}
 				t.errors <- NewStructuredError(event.Err, "reading file", map[string]interface{}{"path": t.path})
 				continue
 			}
 			if len(event.Text) > 0 {
-				t.outputLines <- &Line{event.Text, t.Filename}
+				// While waiting, the tail goroutine blocks on t.Lines, so reading pauses instead of skipping lines.
+				// If stopped while waiting, the offset is not stored, so the line is read again next time.
+				if delay := t.limiter.reserve(); delay > 0 {
+					if delPos, stopped := t.sleep(delay); stopped {
+						t.finalizer(delPos)
+						return
+					}
+				}
+				t.outputLines <- &Line{Line: event.Text, File: t.Filename}
 			}
-			offset, err := t.Tail.Tell()
-			if err != nil {
-				t.errors <- NewStructuredError(event.Err, "updating offset", map[string]interface{}{"path": t.path})
+			if err := t.advance(event); err != nil {
+				t.errors <- NewStructuredError(err, "updating offset", map[string]interface{}{"path": t.path})
 				continue
 			}
-			t.pos.SetOffset(t.devIno, offset)
+			t.pos.SetOffset(t.devIno, t.offset)
 			t.readAt.Store(time.Now())
 		case delPos := <-t.done:
 			t.finalizer(delPos)
@@ -111,6 +121,47 @@ func (t *tailer) run() {
 	}
 }
 
+// Advances the offset by the length of a line that was passed on.
+// The tail goroutine reads the next line as soon as this one was received, so Tell() may point past a line that
+// was not passed on yet. Tell() is only used to detect that the file was truncated and read from the start again.
+// Lines longer than maxLineSize are split into parts with the same time, the newline follows the last part.
+func (t *tailer) advance(event *tail.Line) error {
+	if t.newlinePending && !event.Time.Equal(t.lastLineTime) {
+		t.offset++
+	}
+	length := int64(len(event.Text))
+	t.newlinePending = t.maxLineSize > 0 && len(event.Text) == t.maxLineSize
+	if !t.newlinePending {
+		length++
+	}
+	t.offset += length
+	t.lastLineTime = event.Time
+	readOffset, err := t.Tail.Tell()
+	if err != nil {
+		return err
+	}
+	if readOffset < t.offset {
+		// The tail goroutine already read this line, so it was read from the start of the truncated file.
+		t.offset = length
+	}
+	return nil
+}
+
+// Returns true if the tailer was stopped while sleeping.
+func (t *tailer) sleep(delay time.Duration) (delPos bool, stopped bool) {
+	start := time.Now()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case delPos = <-t.done:
+		t.limiter.cancel()
+		stopped = true
+	}
+	t.limiter.paused(time.Since(start))
+	return delPos, stopped
+}
+
 func (t *tailer) stop(delPos bool) {
 	if atomic.CompareAndSwapInt32(&t.stopped, 0, 1) {
 		t.done <- delPos
@@ -126,11 +177,18 @@ func (t *tailer) finalizer(delPos bool) {
 		"delPos": delPos,
 	}).Debug("closing tailer")
 
+	// The tail goroutine doesn't stop while it is blocked sending the next line, so the lines are discarded until it is stopped.
+	// Their offsets were not stored, so they are read again by the next tailer of this file.
+	go func() {
+		for range t.Lines {
+		}
+	}()
 	if err := t.Stop(); err != nil {
 		t.errors <- NewStructuredError(err, "closing file", map[string]interface{}{"path": t.path})
 	}
 	if delPos {
 		t.pos.DelOffset(t.devIno)
 	}
+	t.limiter.close()
 	close(t.terminated)
 }
@@ -1,30 +1,77 @@
 package fswatcher
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
 
 	"github.com/sequix/grok_exporter/tailer/glob"
 )
 
 // Gets the directory paths from the glob expressions,
 // and makes sure these directories exist.
+// Directories matching wildcards in the directory path, like /var/log/pods/*/*/*.log or /var/log/**/*.log, are included.
 func expandGlobs(globs []glob.Glob) (map[string]struct{}, Error) {
 	result := make(map[string]struct{})
+	baseDirs := make([]string, 0, len(globs))
 	for _, g := range globs {
-		if _, existing := result[g.Dir()]; existing {
+		if _, existing := result[g.BaseDir()]; existing {
 			continue
 		}
-		dirInfo, err := os.Stat(g.Dir())
+		dirInfo, err := os.Stat(g.BaseDir())
 		if err != nil {
 			if os.IsNotExist(err) {
-				return nil, NewErrorf(DirectoryNotFound, nil, "%q: no such directory", g.Dir())
+				return nil, NewErrorf(DirectoryNotFound, nil, "%q: no such directory", g.BaseDir())
 			}
-			return nil, NewErrorf(NotSpecified, err, "%q: stat() failed", g.Dir())
+			return nil, NewErrorf(NotSpecified, err, "%q: stat() failed", g.BaseDir())
 		}
 		if !dirInfo.IsDir() {
-			return nil, NewErrorf(NotSpecified, nil, "%q is not a directory", g.Dir())
+			return nil, NewErrorf(NotSpecified, nil, "%q is not a directory", g.BaseDir())
+		}
+		result[g.BaseDir()] = struct{}{}
+		baseDirs = append(baseDirs, g.BaseDir())
+	}
+	// matchingSubdirs() already recurses, so only the base dirs are expanded.
+	for _, dir := range baseDirs {
+		for _, subdir := range matchingSubdirs(dir, globs) {
+			result[subdir] = struct{}{}
 		}
-		result[g.Dir()] = struct{}{}
 	}
 	return result, nil
 }
+
+// Finds all subdirectories of dir that may contain matching files. Symlinks are not followed.
+func matchingSubdirs(dir string, globs []glob.Glob) []string {
+	var result []string
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil // the directory was removed, or it is not readable. The latter is reported when it is listed.
+	}
+	for _, fi := range fis {
+		subdir := filepath.Join(dir, fi.Name())
+		if fi.IsDir() && matchDir(subdir, globs) {
+			result = append(result, subdir)
+			result = append(result, matchingSubdirs(subdir, globs)...)
+		}
+	}
+	return result
+}
+
+func matchDir(dir string, globs []glob.Glob) bool {
+	for _, g := range globs {
+		if g.MatchDir(dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// Directories from the config must exist, subdirectories matching wildcards may be removed.
+func isBaseDir(dir string, globs []glob.Glob) bool {
+	for _, g := range globs {
+		if g.BaseDir() == dir {
+			return true
+		}
+	}
+	return false
+}
@@ -24,7 +24,6 @@ import (
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/sequix/tail"
-	"github.com/sequix/tail/ratelimiter"
 	"github.com/sirupsen/logrus"
 
 	"github.com/sequix/grok_exporter/tailer/glob"
@@ -37,10 +36,13 @@ type watcher struct {
 	globs       []glob.Glob
 	excludes    []glob.Glob
 	tailConfig  tail.Config
+	rateLimit   *RateLimit
 	idleTimeout time.Duration
 	logger      logrus.FieldLogger
 	watcher     *fsnotify.Watcher
+	dirs        map[string]struct{} // watched directories
 	tailers     map[string]*tailer
+	compressed  map[string]*compressedFile // nil if the file was already read
 	lines       chan *Line
 	errors      chan Error
 	done        chan struct{}
@@ -52,7 +54,7 @@ func RunFileTailer(
 	excludes []glob.Glob,
 	pos position.Interface,
 	maxLineSize int,
-	maxLinesPerSeconds uint16,
+	rateLimit *RateLimit,
 	pollInterval time.Duration,
 	fileIdleTimeout time.Duration,
 	log logrus.FieldLogger,
@@ -79,20 +81,18 @@ func RunFileTailer(
 		MustExist:    false,
 	}
 
-	// TODO 不掉日志的速率限制
-	if maxLinesPerSeconds > 0 {
-		tailConfig.RateLimiter = ratelimiter.NewLeakyBucket(maxLinesPerSeconds, time.Second)
-	}
-
 	w := &watcher{
 		pos:         pos,
 		globs:       globs,
 		excludes:    excludes,
 		tailConfig:  tailConfig,
+		rateLimit:   rateLimit,
 		idleTimeout: fileIdleTimeout,
 		logger:      log.WithField("component", "watcher"),
 		watcher:     fw,
+		dirs:        map[string]struct{}{},
 		tailers:     map[string]*tailer{},
+		compressed:  map[string]*compressedFile{},
 		lines:       make(chan *Line),
 		errors:      make(chan Error),
 		done:        make(chan struct{}),
@@ -124,9 +124,7 @@ func (w *watcher) run() {
 		case now := <-ticker.C:
 			w.cleanIdleFiles(now)
 		case <-w.done:
-			for _, t := range w.tailers {
-				t.stop(false)
-			}
+			w.stopAll()
 			close(w.lines)
 			close(w.errors)
 			return
@@ -146,9 +144,7 @@ func (w *watcher) runWithoutCleaner() {
 			w.logger.WithField("event", event).Debug("recv event")
 			w.handle(event)
 		case <-w.done:
-			for _, t := range w.tailers {
-				t.stop(false)
-			}
+			w.stopAll()
 			close(w.lines)
 			close(w.errors)
 			return
@@ -156,6 +152,17 @@ func (w *watcher) runWithoutCleaner() {
 	}
 }
 
+func (w *watcher) stopAll() {
+	for _, t := range w.tailers {
+		t.stop(false)
+	}
+	for _, c := range w.compressed {
+		if c != nil {
+			c.stop()
+		}
+	}
+}
+
 func (w *watcher) shouldWatch(path string) bool {
 	return util.MatchGlobs(path, w.globs) && !util.MatchGlobs(path, w.excludes)
 }
@@ -163,31 +170,61 @@ func (w *watcher) shouldWatch(path string) bool {
 // list pollingDirs，获取所有需要监听的文件
 func (w *watcher) init(dirs map[string]struct{}) {
 	for dir := range dirs {
-		fis, err := ioutil.ReadDir(dir)
-		if err != nil {
-			w.errors <- NewStructuredError(err, "read dir", map[string]interface{}{"path": dir})
-			continue
-		}
-		if err := w.watcher.Add(dir); err != nil {
-			w.errors <- NewStructuredError(err, "watch new dir", map[string]interface{}{"path": dir})
-			continue
-		}
-		for _, fi := range fis {
-			path := filepath.Join(dir, fi.Name())
-			if w.shouldWatch(path) {
-				w.watch(path)
+		w.watchDir(dir, false)
+	}
+}
+
+// Adds the directory to the fsnotify watcher, and watches the files in it.
+// If recursive is true, matching subdirectories are watched as well,
+// because they may have been created before the directory was added to the fsnotify watcher.
+func (w *watcher) watchDir(dir string, recursive bool) {
+	if _, existing := w.dirs[dir]; existing {
+		return
+	}
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		w.errors <- NewStructuredError(err, "read dir", map[string]interface{}{"path": dir})
+		return
+	}
+	if err := w.watcher.Add(dir); err != nil {
+		w.errors <- NewStructuredError(err, "watch new dir", map[string]interface{}{"path": dir})
+		return
+	}
+	w.dirs[dir] = struct{}{}
+	for _, fi := range fis {
+		path := filepath.Join(dir, fi.Name())
+		switch {
+		case fi.IsDir():
+			if recursive && matchDir(path, w.globs) {
+				w.watchDir(path, true)
 			}
+		case w.shouldWatch(path):
+			w.watch(path)
 		}
 	}
 }
 
+func (w *watcher) unwatchDir(dir string) {
+	if _, existing := w.dirs[dir]; !existing {
+		return
+	}
+	w.logger.WithField("path", dir).Info("unwatch dir")
+	w.watcher.Remove(dir) // fails if the directory was removed, because then it is removed from the watcher automatically
+	delete(w.dirs, dir)
+}
+
 func (w *watcher) handle(event fsnotify.Event) {
 	path := event.Name
 	ops := strings.Split(event.Op.String(), "|")
 	for _, op := range ops {
 		switch op {
 		case "CREATE":
-			if w.shouldWatch(path) {
+			if fi, err := os.Lstat(path); err == nil && fi.IsDir() {
+				if matchDir(path, w.globs) {
+					w.logger.WithField("path", path).Info("watch new dir")
+					w.watchDir(path, true)
+				}
+			} else if w.shouldWatch(path) {
 				w.watch(path)
 			}
 		case "CHMOD":
@@ -202,14 +239,20 @@ func (w *watcher) handle(event fsnotify.Event) {
 				f.Close()
 			}
 		case "RENAME":
+			w.unwatchDir(path)
 			w.unwatch(path, false)
 		case "REMOVE":
+			w.unwatchDir(path)
 			w.unwatch(path, true)
 		}
 	}
 }
 
 func (w *watcher) watch(path string) {
+	if isCompressed(path) {
+		w.watchCompressed(path)
+		return
+	}
 	if _, existing := w.tailers[path]; existing {
 		return
 	}
@@ -223,7 +266,30 @@ func (w *watcher) watch(path string) {
 	go t.run()
 }
 
+func (w *watcher) watchCompressed(path string) {
+	if _, existing := w.compressed[path]; existing {
+		return
+	}
+	c, err := newCompressedFile(path, w.pos, w.lines, w.errors, w.logger)
+	if err != nil {
+		w.errors <- NewStructuredError(err, "watch new file", map[string]interface{}{"path": path})
+		return
+	}
+	w.compressed[path] = c
+	if c != nil {
+		w.logger.WithField("path", path).Info("watch new compressed file")
+		go c.run()
+	}
+}
+
 func (w *watcher) unwatch(path string, delPos bool) {
+	if c, ok := w.compressed[path]; ok {
+		if c != nil {
+			c.stop()
+		}
+		delete(w.compressed, path)
+		return
+	}
 	t, ok := w.tailers[path]
 	if !ok {
 		return
@@ -587,7 +587,7 @@ func startFileTailer(t *testing.T, ctx *context, params []string) {
 			[]glob.Glob{},
 			position.NewMemPos(),
 			0,
-			0,
+			nil,
 			250*time.Millisecond,
 			0,
 			ctx.log)
@@ -596,6 +596,7 @@ func startFileTailer(t *testing.T, ctx *context, params []string) {
 			parsedGlobs,
 			[]glob.Glob{},
 			pos,
+			nil,
 			10*time.Millisecond,
 			0,
 			ctx.log)
@@ -819,11 +820,11 @@ func deleteRecursively(t *testing.T, ctx *context, file string) {
 		}
 	}
 	ctx.log.Debugf("tearDown: removing %q", file)
-	delete(t, ctx, file)
+	deleteFile(t, ctx, file)
 }
 
 // Verbose implementation of os.Remove() to debug a Windows "Access is denied" issue.
-func delete(t *testing.T, ctx *context, file string) {
+func deleteFile(t *testing.T, ctx *context, file string) {
 	var (
 		err, statErr error
 		timeout      = 5 * time.Second
@@ -918,7 +919,7 @@ func runTestShutdown(t *testing.T, mode string) {
 		[]glob.Glob{},
 		position.NewMemPos(),
 		0,
-		0,
+		nil,
 		250*time.Millisecond,
 		0,
 		ctx.log)
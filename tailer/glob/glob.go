@@ -18,13 +18,16 @@ import (
 	"fmt"
 	"path/filepath"
 	"runtime"
+	"strings"
 )
 
+// A path segment "**" matches any number of directories, including none.
+const recursiveWildcard = "**"
+
 type Glob string
 
 func Parse(pattern string) (Glob, error) {
 	var (
-		result  Glob
 		absglob string
 		err     error
 	)
@@ -35,20 +38,76 @@ func Parse(pattern string) (Glob, error) {
 	if err != nil {
 		return "", fmt.Errorf("%q: failed to finnd absolute path for glob pattern: %v", pattern, err)
 	}
-	result = Glob(absglob)
-	if containsWildcards(result.Dir()) {
-		return "", fmt.Errorf("%q: wildcards are only allowed in the file name, but not in the directory path", pattern)
+	for _, segment := range splitPath(absglob) {
+		if segment != recursiveWildcard && strings.Contains(segment, recursiveWildcard) {
+			return "", fmt.Errorf("%q: '**' must be a complete path segment, like in /var/log/**/*.log", pattern)
+		}
 	}
-	return result, nil
+	return Glob(absglob), nil
 }
 
-func (g Glob) Dir() string {
+// The longest directory path without wildcards. Only files in this directory or its subdirectories can match.
+func (g Glob) BaseDir() string {
+	segments := splitPath(string(g))
+	for i := 0; i < len(segments)-1; i++ {
+		if containsWildcards(segments[i]) {
+			return joinPath(segments[:i])
+		}
+	}
 	return filepath.Dir(string(g))
 }
 
 func (g Glob) Match(path string) bool {
-	matched, _ := filepath.Match(string(g), path)
-	return matched
+	return matchSegments(splitPath(string(g)), splitPath(path))
+}
+
+// Returns true if files in the directory dir or in one of its subdirectories may match the glob.
+func (g Glob) MatchDir(dir string) bool {
+	segments := splitPath(string(g))
+	if segments[len(segments)-1] != recursiveWildcard {
+		segments = segments[:len(segments)-1] // the file name
+	}
+	return matchDirSegments(segments, splitPath(dir))
+}
+
+func matchSegments(pattern, path []string) bool {
+	switch {
+	case len(pattern) == 0:
+		return len(path) == 0
+	case pattern[0] == recursiveWildcard:
+		return matchSegments(pattern[1:], path) || len(path) > 0 && matchSegments(pattern, path[1:])
+	case len(path) == 0:
+		return false
+	}
+	matched, _ := filepath.Match(pattern[0], path[0])
+	return matched && matchSegments(pattern[1:], path[1:])
+}
+
+// Like matchSegments, but the pattern may be longer than the path.
+func matchDirSegments(pattern, path []string) bool {
+	switch {
+	case len(path) == 0:
+		return true
+	case len(pattern) == 0:
+		return false
+	case pattern[0] == recursiveWildcard:
+		return matchDirSegments(pattern[1:], path) || matchDirSegments(pattern, path[1:])
+	}
+	matched, _ := filepath.Match(pattern[0], path[0])
+	return matched && matchDirSegments(pattern[1:], path[1:])
+}
+
+func splitPath(path string) []string {
+	return strings.Split(filepath.Clean(path), string(filepath.Separator))
+}
+
+func joinPath(segments []string) string {
+	result := strings.Join(segments, string(filepath.Separator))
+	if len(result) == 0 || strings.HasSuffix(result, ":") {
+		// root directory, like "/" or "C:\\"
+		result += string(filepath.Separator)
+	}
+	return result
 }
 
 // The file tailer implementation switched from watching single paths to globs,
@@ -71,7 +130,7 @@ func containsWildcards(pattern string) bool {
 			continue
 		}
 		if !escaped && (p[i] == '[' || p[i] == '*' || p[i] == '?') {
-			return false
+			return true
 		}
 		escaped = false
 	}
@@ -0,0 +1,87 @@
+// Copyright 2018 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package glob
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestRecursiveGlob(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test uses unix paths")
+	}
+	for _, data := range []struct {
+		pattern string
+		path    string
+		matches bool
+	}{
+		{"/var/log/*.log", "/var/log/a.log", true},
+		{"/var/log/*.log", "/var/log/a/b.log", false},
+		{"/var/log/pods/*/*/*.log", "/var/log/pods/ns_pod_uid/container/0.log", true},
+		{"/var/log/pods/*/*/*.log", "/var/log/pods/ns_pod_uid/0.log", false},
+		{"/var/log/**/*.log", "/var/log/a.log", true},
+		{"/var/log/**/*.log", "/var/log/a/b/c.log", true},
+		{"/var/log/**/*.log", "/var/lib/a.log", false},
+		{"/var/**/app/*.log", "/var/log/x/app/a.log", true},
+		{"/var/**/app/*.log", "/var/log/x/a.log", false},
+		{"/var/log/**", "/var/log/a/b.txt", true},
+	} {
+		g, err := Parse(data.pattern)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", data.pattern, err)
+		}
+		if g.Match(data.path) != data.matches {
+			t.Errorf("%v: expected Match(%v) to be %v", data.pattern, data.path, data.matches)
+		}
+	}
+	for _, data := range []struct {
+		pattern string
+		dir     string
+		matches bool
+	}{
+		{"/var/log/pods/*/*/*.log", "/var/log/pods/ns_pod_uid", true},
+		{"/var/log/pods/*/*/*.log", "/var/log/pods/ns_pod_uid/container", true},
+		{"/var/log/pods/*/*/*.log", "/var/log/pods/ns_pod_uid/container/sub", false},
+		{"/var/log/**/*.log", "/var/log/a/b/c", true},
+		{"/var/log/**/*.log", "/var/lib", false},
+		{"/var/log/*.log", "/var/log/a", false},
+	} {
+		g, err := Parse(data.pattern)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", data.pattern, err)
+		}
+		if g.MatchDir(data.dir) != data.matches {
+			t.Errorf("%v: expected MatchDir(%v) to be %v", data.pattern, data.dir, data.matches)
+		}
+	}
+	for pattern, baseDir := range map[string]string{
+		"/var/log/*.log":          "/var/log",
+		"/var/log/pods/*/*/*.log": "/var/log/pods",
+		"/var/log/**/*.log":       "/var/log",
+		"/*/log/a.log":            "/",
+	} {
+		g, err := Parse(pattern)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", pattern, err)
+		}
+		if g.BaseDir() != baseDir {
+			t.Errorf("%v: expected base dir %v, got %v", pattern, baseDir, g.BaseDir())
+		}
+	}
+	if _, err := Parse("/var/log/a**/*.log"); err == nil {
+		t.Errorf("expected error for '**' within a path segment")
+	}
+}
@@ -0,0 +1,271 @@
+// Copyright 2016-2018 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	osexec "os/exec" // exec is taken by the tests in this package
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sequix/grok_exporter/config/v2"
+	"github.com/sequix/grok_exporter/tailer/fswatcher"
+	"github.com/sequix/grok_exporter/tailer/position"
+	"github.com/sirupsen/logrus"
+)
+
+// Larger fields are rejected, so that a corrupt length in the export format cannot exhaust the memory.
+const maxJournalFieldSize = 16 * 1024 * 1024
+
+// How long to wait before journalctl is restarted after it terminated.
+const journalctlRestartInterval = 5 * time.Second
+
+// Name of the cursor in the position store.
+const journaldCursorName = "journald"
+
+// Names of the journal fields in fswatcher.Line.Fields for lines read by the journald input.
+// Fields missing in a journal entry are empty. See systemd.journal-fields(7).
+var JournaldFields = []string{
+	"_SYSTEMD_UNIT", "_SYSTEMD_USER_UNIT", "SYSLOG_IDENTIFIER", "SYSLOG_FACILITY", "PRIORITY",
+	"_HOSTNAME", "_TRANSPORT", "_PID", "_COMM", "CONTAINER_NAME",
+}
+
+// implements fswatcher.Interface
+type journaldTailer struct {
+	lines      chan *fswatcher.Line
+	errors     chan fswatcher.Error
+	pos        position.Interface // nil when reading from stdin
+	logger     logrus.FieldLogger
+	mutex      sync.Mutex  // protects cmd
+	cmd        *osexec.Cmd // the running journalctl process
+	done       chan struct{}
+	terminated chan struct{}
+}
+
+func (t *journaldTailer) Lines() chan *fswatcher.Line {
+	return t.lines
+}
+
+func (t *journaldTailer) Errors() chan fswatcher.Error {
+	return t.errors
+}
+
+func (t *journaldTailer) Close() {
+	close(t.done)
+	if t.pos == nil {
+		// TODO: Like the stdin tailer, we cannot stop the goroutine reading on stdin.
+		return
+	}
+	t.mutex.Lock()
+	if t.cmd != nil {
+		t.cmd.Process.Kill()
+	}
+	t.mutex.Unlock()
+	<-t.terminated
+}
+
+// Reads journal entries in the journal export format, see https://systemd.io/JOURNAL_EXPORT_FORMATS/
+// The MESSAGE field is the log line, the JournaldFields are provided as fields.
+// With journald_source "journalctl", journalctl is started and the cursor of the last entry is stored in pos,
+// so that reading continues after that entry when grok_exporter is restarted.
+// With journald_source "stdin", the output of "journalctl -o export" is expected on stdin.
+func RunJournaldTailer(cfg *v2.InputConfig, pos position.Interface, logger logrus.FieldLogger) fswatcher.Interface {
+	t := &journaldTailer{
+		lines:      make(chan *fswatcher.Line),
+		errors:     make(chan fswatcher.Error),
+		logger:     logger.WithField("component", "journald"),
+		done:       make(chan struct{}),
+		terminated: make(chan struct{}),
+	}
+	if cfg.JournaldSource == "stdin" {
+		go t.read(os.Stdin)
+	} else {
+		t.pos = pos
+		go t.runJournalctl(cfg.JournaldCommand, cfg.JournaldDirectory)
+	}
+	return t
+}
+
+func (t *journaldTailer) runJournalctl(command, directory string) {
+	defer close(t.terminated)
+	for {
+		args := journalctlArgs(directory, t.pos.Cursor(journaldCursorName))
+		t.logger.Infof("Start reading the journal with %v %v", command, strings.Join(args, " "))
+		stdout, err := t.startJournalctl(command, args)
+		if err == nil {
+			// The output must be read completely before Wait() closes the pipe.
+			t.read(stdout)
+			err = t.waitForJournalctl()
+		}
+		if t.isClosed() {
+			return
+		}
+		t.sendError(fswatcher.NewErrorf(fswatcher.NotSpecified, err, "%v terminated, restarting in %v", command, journalctlRestartInterval))
+		select {
+		case <-time.After(journalctlRestartInterval):
+		case <-t.done:
+			return
+		}
+	}
+}
+
+func journalctlArgs(directory, cursor string) []string {
+	args := []string{"--output=export", "--follow"}
+	if len(directory) > 0 {
+		args = append(args, "--directory="+directory)
+	}
+	if len(cursor) > 0 {
+		args = append(args, "--after-cursor="+cursor)
+	} else {
+		// Like the file tailer for new files, we start with new entries when there is no cursor.
+		args = append(args, "--lines=0")
+	}
+	return args
+}
+
+func (t *journaldTailer) startJournalctl(command string, args []string) (io.Reader, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.isClosed() {
+		return nil, errors.New("closed")
+	}
+	cmd := osexec.Command(command, args...)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+	t.cmd = cmd
+	return stdout, nil
+}
+
+func (t *journaldTailer) waitForJournalctl() error {
+	t.mutex.Lock()
+	cmd := t.cmd
+	t.mutex.Unlock()
+	err := cmd.Wait()
+	if err == nil {
+		err = errors.New("journalctl exited")
+	}
+	t.mutex.Lock()
+	t.cmd = nil
+	t.mutex.Unlock()
+	return err
+}
+
+func (t *journaldTailer) read(r io.Reader) {
+	reader := bufio.NewReader(r)
+	for {
+		entry, err := readJournalEntry(reader)
+		if err != nil {
+			if err != io.EOF && !t.isClosed() {
+				t.sendError(fswatcher.NewError(fswatcher.NotSpecified, err, "reading journal export format"))
+			}
+			return
+		}
+		if message, exists := entry["MESSAGE"]; exists {
+			fields := make(map[string]string, len(JournaldFields))
+			for _, name := range JournaldFields {
+				fields[name] = entry[name]
+			}
+			select {
+			case t.lines <- &fswatcher.Line{Line: message, Fields: fields}:
+			case <-t.done:
+				return
+			}
+		}
+		if cursor, exists := entry["__CURSOR"]; exists && t.pos != nil {
+			t.pos.SetCursor(journaldCursorName, cursor)
+		}
+	}
+}
+
+// Reads the next entry of the journal export format. Fields are either "NAME=value\n", or
+// "NAME\n" followed by the length as 64 bit little endian, the binary value, and "\n".
+// Entries are terminated by an empty line. Returns io.EOF if there are no more entries.
+func readJournalEntry(reader *bufio.Reader) (map[string]string, error) {
+	entry := make(map[string]string)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if err == io.EOF && len(entry) > 0 {
+				return entry, nil // the last entry may not be terminated if journalctl was stopped
+			}
+			if err == io.EOF && len(line) > 0 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if len(line) == 0 {
+			if len(entry) == 0 {
+				continue
+			}
+			return entry, nil
+		}
+		if i := strings.IndexByte(line, '='); i >= 0 {
+			entry[line[:i]] = line[i+1:]
+			continue
+		}
+		value, err := readBinaryJournalField(reader)
+		if err != nil {
+			return nil, fmt.Errorf("field %v: %v", line, err)
+		}
+		entry[line] = value
+	}
+}
+
+func readBinaryJournalField(reader *bufio.Reader) (string, error) {
+	var size uint64
+	if err := binary.Read(reader, binary.LittleEndian, &size); err != nil {
+		return "", unexpectedEOF(err)
+	}
+	if size > maxJournalFieldSize {
+		return "", fmt.Errorf("size %v exceeds the maximum of %v bytes", size, maxJournalFieldSize)
+	}
+	value := make([]byte, size+1) // including the terminating '\n'
+	if _, err := io.ReadFull(reader, value); err != nil {
+		return "", unexpectedEOF(err)
+	}
+	if value[size] != '\n' {
+		return "", errors.New("binary value is not terminated by a newline")
+	}
+	return string(value[:size]), nil
+}
+
+func (t *journaldTailer) sendError(err fswatcher.Error) {
+	select {
+	case t.errors <- err:
+	case <-t.done:
+	}
+}
+
+func (t *journaldTailer) isClosed() bool {
+	select {
+	case <-t.done:
+		return true
+	default:
+		return false
+	}
+}
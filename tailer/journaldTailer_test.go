@@ -0,0 +1,169 @@
+// Copyright 2016-2018 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sequix/grok_exporter/config/v2"
+	"github.com/sequix/grok_exporter/tailer/fswatcher"
+	"github.com/sequix/grok_exporter/tailer/position"
+)
+
+const journalExport = "" +
+	"__CURSOR=s=739ad463348b4ceca5a9e69c95a3c93f;i=4ece7;b=6c7c6013a8cc4e4f8e1e5a5c3d4a3b2a;m=19a4f3a9;t=4c6a9a2e3d2c1;x=1\n" +
+	"__REALTIME_TIMESTAMP=1342540861416409\n" +
+	"_SYSTEMD_UNIT=sshd.service\n" +
+	"PRIORITY=6\n" +
+	"SYSLOG_IDENTIFIER=sshd\n" +
+	"_HOSTNAME=web-1\n" +
+	"MESSAGE=Accepted publickey for root from 10.0.0.1 port 52410 ssh2\n" +
+	"\n" +
+	"__CURSOR=s=739ad463348b4ceca5a9e69c95a3c93f;i=4ece8;b=6c7c6013a8cc4e4f8e1e5a5c3d4a3b2a;m=19a4f3aa;t=4c6a9a2e3d2c2;x=2\n" +
+	"_SYSTEMD_UNIT=nginx.service\n" +
+	"PRIORITY=3\n"
+
+func TestReadJournalEntry(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString(journalExport)
+	// Values with newlines are written in the binary format.
+	buf.WriteString("MESSAGE\n")
+	binary.Write(&buf, binary.LittleEndian, uint64(len("first line\nsecond line")))
+	buf.WriteString("first line\nsecond line\n")
+	buf.WriteString("\n")
+
+	reader := bufio.NewReader(&buf)
+	entry, err := readJournalEntry(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry["MESSAGE"] != "Accepted publickey for root from 10.0.0.1 port 52410 ssh2" || entry["_SYSTEMD_UNIT"] != "sshd.service" || entry["PRIORITY"] != "6" {
+		t.Fatalf("unexpected entry %v", entry)
+	}
+	entry, err = readJournalEntry(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry["MESSAGE"] != "first line\nsecond line" || entry["_SYSTEMD_UNIT"] != "nginx.service" || entry["PRIORITY"] != "3" {
+		t.Fatalf("unexpected entry %v", entry)
+	}
+	if _, err = readJournalEntry(reader); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+func TestReadJournalEntryErrors(t *testing.T) {
+	for name, input := range map[string]string{
+		"truncated size":   "MESSAGE\n\x05\x00",
+		"truncated value":  "MESSAGE\n\x05\x00\x00\x00\x00\x00\x00\x00abc",
+		"missing newline":  "MESSAGE\n\x03\x00\x00\x00\x00\x00\x00\x00abcd",
+		"size exceeds max": "MESSAGE\n\xff\xff\xff\xff\xff\xff\xff\xff",
+	} {
+		if _, err := readJournalEntry(bufio.NewReader(strings.NewReader(input))); err == nil || err == io.EOF {
+			t.Errorf("%v: expected error, got %v", name, err)
+		}
+	}
+}
+
+func TestJournaldTailer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grok_exporter_journald")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	exportFile := filepath.Join(dir, "export")
+	if err = ioutil.WriteFile(exportFile, []byte(journalExport+"MESSAGE=upstream timed out\n\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	argsFile := filepath.Join(dir, "args")
+	// Fake journalctl recording its arguments, printing the entries, and waiting for more like --follow.
+	journalctl := filepath.Join(dir, "journalctl")
+	script := "#!/bin/sh\necho \"$@\" > " + argsFile + "\ncat " + exportFile + "\nexec sleep 60\n"
+	if err = ioutil.WriteFile(journalctl, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &v2.InputConfig{
+		JournaldSource:    "journalctl",
+		JournaldCommand:   journalctl,
+		JournaldDirectory: "/var/log/journal",
+	}
+	pos := position.NewMemPos()
+
+	tail := RunJournaldTailer(cfg, pos, testLogger)
+	expectJournalLine(t, tail.Lines(), "Accepted publickey for root from 10.0.0.1 port 52410 ssh2", map[string]string{
+		"_SYSTEMD_UNIT":     "sshd.service",
+		"PRIORITY":          "6",
+		"SYSLOG_IDENTIFIER": "sshd",
+		"_HOSTNAME":         "web-1",
+	})
+	expectJournalLine(t, tail.Lines(), "upstream timed out", map[string]string{
+		"_SYSTEMD_UNIT": "nginx.service",
+		"PRIORITY":      "3",
+	})
+	tail.Close()
+	expectJournalctlArgs(t, argsFile, "--output=export --follow --directory=/var/log/journal --lines=0")
+	cursor := pos.Cursor(journaldCursorName)
+	if !strings.Contains(cursor, "i=4ece8") {
+		t.Fatalf("expected the cursor of the last entry, got %q", cursor)
+	}
+
+	// After a restart, journalctl continues after the stored cursor.
+	tail = RunJournaldTailer(cfg, pos, testLogger)
+	expectJournalLine(t, tail.Lines(), "Accepted publickey for root from 10.0.0.1 port 52410 ssh2", nil)
+	tail.Close()
+	expectJournalctlArgs(t, argsFile, "--output=export --follow --directory=/var/log/journal --after-cursor="+cursor)
+}
+
+// Fields not in expectedFields must be empty.
+func expectJournalLine(t *testing.T, lines chan *fswatcher.Line, expectedLine string, expectedFields map[string]string) {
+	select {
+	case line := <-lines:
+		if line.Line != expectedLine {
+			t.Fatalf("expected line %q, got %q", expectedLine, line.Line)
+		}
+		if expectedFields == nil {
+			return
+		}
+		fields := make(map[string]string)
+		for _, name := range JournaldFields {
+			fields[name] = expectedFields[name]
+		}
+		if !reflect.DeepEqual(line.Fields, fields) {
+			t.Fatalf("%q: expected fields %v, got %v", expectedLine, fields, line.Fields)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout while waiting for line %q", expectedLine)
+	}
+}
+
+func expectJournalctlArgs(t *testing.T, argsFile, expected string) {
+	args, err := ioutil.ReadFile(argsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(args)) != expected {
+		t.Fatalf("expected journalctl arguments %q, got %q", expected, strings.TrimSpace(string(args)))
+	}
+}
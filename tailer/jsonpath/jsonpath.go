@@ -0,0 +1,228 @@
+// Copyright 2016-2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package jsonpath implements the subset of JSONPath used for selecting log lines in JSON documents.
+//
+// Supported are the root $, child names .name and ['name'], array indexes [0] and [-1] (counting from the end),
+// wildcards .* and [*], and unions like ['msg','text'] or [0,1]. Recursive descent and filter expressions are not supported.
+// For compatibility with older configurations, the $ may be omitted, like in .message or .path.to.element.
+package jsonpath
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type step struct {
+	wildcard bool
+	names    []string // object keys
+	indexes  []int    // array indexes, negative indexes count from the end
+}
+
+// A compiled JSONPath expression.
+type Path struct {
+	expr  string
+	steps []step
+}
+
+func Parse(expr string) (*Path, error) {
+	s := expr
+	switch {
+	case strings.HasPrefix(s, "$"):
+		s = s[1:]
+	case strings.HasPrefix(s, "."), strings.HasPrefix(s, "["):
+	default:
+		return nil, fmt.Errorf("%q: invalid JSONPath: must start with \"$\" or \".\"", expr)
+	}
+	var steps []step
+	for len(s) > 0 {
+		var (
+			st  step
+			err error
+		)
+		switch s[0] {
+		case '.':
+			s = s[1:]
+			if strings.HasPrefix(s, ".") {
+				return nil, fmt.Errorf("%q: invalid JSONPath: recursive descent \"..\" is not supported", expr)
+			}
+			end := strings.IndexAny(s, ".[")
+			if end < 0 {
+				end = len(s)
+			}
+			name := s[:end]
+			s = s[end:]
+			switch name {
+			case "":
+				return nil, fmt.Errorf("%q: invalid JSONPath: empty name", expr)
+			case "*":
+				st.wildcard = true
+			default:
+				st.names = []string{name}
+			}
+		case '[':
+			end := closingBracket(s)
+			if end < 0 {
+				return nil, fmt.Errorf("%q: invalid JSONPath: missing \"]\"", expr)
+			}
+			st, err = parseBracket(s[1:end])
+			if err != nil {
+				return nil, fmt.Errorf("%q: invalid JSONPath: %v", expr, err)
+			}
+			s = s[end+1:]
+		default:
+			return nil, fmt.Errorf("%q: invalid JSONPath: unexpected %q", expr, s)
+		}
+		steps = append(steps, st)
+	}
+	return &Path{expr: expr, steps: steps}, nil
+}
+
+// Index of the "]" terminating the bracket expression at the beginning of s, ignoring brackets in quoted names.
+func closingBracket(s string) int {
+	var quote byte
+	for i := 1; i < len(s); i++ {
+		switch {
+		case quote != 0 && s[i] == '\\':
+			i++
+		case quote != 0 && s[i] == quote:
+			quote = 0
+		case quote == 0 && (s[i] == '\'' || s[i] == '"'):
+			quote = s[i]
+		case quote == 0 && s[i] == ']':
+			return i
+		}
+	}
+	return -1
+}
+
+// Parses the content of a bracket expression: *, a list of quoted names, or a list of indexes.
+func parseBracket(s string) (step, error) {
+	var st step
+	if strings.TrimSpace(s) == "*" {
+		st.wildcard = true
+		return st, nil
+	}
+	for _, elem := range splitUnion(s) {
+		elem = strings.TrimSpace(elem)
+		if len(elem) >= 2 && (elem[0] == '\'' || elem[0] == '"') && elem[len(elem)-1] == elem[0] {
+			st.names = append(st.names, unescape(elem[1:len(elem)-1]))
+			continue
+		}
+		i, err := strconv.Atoi(elem)
+		if err != nil {
+			return st, fmt.Errorf("invalid index or name %q, names must be quoted", elem)
+		}
+		st.indexes = append(st.indexes, i)
+	}
+	if len(st.names) > 0 && len(st.indexes) > 0 {
+		return st, fmt.Errorf("cannot mix names and indexes in [%v]", s)
+	}
+	return st, nil
+}
+
+// In quoted names, a backslash escapes the following character, like \' or \\.
+func unescape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// Splits a union at the commas outside of quoted names.
+func splitUnion(s string) []string {
+	var (
+		result []string
+		quote  byte
+		start  int
+	)
+	for i := 0; i < len(s); i++ {
+		switch {
+		case quote != 0 && s[i] == '\\':
+			i++
+		case quote != 0 && s[i] == quote:
+			quote = 0
+		case quote == 0 && (s[i] == '\'' || s[i] == '"'):
+			quote = s[i]
+		case quote == 0 && s[i] == ',':
+			result = append(result, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(result, s[start:])
+}
+
+func (p *Path) String() string {
+	return p.expr
+}
+
+// Returns the values selected in a document decoded with encoding/json, in document order for arrays
+// and in the order of the union for names. Wildcards on objects select the values in the order of the sorted keys.
+// Returns an empty result if nothing matches.
+func (p *Path) Find(doc interface{}) []interface{} {
+	current := []interface{}{doc}
+	for _, st := range p.steps {
+		var next []interface{}
+		for _, value := range current {
+			next = append(next, st.apply(value)...)
+		}
+		current = next
+	}
+	return current
+}
+
+func (st step) apply(value interface{}) []interface{} {
+	var result []interface{}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if st.wildcard {
+			for _, key := range sortedKeys(v) {
+				result = append(result, v[key])
+			}
+		}
+		for _, name := range st.names {
+			if elem, exists := v[name]; exists {
+				result = append(result, elem)
+			}
+		}
+	case []interface{}:
+		if st.wildcard {
+			result = append(result, v...)
+		}
+		for _, i := range st.indexes {
+			if i < 0 {
+				i += len(v)
+			}
+			if i >= 0 && i < len(v) {
+				result = append(result, v[i])
+			}
+		}
+	}
+	return result
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	result := make([]string, 0, len(m))
+	for key := range m {
+		result = append(result, key)
+	}
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,80 @@
+// Copyright 2016-2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jsonpath
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const doc = `{
+  "message": "top level",
+  "events": [
+    {"msg": "first", "text": "one"},
+    {"msg": "second"},
+    {"text": "three"}
+  ],
+  "records": [{"log": "record 0"}, {"log": "record 1"}],
+  "nested": {"path": {"to": {"element": "deep"}}},
+  "dotted.key": "dotted",
+  "quo'te]": "quoted",
+  "count": 42
+}`
+
+func TestFind(t *testing.T) {
+	var v interface{}
+	decoder := json.NewDecoder(strings.NewReader(doc))
+	decoder.UseNumber()
+	if err := decoder.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	for expr, expected := range map[string]string{
+		".message":                  "[top level]",
+		"$.message":                 "[top level]",
+		".nested.path.to.element":   "[deep]",
+		"$.events[*].msg":           "[first second]",
+		"$.events[*]['msg','text']": "[first one second three]",
+		"$.events[0,2].text":        "[one three]",
+		"$.records[0].log":          "[record 0]",
+		"$.records[-1].log":         "[record 1]",
+		"$.records[5].log":          "[]",
+		"$['dotted.key']":           "[dotted]",
+		`$["quo'te]"]`:              "[quoted]",
+		`$['quo\'te]']`:             "[quoted]",
+		"$.nested.*.to.element":     "[deep]",
+		"$.count":                   "[42]",
+		"$.missing":                 "[]",
+		"$.message.length":          "[]",
+	} {
+		path, err := Parse(expr)
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", expr, err)
+			continue
+		}
+		if actual := fmt.Sprintf("%v", path.Find(v)); actual != expected {
+			t.Errorf("%v: expected %v, got %v", expr, expected, actual)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, expr := range []string{"", "message", "$..message", "$.", "$.events[", "$.events[*", "$[msg]", "$[0,'msg']", "$.events[]", "$x"} {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("%q: expected error", expr)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+// Copyright 2016-2018 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sequix/grok_exporter/tailer/fswatcher"
+	"github.com/sirupsen/logrus"
+)
+
+// Partial lines are flushed when they get larger, so that a container writing without newlines cannot exhaust the memory.
+const maxPartialLineSize = 1024 * 1024
+
+// How often the modification time of the metadata file is checked.
+const kubernetesMetadataCheckInterval = 10 * time.Second
+
+// Names of the fields in fswatcher.Line.Fields for lines read by the kubernetes input.
+// The fields are empty if the information is not available, like the node without metadata file.
+var KubernetesFields = []string{"namespace", "pod", "container", "container_id", "pod_uid", "stream", "node", "app"}
+
+// implements fswatcher.Interface
+type kubernetesTailer struct {
+	out        chan *fswatcher.Line
+	orig       fswatcher.Interface
+	metadata   *kubernetesMetadata // nil if no metadata file is configured
+	logger     logrus.FieldLogger
+	done       chan struct{}
+	terminated chan struct{}
+}
+
+// Content of a partial line written by the container runtime, waiting for the rest of the line.
+type partialLine struct {
+	content strings.Builder
+	fields  map[string]string
+}
+
+// A line in the CRI or Docker JSON log format.
+type containerLogLine struct {
+	content string
+	stream  string
+	partial bool // the line is continued in the next log line
+}
+
+// Format of lines written by the Docker json-file logging driver.
+type dockerLogLine struct {
+	Log    string `json:"log"`
+	Stream string `json:"stream"`
+}
+
+func (k *kubernetesTailer) Lines() chan *fswatcher.Line {
+	return k.out
+}
+
+func (k *kubernetesTailer) Errors() chan fswatcher.Error {
+	return k.orig.Errors()
+}
+
+func (k *kubernetesTailer) Close() {
+	k.orig.Close()
+	close(k.done)
+	<-k.terminated
+}
+
+// Wrapper around a file tailer reading container logs in /var/log/containers or /var/log/pods.
+// The CRI and Docker JSON log formats are unwrapped, partial lines are merged,
+// and the namespace, pod, and container are taken from the file name.
+// If metadataFile is not empty, it is read as JSON list of pods like returned by the kubelet's /pods endpoint,
+// and used to add the pod uid, node, and app label.
+func KubernetesTailer(orig fswatcher.Interface, metadataFile string, logger logrus.FieldLogger) fswatcher.Interface {
+	k := &kubernetesTailer{
+		out:        make(chan *fswatcher.Line),
+		orig:       orig,
+		logger:     logger.WithField("component", "kubernetes"),
+		done:       make(chan struct{}),
+		terminated: make(chan struct{}),
+	}
+	if len(metadataFile) > 0 {
+		k.metadata = &kubernetesMetadata{path: metadataFile}
+	}
+	go k.run()
+	return k
+}
+
+func (k *kubernetesTailer) run() {
+	defer close(k.terminated)
+	partial := make(map[string]*partialLine) // file -> partial line
+	for {
+		select {
+		case line, ok := <-k.orig.Lines():
+			if !ok {
+				k.flushAll(partial)
+				close(k.out)
+				return
+			}
+			k.process(partial, line)
+		case <-k.done:
+			// Lines that are already available are processed nevertheless.
+			k.drain(partial)
+			k.flushAll(partial)
+			close(k.out)
+			return
+		}
+	}
+}
+
+func (k *kubernetesTailer) drain(partial map[string]*partialLine) {
+	for {
+		select {
+		case line, ok := <-k.orig.Lines():
+			if !ok {
+				return
+			}
+			k.process(partial, line)
+		default:
+			return
+		}
+	}
+}
+
+func (k *kubernetesTailer) process(partial map[string]*partialLine, line *fswatcher.Line) {
+	logLine := parseContainerLogLine(line.Line)
+	p, exists := partial[line.File]
+	if !exists {
+		p = &partialLine{fields: k.fields(line, logLine.stream)}
+	}
+	p.content.WriteString(logLine.content)
+	if logLine.partial && p.content.Len() < maxPartialLineSize {
+		partial[line.File] = p
+		return
+	}
+	delete(partial, line.File)
+	k.flush(line.File, p)
+}
+
+func (k *kubernetesTailer) flush(file string, p *partialLine) {
+	k.out <- &fswatcher.Line{
+		Line:   p.content.String(),
+		File:   file,
+		Fields: p.fields,
+	}
+}
+
+func (k *kubernetesTailer) flushAll(partial map[string]*partialLine) {
+	for file, p := range partial {
+		k.flush(file, p)
+	}
+}
+
+func (k *kubernetesTailer) fields(line *fswatcher.Line, stream string) map[string]string {
+	result := make(map[string]string, len(line.Fields)+len(KubernetesFields))
+	for name, value := range line.Fields {
+		result[name] = value
+	}
+	for _, name := range KubernetesFields {
+		result[name] = ""
+	}
+	for name, value := range parseContainerLogPath(line.File) {
+		result[name] = value
+	}
+	result["stream"] = stream
+	if pod := k.metadata.lookup(result["namespace"], result["pod"], k.logger); pod != nil {
+		if len(result["pod_uid"]) == 0 {
+			result["pod_uid"] = pod.Metadata.Uid
+		}
+		result["node"] = pod.Spec.NodeName
+		result["app"] = pod.app()
+	}
+	return result
+}
+
+// Parses a line in the CRI format "<time> <stream> <tag> <content>", where the tag is "P" for partial lines and "F" otherwise,
+// or in the Docker JSON format {"log":"<content>\n","stream":"<stream>","time":"<time>"}, where partial lines don't end with a newline.
+// Lines in other formats are returned as they are.
+func parseContainerLogLine(line string) containerLogLine {
+	if strings.HasPrefix(line, "{") {
+		var dockerLine dockerLogLine
+		if err := json.Unmarshal([]byte(line), &dockerLine); err == nil {
+			content := strings.TrimSuffix(dockerLine.Log, "\n")
+			return containerLogLine{
+				content: content,
+				stream:  dockerLine.Stream,
+				partial: len(content) == len(dockerLine.Log),
+			}
+		}
+		return containerLogLine{content: line}
+	}
+	parts := strings.SplitN(line, " ", 4)
+	if len(parts) < 3 || parts[1] != "stdout" && parts[1] != "stderr" {
+		return containerLogLine{content: line}
+	}
+	result := containerLogLine{
+		stream:  parts[1],
+		partial: strings.Split(parts[2], ":")[0] == "P", // the tag may be extended by further tags separated by ':'
+	}
+	if len(parts) == 4 {
+		result.content = parts[3]
+	}
+	return result
+}
+
+// Gets the namespace, pod, and container from the path of a container log file. Supported are
+// /var/log/containers/<pod>_<namespace>_<container>-<container id>.log and /var/log/pods/<namespace>_<pod>_<pod uid>/<container>/<n>.log.
+// Names in Kubernetes cannot contain '_', so the result is unique.
+func parseContainerLogPath(path string) map[string]string {
+	name := strings.TrimSuffix(filepath.Base(path), ".log")
+	if parts := strings.Split(name, "_"); len(parts) == 3 {
+		if i := strings.LastIndex(parts[2], "-"); i > 0 {
+			return map[string]string{
+				"pod":          parts[0],
+				"namespace":    parts[1],
+				"container":    parts[2][:i],
+				"container_id": parts[2][i+1:],
+			}
+		}
+	}
+	containerDir := filepath.Dir(path)
+	if parts := strings.Split(filepath.Base(filepath.Dir(containerDir)), "_"); len(parts) == 3 {
+		return map[string]string{
+			"namespace": parts[0],
+			"pod":       parts[1],
+			"pod_uid":   parts[2],
+			"container": filepath.Base(containerDir),
+		}
+	}
+	return nil
+}
+
+// Pod metadata from a local file, like the output of the kubelet's /pods endpoint or of 'kubectl get pods -o json'.
+// The file is re-read when it is modified.
+type kubernetesMetadata struct {
+	path      string
+	modTime   time.Time
+	lastCheck time.Time
+	pods      map[string]*podMetadata // namespace/name -> pod
+}
+
+type podList struct {
+	Items []*podMetadata `json:"items"`
+}
+
+type podMetadata struct {
+	Metadata struct {
+		Name      string            `json:"name"`
+		Namespace string            `json:"namespace"`
+		Uid       string            `json:"uid"`
+		Labels    map[string]string `json:"labels"`
+	} `json:"metadata"`
+	Spec struct {
+		NodeName string `json:"nodeName"`
+	} `json:"spec"`
+}
+
+// The app label, see https://kubernetes.io/docs/concepts/overview/working-with-objects/common-labels/
+func (pod *podMetadata) app() string {
+	if app, exists := pod.Metadata.Labels["app.kubernetes.io/name"]; exists {
+		return app
+	}
+	return pod.Metadata.Labels["app"]
+}
+
+// Returns nil if the pod is unknown. Only called from the kubernetesTailer's goroutine, so no locking is needed.
+func (m *kubernetesMetadata) lookup(namespace, name string, logger logrus.FieldLogger) *podMetadata {
+	if m == nil {
+		return nil
+	}
+	// New pods are not in the metadata file before it is updated, so the file is checked again when a pod is unknown.
+	if _, known := m.pods[namespace+"/"+name]; !known || time.Since(m.lastCheck) >= kubernetesMetadataCheckInterval {
+		m.reloadIfModified(logger)
+	}
+	return m.pods[namespace+"/"+name]
+}
+
+func (m *kubernetesMetadata) reloadIfModified(logger logrus.FieldLogger) {
+	if time.Since(m.lastCheck) < time.Second {
+		return // don't stat the file for each line of an unknown pod
+	}
+	m.lastCheck = time.Now()
+	fi, err := os.Stat(m.path)
+	if err != nil {
+		if !os.IsNotExist(err) || m.pods != nil {
+			logger.WithError(err).Warn("failed to read kubernetes metadata file " + m.path)
+		}
+		return
+	}
+	if fi.ModTime().Equal(m.modTime) {
+		return
+	}
+	buf, err := ioutil.ReadFile(m.path)
+	if err != nil {
+		logger.WithError(err).Warn("failed to read kubernetes metadata file " + m.path)
+		return
+	}
+	var list podList
+	if err := json.Unmarshal(buf, &list); err != nil {
+		// The file may be written while we read it, so it is read again when the modification time changes.
+		logger.WithError(err).Warn("failed to parse kubernetes metadata file " + m.path)
+		return
+	}
+	m.pods = make(map[string]*podMetadata, len(list.Items))
+	for _, pod := range list.Items {
+		m.pods[pod.Metadata.Namespace+"/"+pod.Metadata.Name] = pod
+	}
+	m.modTime = fi.ModTime()
+}
@@ -0,0 +1,161 @@
+// Copyright 2016-2018 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sequix/grok_exporter/tailer/fswatcher"
+	"github.com/sequix/grok_exporter/tailer/position"
+)
+
+const containerId = "5f2c4b1e0e9d8c7b6a5f4e3d2c1b0a9f8e7d6c5b4a3f2e1d0c9b8a7f6e5d4c3b"
+
+const kubeletPods = `{
+  "kind": "PodList",
+  "items": [
+    {
+      "metadata": {
+        "name": "web-7d4b9c8f6-x2x9z",
+        "namespace": "shop",
+        "uid": "0f6b1c2e-1111-2222-3333-444455556666",
+        "labels": {"app.kubernetes.io/name": "web", "pod-template-hash": "7d4b9c8f6"}
+      },
+      "spec": {"nodeName": "node-1"}
+    }
+  ]
+}`
+
+func TestParseContainerLogLine(t *testing.T) {
+	for line, expected := range map[string]containerLogLine{
+		"2019-10-06T00:17:09.669794202Z stdout F GET /index.html 200":                               {content: "GET /index.html 200", stream: "stdout"},
+		"2019-10-06T00:17:09.669794202Z stderr P first part ":                                       {content: "first part ", stream: "stderr", partial: true},
+		"2019-10-06T00:17:09.669794202Z stdout F":                                                   {content: "", stream: "stdout"},
+		`{"log":"GET /index.html 200\n","stream":"stdout","time":"2019-10-06T00:17:09.669794202Z"}`: {content: "GET /index.html 200", stream: "stdout"},
+		`{"log":"first part ","stream":"stderr","time":"2019-10-06T00:17:09.669794202Z"}`:           {content: "first part ", stream: "stderr", partial: true},
+		"plain text line":    {content: "plain text line"},
+		`{"not": "a docker"`: {content: `{"not": "a docker"`},
+	} {
+		if actual := parseContainerLogLine(line); actual != expected {
+			t.Errorf("%q: expected %+v, got %+v", line, expected, actual)
+		}
+	}
+}
+
+func TestParseContainerLogPath(t *testing.T) {
+	for path, expected := range map[string]map[string]string{
+		"/var/log/containers/web-7d4b9c8f6-x2x9z_shop_nginx-" + containerId + ".log": {
+			"pod":          "web-7d4b9c8f6-x2x9z",
+			"namespace":    "shop",
+			"container":    "nginx",
+			"container_id": containerId,
+		},
+		"/var/log/pods/shop_web-7d4b9c8f6-x2x9z_0f6b1c2e-1111-2222-3333-444455556666/nginx/0.log": {
+			"pod":       "web-7d4b9c8f6-x2x9z",
+			"namespace": "shop",
+			"pod_uid":   "0f6b1c2e-1111-2222-3333-444455556666",
+			"container": "nginx",
+		},
+		"/var/log/syslog": nil,
+	} {
+		if actual := parseContainerLogPath(path); !reflect.DeepEqual(actual, expected) {
+			t.Errorf("%v: expected %v, got %v", path, expected, actual)
+		}
+	}
+}
+
+func TestKubernetesTailer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grok_exporter_kubernetes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	metadataFile := filepath.Join(dir, "pods.json")
+	if err = ioutil.WriteFile(metadataFile, []byte(kubeletPods), 0644); err != nil {
+		t.Fatal(err)
+	}
+	criFile := filepath.Join(dir, "containers", "web-7d4b9c8f6-x2x9z_shop_nginx-"+containerId+".log")
+	writeTestLogFile(t, filepath.Dir(criFile), filepath.Base(criFile), ""+
+		"2019-10-06T00:17:09.669794202Z stdout F GET /index.html 200\n"+
+		"2019-10-06T00:17:09.769794202Z stderr P a long \n"+
+		"2019-10-06T00:17:09.769794202Z stderr F error message\n")
+	dockerFile := filepath.Join(dir, "containers", "db-0_shop_postgres-"+containerId+".log")
+	writeTestLogFile(t, filepath.Dir(dockerFile), filepath.Base(dockerFile), ""+
+		`{"log":"checkpoint starting\n","stream":"stdout","time":"2019-10-06T00:17:09.669794202Z"}`+"\n")
+
+	orig := runTestFileTailer(t, filepath.Join(dir, "containers", "*.log"), position.NewMemPos(), nil, false)
+	tail := KubernetesTailer(orig, metadataFile, testLogger)
+	defer tail.Close()
+
+	lines := make(map[string]*fswatcher.Line)
+	for len(lines) < 3 {
+		select {
+		case line := <-tail.Lines():
+			lines[line.Line] = line
+		case err := <-tail.Errors():
+			t.Fatalf("unexpected error: %v", err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout while waiting for lines, got %v", lines)
+		}
+	}
+	expectKubernetesLine(t, lines, "GET /index.html 200", criFile, map[string]string{
+		"namespace":    "shop",
+		"pod":          "web-7d4b9c8f6-x2x9z",
+		"container":    "nginx",
+		"container_id": containerId,
+		"pod_uid":      "0f6b1c2e-1111-2222-3333-444455556666",
+		"stream":       "stdout",
+		"node":         "node-1",
+		"app":          "web",
+	})
+	expectKubernetesLine(t, lines, "a long error message", criFile, map[string]string{
+		"namespace":    "shop",
+		"pod":          "web-7d4b9c8f6-x2x9z",
+		"container":    "nginx",
+		"container_id": containerId,
+		"pod_uid":      "0f6b1c2e-1111-2222-3333-444455556666",
+		"stream":       "stderr",
+		"node":         "node-1",
+		"app":          "web",
+	})
+	// The pod is not in the metadata file.
+	expectKubernetesLine(t, lines, "checkpoint starting", dockerFile, map[string]string{
+		"namespace":    "shop",
+		"pod":          "db-0",
+		"container":    "postgres",
+		"container_id": containerId,
+		"pod_uid":      "",
+		"stream":       "stdout",
+		"node":         "",
+		"app":          "",
+	})
+}
+
+func expectKubernetesLine(t *testing.T, lines map[string]*fswatcher.Line, line, file string, fields map[string]string) {
+	l, exists := lines[line]
+	switch {
+	case !exists:
+		t.Errorf("line %q not found", line)
+	case l.File != file:
+		t.Errorf("%q: expected file %v, got %v", line, file, l.File)
+	case !reflect.DeepEqual(l.Fields, fields):
+		t.Errorf("%q: expected fields %v, got %v", line, fields, l.Fields)
+	}
+}
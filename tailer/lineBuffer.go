@@ -5,16 +5,20 @@ import (
 	"io"
 	"sync"
 
+	"github.com/sirupsen/logrus"
+
 	"github.com/sequix/grok_exporter/tailer/fswatcher"
 )
 
 // lineBuffer is a thread safe queue for *fswatcher.Line.
 type lineBuffer interface {
-	io.Closer // will interrupt BlockingPop()
-	Push(line *fswatcher.Line)
-	BlockingPop() *fswatcher.Line // can be interrupted by calling Close()
+	io.Closer                       // will interrupt BlockingPop()
+	Push(line *fswatcher.Line) bool // false if the line was dropped
+	BlockingPop() *fswatcher.Line   // can be interrupted by calling Close()
 	Len() int
 	Clear()
+	StopBlocking() // Push() no longer waits for free space, so that the remaining lines can be pushed while the tailer is closed
+	Finish()       // no more lines are pushed, BlockingPop() returns the remaining lines and then nil
 }
 
 func NewLineBuffer() lineBuffer {
@@ -26,18 +30,21 @@ func NewLineBuffer() lineBuffer {
 }
 
 type lineBufferImpl struct {
-	buffer *list.List
-	lock   *sync.Cond
-	closed bool
+	buffer   *list.List
+	lock     *sync.Cond
+	closed   bool
+	finished bool
 }
 
-func (b *lineBufferImpl) Push(line *fswatcher.Line) {
+func (b *lineBufferImpl) Push(line *fswatcher.Line) bool {
 	b.lock.L.Lock()
 	defer b.lock.L.Unlock()
-	if !b.closed {
+	if !b.closed && !b.finished {
 		b.buffer.PushBack(line)
 		b.lock.Signal()
+		return true
 	}
+	return false
 }
 
 // Interrupted by Close(), returns nil when Close() is called.
@@ -45,10 +52,10 @@ func (b *lineBufferImpl) BlockingPop() *fswatcher.Line {
 	b.lock.L.Lock()
 	defer b.lock.L.Unlock()
 	if !b.closed {
-		for b.buffer.Len() == 0 && !b.closed {
+		for b.buffer.Len() == 0 && !b.closed && !b.finished {
 			b.lock.Wait()
 		}
-		if !b.closed {
+		if !b.closed && b.buffer.Len() > 0 {
 			first := b.buffer.Front()
 			b.buffer.Remove(first)
 			return first.Value.(*fswatcher.Line)
@@ -67,6 +74,16 @@ func (b *lineBufferImpl) Close() error {
 	return nil
 }
 
+// Push() never blocks.
+func (b *lineBufferImpl) StopBlocking() {}
+
+func (b *lineBufferImpl) Finish() {
+	b.lock.L.Lock()
+	defer b.lock.L.Unlock()
+	b.finished = true
+	b.lock.Signal()
+}
+
 func (b *lineBufferImpl) Len() int {
 	b.lock.L.Lock()
 	defer b.lock.L.Unlock()
@@ -78,3 +95,245 @@ func (b *lineBufferImpl) Clear() {
 	defer b.lock.L.Unlock()
 	b.buffer = list.New()
 }
+
+// lineBuffer keeping at most maxLines lines in memory. When the limit is reached, Push() either blocks
+// until lines are taken from the buffer, which blocks the tailer, or appends the line to a spillQueue on disk.
+// Once lines were spilled, all lines are spilled until the spillQueue is empty, so that the order is kept.
+// Lines are encoded and written to disk without holding lock, so disk I/O doesn't block taking lines from memory.
+type boundedLineBuffer struct {
+	memory       *list.List
+	maxLines     int
+	spilled      int         // number of lines in spill, updated after the spillQueue was updated
+	spill        *spillQueue // nil if Push() blocks
+	maxSpillSize int64       // 0 means unlimited
+	spillFull    bool        // for logging the warning only once
+	metric       BufferLoadMetric
+	log          logrus.FieldLogger
+	lock         *sync.Cond  // guards memory, spilled, closed, finished, and stopBlocking
+	pushLock     *sync.Mutex // serializes Push(), so a line is not put into memory while the previous line is spilled
+	spillLock    *sync.Mutex // guards spill and spillFull, acquired after pushLock and before lock
+	closed       bool
+	finished     bool
+	stopBlocking bool
+}
+
+// If spill is nil, Push() blocks when maxLines is reached.
+func newBoundedLineBuffer(maxLines int, spill *spillQueue, maxSpillSize int64, metric BufferLoadMetric, log logrus.FieldLogger) *boundedLineBuffer {
+	spilled := 0
+	if spill != nil {
+		spilled = spill.Len()
+	}
+	return &boundedLineBuffer{
+		memory:       list.New(),
+		maxLines:     maxLines,
+		spilled:      spilled,
+		spill:        spill,
+		maxSpillSize: maxSpillSize,
+		metric:       metric,
+		log:          log,
+		lock:         sync.NewCond(&sync.Mutex{}),
+		pushLock:     &sync.Mutex{},
+		spillLock:    &sync.Mutex{},
+	}
+}
+
+func (b *boundedLineBuffer) Push(line *fswatcher.Line) bool {
+	b.pushLock.Lock()
+	defer b.pushLock.Unlock()
+	b.lock.L.Lock()
+	if b.spill == nil {
+		for b.memory.Len() >= b.maxLines && !b.closed && !b.stopBlocking {
+			b.lock.Wait()
+		}
+	}
+	if b.closed || b.finished {
+		b.lock.L.Unlock()
+		return false
+	}
+	if b.spill == nil || b.memory.Len() < b.maxLines && b.spilled == 0 {
+		b.memory.PushBack(line)
+		b.lock.Broadcast()
+		b.lock.L.Unlock()
+		return true
+	}
+	b.lock.L.Unlock()
+	return b.spillLine(line)
+}
+
+func (b *boundedLineBuffer) spillLine(line *fswatcher.Line) bool {
+	record, err := encodeSpillRecord(line)
+	if err != nil {
+		b.log.Errorf("Failed to spill line to disk: %v. Dropping line.", err)
+		return false
+	}
+	b.spillLock.Lock()
+	defer b.spillLock.Unlock()
+	if b.maxSpillSize > 0 && b.spill.Size()+int64(len(record)) > b.maxSpillSize {
+		if !b.spillFull {
+			b.log.Warnf("Line buffer reached limit of %v lines and buffer_spill_max_size of %v bytes. Dropping lines until lines are processed.", b.maxLines, b.maxSpillSize)
+			b.spillFull = true
+		}
+		return false
+	}
+	b.spillFull = false
+	if err = b.spill.Push(record); err != nil {
+		b.log.Errorf("Failed to spill line to disk: %v. Dropping line.", err)
+		return false
+	}
+	b.metric.Spilled(len(record))
+	b.lock.L.Lock()
+	b.spilled++
+	b.lock.Broadcast()
+	b.lock.L.Unlock()
+	return true
+}
+
+// Interrupted by Close(), returns nil when Close() is called.
+// Lines that cannot be read from the spillQueue are dropped.
+func (b *boundedLineBuffer) BlockingPop() *fswatcher.Line {
+	b.lock.L.Lock()
+	defer b.lock.L.Unlock()
+	for !b.closed {
+		switch {
+		case b.memory.Len() > 0:
+			first := b.memory.Front()
+			b.memory.Remove(first)
+			b.lock.Broadcast()
+			return first.Value.(*fswatcher.Line)
+		case b.spilled > 0:
+			b.lock.L.Unlock()
+			line := b.popSpilled()
+			b.lock.L.Lock()
+			if line != nil {
+				return line
+			}
+		case b.finished:
+			return nil
+		default:
+			b.lock.Wait()
+		}
+	}
+	return nil
+}
+
+// Returns nil if the line cannot be read or if the buffer was closed.
+func (b *boundedLineBuffer) popSpilled() *fswatcher.Line {
+	b.spillLock.Lock()
+	defer b.spillLock.Unlock()
+	b.lock.L.Lock()
+	closed := b.closed
+	b.lock.L.Unlock()
+	if closed || b.spill.Len() == 0 {
+		return nil
+	}
+	line, err := b.spill.Pop()
+	b.lock.L.Lock()
+	defer b.lock.L.Unlock()
+	if err == nil {
+		b.spilled--
+		return line
+	}
+	if _, ok := err.(invalidSpillRecordError); ok {
+		b.log.Errorf("%v. Dropping line.", err)
+		b.spilled--
+		b.metric.Dec()
+		b.metric.Dropped(1)
+		return nil
+	}
+	b.log.Errorf("Failed to read spilled lines from disk: %v. Dropping %v spilled lines.", err, b.spill.Len())
+	b.metric.Set(int64(b.memory.Len()))
+	b.metric.Dropped(b.spill.Len())
+	if err = b.spill.Clear(); err != nil {
+		b.log.Errorf("%v", err)
+	}
+	b.spilled = 0
+	return nil
+}
+
+// Closes the spillQueue. The lines in memory are spilled before the lines that were already spilled,
+// so all lines are read again in their original order when the next boundedLineBuffer is created with the same directory.
+// These are at most maxLines lines, they are spilled even if this exceeds maxSpillSize.
+func (b *boundedLineBuffer) Close() error {
+	b.lock.L.Lock()
+	if b.closed {
+		b.lock.L.Unlock()
+		return nil
+	}
+	b.closed = true
+	b.lock.Broadcast() // interrupts a Push() that waits in block mode
+	if b.spill == nil {
+		b.lock.L.Unlock()
+		return nil
+	}
+	memory := b.memory
+	b.memory = list.New()
+	b.lock.L.Unlock()
+	// Wait until a line that is currently spilled was written.
+	b.pushLock.Lock()
+	defer b.pushLock.Unlock()
+	records := make([][]byte, 0, memory.Len())
+	size := 0
+	for e := memory.Front(); e != nil; e = e.Next() {
+		record, err := encodeSpillRecord(e.Value.(*fswatcher.Line))
+		if err != nil {
+			b.log.Errorf("Failed to spill line to disk: %v. Dropping line.", err)
+			continue
+		}
+		records = append(records, record)
+		size += len(record)
+	}
+	b.spillLock.Lock()
+	defer b.spillLock.Unlock()
+	err := b.spill.Prepend(records)
+	if err == nil {
+		b.metric.Spilled(size)
+	}
+	if closeErr := b.spill.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		b.log.Errorf("%v", err)
+	}
+	return err
+}
+
+// Lines that don't fit into memory any more are kept in memory anyway, if Push() would block otherwise.
+func (b *boundedLineBuffer) StopBlocking() {
+	b.lock.L.Lock()
+	defer b.lock.L.Unlock()
+	b.stopBlocking = true
+	b.lock.Broadcast()
+}
+
+// With a spillQueue, the remaining lines are kept on disk for the next boundedLineBuffer instead, see Close().
+func (b *boundedLineBuffer) Finish() {
+	if b.spill != nil {
+		b.Close()
+		return
+	}
+	b.lock.L.Lock()
+	defer b.lock.L.Unlock()
+	b.finished = true
+	b.lock.Broadcast()
+}
+
+func (b *boundedLineBuffer) Len() int {
+	b.lock.L.Lock()
+	defer b.lock.L.Unlock()
+	return b.memory.Len() + b.spilled
+}
+
+func (b *boundedLineBuffer) Clear() {
+	if b.spill != nil {
+		b.spillLock.Lock()
+		defer b.spillLock.Unlock()
+		if err := b.spill.Clear(); err != nil {
+			b.log.Errorf("%v", err)
+		}
+	}
+	b.lock.L.Lock()
+	defer b.lock.L.Unlock()
+	b.memory = list.New()
+	b.spilled = 0
+	b.lock.Broadcast()
+}
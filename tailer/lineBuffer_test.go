@@ -3,7 +3,9 @@ package tailer
 import (
 	"fmt"
 	"github.com/sequix/grok_exporter/tailer/fswatcher"
+	"io/ioutil"
 	"math/rand"
+	"os"
 	"sync"
 	"testing"
 	"time"
@@ -129,3 +131,44 @@ func TestLineBufferClose(t *testing.T) {
 		t.Fatal("BlockingPop() not interrupted by Close()")
 	}
 }
+
+// Lines that are still in memory are spilled on Close(), before the lines that were spilled already.
+func TestBoundedLineBufferSpillsMemoryOnClose(t *testing.T) {
+	for _, pushed := range []int{3, 12} {
+		dir, err := ioutil.TempDir("", "grok_exporter_spill")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		buf := openTestBoundedLineBuffer(t, dir)
+		for i := 1; i <= pushed; i++ {
+			if !buf.Push(&fswatcher.Line{Line: fmt.Sprintf("line %v", i)}) {
+				t.Fatalf("line %v was dropped", i)
+			}
+		}
+		if line := buf.BlockingPop(); line.Line != "line 1" {
+			t.Fatalf("expected line 1, got %q", line.Line)
+		}
+		if err = buf.Close(); err != nil {
+			t.Fatal(err)
+		}
+		buf = openTestBoundedLineBuffer(t, dir)
+		if buf.Len() != pushed-1 {
+			t.Fatalf("expected %v lines after restart, got %v", pushed-1, buf.Len())
+		}
+		for i := 2; i <= pushed; i++ {
+			if line := buf.BlockingPop(); line.Line != fmt.Sprintf("line %v", i) {
+				t.Fatalf("expected line %v after restart, got %q", i, line.Line)
+			}
+		}
+		buf.Close()
+	}
+}
+
+func openTestBoundedLineBuffer(t *testing.T, dir string) *boundedLineBuffer {
+	spill, err := openSpillQueue(dir, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newBoundedLineBuffer(5, spill, 0, &peakLoadMetric{}, testLogger)
+}
@@ -0,0 +1,218 @@
+// Copyright 2016-2018 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sequix/grok_exporter/config/v2"
+	"github.com/sequix/grok_exporter/oniguruma"
+	"github.com/sequix/grok_exporter/tailer/fswatcher"
+	"github.com/sirupsen/logrus"
+)
+
+// implements fswatcher.Interface
+type multilineTailer struct {
+	out        chan *fswatcher.Line
+	orig       fswatcher.Interface
+	done       chan struct{}
+	terminated chan struct{}
+}
+
+type MultilineConfig struct {
+	Start    *oniguruma.Regex // a line matching start begins a new event
+	Continue *oniguruma.Regex // a line not matching continue begins a new event
+	MaxLines int              // an event is flushed when it has max lines, 0 means no limit
+	MaxWait  time.Duration    // an event is flushed when no line was added for max wait
+	// Fields that identify the remote source of lines without a file, like the syslog hostname, see MultilineSourceFields().
+	SourceFields []string
+}
+
+// lines of an event that was not flushed yet
+type pendingEvent struct {
+	file       string
+	lines      []string
+	fields     map[string]string // fields of the first line
+	lastUpdate time.Time
+}
+
+func (m *multilineTailer) Lines() chan *fswatcher.Line {
+	return m.out
+}
+
+func (m *multilineTailer) Errors() chan fswatcher.Error {
+	return m.orig.Errors()
+}
+
+func (m *multilineTailer) Close() {
+	m.orig.Close()
+	close(m.done)
+	<-m.terminated
+}
+
+// Wrapper around a tailer that merges multi-line events like stack traces into a single line.
+// Lines are merged per source, see sourceKey(), the merged line contains the original lines separated by "\n".
+// The regular expressions in cfg must not be used by other goroutines.
+// The lines channel must be consumed until it is closed, because pending events are flushed on Close().
+// The bufferedTailer does this, so a multiline tailer wrapped in a bufferedTailer keeps the flushed events.
+func MultilineTailer(orig fswatcher.Interface, cfg *MultilineConfig, log logrus.FieldLogger) fswatcher.Interface {
+	m := &multilineTailer{
+		out:        make(chan *fswatcher.Line),
+		orig:       orig,
+		done:       make(chan struct{}),
+		terminated: make(chan struct{}),
+	}
+	go m.run(cfg, log)
+	return m
+}
+
+func (m *multilineTailer) run(cfg *MultilineConfig, log logrus.FieldLogger) {
+	defer close(m.terminated)
+	pending := make(map[string]*pendingEvent)
+	ticker := time.NewTicker(cfg.MaxWait / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case line, ok := <-m.orig.Lines():
+			if !ok {
+				m.flushAll(pending)
+				close(m.out)
+				return
+			}
+			m.add(pending, line, cfg, log)
+		case now := <-ticker.C:
+			for key, event := range pending {
+				if now.Sub(event.lastUpdate) >= cfg.MaxWait {
+					m.flush(event)
+					delete(pending, key)
+				}
+			}
+		case <-m.done:
+			// The original tailer may not close its lines channel, like the stdin tailer.
+			// Lines that are already available are processed nevertheless.
+			m.drain(pending, cfg, log)
+			m.flushAll(pending)
+			close(m.out)
+			return
+		}
+	}
+}
+
+func (m *multilineTailer) add(pending map[string]*pendingEvent, line *fswatcher.Line, cfg *MultilineConfig, log logrus.FieldLogger) {
+	key := sourceKey(cfg, line)
+	event, exists := pending[key]
+	if exists && startsNewEvent(cfg, line.Line, log) {
+		m.flush(event)
+		delete(pending, key)
+		exists = false
+	}
+	if !exists {
+		event = &pendingEvent{file: line.File, fields: line.Fields}
+		pending[key] = event
+	}
+	event.lines = append(event.lines, line.Line)
+	event.lastUpdate = time.Now()
+	if cfg.MaxLines > 0 && len(event.lines) >= cfg.MaxLines {
+		m.flush(event)
+		delete(pending, key)
+	}
+}
+
+// Lines of different files or remote sources are never merged, even if they are interleaved.
+// The tailer belongs to a single input, the input name is set after the lines were merged.
+// Each value is prefixed with its length, because the values may contain any character.
+func sourceKey(cfg *MultilineConfig, line *fswatcher.Line) string {
+	var sb strings.Builder
+	values := []string{line.File}
+	if len(line.File) == 0 {
+		for _, name := range cfg.SourceFields {
+			values = append(values, line.Fields[name])
+		}
+	}
+	for _, value := range values {
+		sb.WriteString(strconv.Itoa(len(value)))
+		sb.WriteByte(':')
+		sb.WriteString(value)
+	}
+	return sb.String()
+}
+
+// The fields that identify the remote source of a line for inputs that don't read files.
+// Fields that may change from line to line, like the syslog severity, are not included.
+func MultilineSourceFields(input *v2.InputConfig) []string {
+	switch input.Type {
+	case "syslog":
+		return []string{"hostname", "appname"}
+	case "journald":
+		return []string{"_HOSTNAME", "_SYSTEMD_UNIT", "_SYSTEMD_USER_UNIT", "SYSLOG_IDENTIFIER", "_PID", "CONTAINER_NAME"}
+	case "webhook":
+		result := make([]string, 0, len(input.WebhookFields))
+		for name := range input.WebhookFields {
+			result = append(result, name)
+		}
+		sort.Strings(result)
+		return result
+	default:
+		return nil
+	}
+}
+
+func (m *multilineTailer) drain(pending map[string]*pendingEvent, cfg *MultilineConfig, log logrus.FieldLogger) {
+	for {
+		select {
+		case line, ok := <-m.orig.Lines():
+			if !ok {
+				return
+			}
+			m.add(pending, line, cfg, log)
+		default:
+			return
+		}
+	}
+}
+
+func startsNewEvent(cfg *MultilineConfig, line string, log logrus.FieldLogger) bool {
+	if cfg.Start != nil && matches(cfg.Start, line, log) {
+		return true
+	}
+	return cfg.Continue != nil && !matches(cfg.Continue, line, log)
+}
+
+func matches(regex *oniguruma.Regex, line string, log logrus.FieldLogger) bool {
+	searchResult, err := regex.Search(line)
+	if err != nil {
+		log.WithField("line", line).WithField("err", err).Warn("multiline pattern error, treat line as not matching")
+		return false
+	}
+	defer searchResult.Free()
+	return searchResult.IsMatch()
+}
+
+func (m *multilineTailer) flush(event *pendingEvent) {
+	m.out <- &fswatcher.Line{
+		Line:   strings.Join(event.lines, "\n"),
+		File:   event.file,
+		Fields: event.fields,
+	}
+}
+
+func (m *multilineTailer) flushAll(pending map[string]*pendingEvent) {
+	for _, event := range pending {
+		m.flush(event)
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2016-2018 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sequix/grok_exporter/config/v2"
+	"github.com/sequix/grok_exporter/oniguruma"
+	"github.com/sequix/grok_exporter/tailer/fswatcher"
+)
+
+func mustCompile(t *testing.T, pattern string) *oniguruma.Regex {
+	regex, err := oniguruma.Compile(pattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return regex
+}
+
+func expectLine(t *testing.T, tail fswatcher.Interface, file, line string) {
+	select {
+	case l := <-tail.Lines():
+		if l.File != file || l.Line != line {
+			t.Fatalf("expected %q from %q, but got %q from %q", line, file, l.Line, l.File)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout while waiting for %q", line)
+	}
+}
+
+func TestMultilineStart(t *testing.T) {
+	src := &sourceTailer{lines: make(chan *fswatcher.Line, 10)}
+	tail := MultilineTailer(src, &MultilineConfig{
+		Start:   mustCompile(t, "^[0-9]"),
+		MaxWait: time.Hour,
+	}, testLogger)
+	for _, line := range []string{"1 exception", "  at a", "  at b", "2 info", "3 exception", "  at c"} {
+		src.lines <- &fswatcher.Line{Line: line, File: "a.log"}
+	}
+	expectLine(t, tail, "a.log", "1 exception\n  at a\n  at b")
+	expectLine(t, tail, "a.log", "2 info")
+	go tail.Close()
+	expectLine(t, tail, "a.log", "3 exception\n  at c")
+	if _, open := <-tail.Lines(); open {
+		t.Fatal("multiline tailer was not closed")
+	}
+}
+
+func TestMultilineContinue(t *testing.T) {
+	src := &sourceTailer{lines: make(chan *fswatcher.Line, 10)}
+	tail := MultilineTailer(src, &MultilineConfig{
+		Continue: mustCompile(t, "^\\s"),
+		MaxWait:  time.Hour,
+	}, testLogger)
+	for _, line := range []string{"Traceback", "  File x", "ValueError", "next"} {
+		src.lines <- &fswatcher.Line{Line: line, File: "a.log"}
+	}
+	expectLine(t, tail, "a.log", "Traceback\n  File x")
+	expectLine(t, tail, "a.log", "ValueError")
+	go tail.Close()
+	expectLine(t, tail, "a.log", "next")
+}
+
+func TestMultilinePerFile(t *testing.T) {
+	src := &sourceTailer{lines: make(chan *fswatcher.Line, 10)}
+	tail := MultilineTailer(src, &MultilineConfig{
+		Start:   mustCompile(t, "^[0-9]"),
+		MaxWait: time.Hour,
+	}, testLogger)
+	src.lines <- &fswatcher.Line{Line: "1 a", File: "a.log"}
+	src.lines <- &fswatcher.Line{Line: "1 b", File: "b.log"}
+	src.lines <- &fswatcher.Line{Line: " a", File: "a.log"}
+	src.lines <- &fswatcher.Line{Line: " b", File: "b.log"}
+	src.lines <- &fswatcher.Line{Line: "2 a", File: "a.log"}
+	expectLine(t, tail, "a.log", "1 a\n a")
+	go tail.Close()
+	// pending events are flushed in random order
+	flushed := make(map[string]string)
+	for line := range tail.Lines() {
+		flushed[line.File] = line.Line
+	}
+	if len(flushed) != 2 || flushed["a.log"] != "2 a" || flushed["b.log"] != "1 b\n b" {
+		t.Fatalf("unexpected lines flushed on close: %v", flushed)
+	}
+}
+
+func TestMultilinePerRemoteSource(t *testing.T) {
+	src := &sourceTailer{lines: make(chan *fswatcher.Line, 10)}
+	tail := MultilineTailer(src, &MultilineConfig{
+		Start:        mustCompile(t, "^[0-9]"),
+		MaxWait:      time.Hour,
+		SourceFields: MultilineSourceFields(&v2.InputConfig{Type: "syslog"}),
+	}, testLogger)
+	syslogLine := func(line, hostname, severity string) *fswatcher.Line {
+		return &fswatcher.Line{Line: line, Fields: map[string]string{"hostname": hostname, "appname": "app", "severity": severity}}
+	}
+	src.lines <- syslogLine("1 exception", "host-a", "err")
+	src.lines <- syslogLine("1 exception", "host-b", "err")
+	src.lines <- syslogLine("  at a", "host-a", "info") // the severity does not identify the source
+	src.lines <- syslogLine("  at b", "host-b", "err")
+	src.lines <- syslogLine("2 info", "host-a", "info")
+	select {
+	case line := <-tail.Lines():
+		if line.Line != "1 exception\n  at a" || line.Fields["hostname"] != "host-a" {
+			t.Fatalf("expected the event of host-a, but got %q from %v", line.Line, line.Fields["hostname"])
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout while waiting for the event of host-a")
+	}
+	go tail.Close()
+	flushed := make(map[string]string)
+	for line := range tail.Lines() {
+		flushed[line.Fields["hostname"]] = line.Line
+	}
+	if len(flushed) != 2 || flushed["host-a"] != "2 info" || flushed["host-b"] != "1 exception\n  at b" {
+		t.Fatalf("unexpected lines flushed on close: %v", flushed)
+	}
+}
+
+// The events flushed on Close() are not lost when the multiline tailer is wrapped in a buffered tailer, like in grok_exporter.go.
+func TestMultilineFlushOnCloseWhenBuffered(t *testing.T) {
+	src := &sourceTailer{lines: make(chan *fswatcher.Line, 10)}
+	tail, err := BufferedTailerWithMetrics(MultilineTailer(src, &MultilineConfig{
+		Start:   mustCompile(t, "^[0-9]"),
+		MaxWait: time.Hour,
+	}, testLogger), &noopMetric{}, testLogger, BufferConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	src.lines <- &fswatcher.Line{Line: "1 exception", File: "a.log"}
+	src.lines <- &fswatcher.Line{Line: "  at a", File: "a.log"}
+	tail.Close()
+	expectLine(t, tail, "a.log", "1 exception\n  at a")
+	if _, open := <-tail.Lines(); open {
+		t.Fatal("buffered tailer was not closed")
+	}
+}
+
+func TestMultilineMaxLines(t *testing.T) {
+	src := &sourceTailer{lines: make(chan *fswatcher.Line, 10)}
+	tail := MultilineTailer(src, &MultilineConfig{
+		Start:    mustCompile(t, "^[0-9]"),
+		MaxLines: 2,
+		MaxWait:  time.Hour,
+	}, testLogger)
+	for _, line := range []string{"1", " a", " b"} {
+		src.lines <- &fswatcher.Line{Line: line}
+	}
+	expectLine(t, tail, "", "1\n a")
+	go tail.Close()
+	expectLine(t, tail, "", " b")
+}
+
+func TestMultilineMaxWait(t *testing.T) {
+	src := &sourceTailer{lines: make(chan *fswatcher.Line, 10)}
+	tail := MultilineTailer(src, &MultilineConfig{
+		Start:   mustCompile(t, "^[0-9]"),
+		MaxWait: 20 * time.Millisecond,
+	}, testLogger)
+	src.lines <- &fswatcher.Line{Line: "1"}
+	src.lines <- &fswatcher.Line{Line: " a"}
+	expectLine(t, tail, "", "1\n a")
+	tail.Close()
+}
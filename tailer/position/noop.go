@@ -5,8 +5,9 @@ import (
 )
 
 type memPos struct {
-	mutex *sync.RWMutex
-	pos   map[string]int64
+	mutex   *sync.RWMutex
+	pos     map[string]int64
+	cursors map[string]string
 }
 
 func (m *memPos) DelOffset(devIno string) {
@@ -17,12 +18,14 @@ func (m *memPos) DelOffset(devIno string) {
 
 func NewMemPos() Interface {
 	return &memPos{
-		mutex: &sync.RWMutex{},
-		pos:   make(map[string]int64),
+		mutex:   &sync.RWMutex{},
+		pos:     make(map[string]int64),
+		cursors: make(map[string]string),
 	}
 }
 
-func (m *memPos) GetOffset(devIno string) int64 {
+// The in-memory positions do not survive restarts, so there is no need to check fingerprints.
+func (m *memPos) ResumeOffset(devIno, path string) int64 {
 	m.mutex.RLock()
 	defer m.mutex.RUnlock()
 	return m.pos[devIno]
@@ -34,5 +37,17 @@ func (m *memPos) SetOffset(devIno string, offset int64) {
 	m.mutex.Unlock()
 }
 
+func (m *memPos) Cursor(name string) string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.cursors[name]
+}
+
+func (m *memPos) SetCursor(name, cursor string) {
+	m.mutex.Lock()
+	m.cursors[name] = cursor
+	m.mutex.Unlock()
+}
+
 func (m *memPos) Stop() {
 }
@@ -1,22 +1,44 @@
 package position
 
 import (
+	"encoding/hex"
 	"encoding/json"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+
+	"github.com/sequix/grok_exporter/util"
 )
 
-const positionFileMode = 0600
+const (
+	positionFileMode    = 0600
+	positionFileVersion = 3
+	fingerprintSize     = 1024 // number of bytes at the beginning of a file used as fingerprint
+	backupSuffix        = ".bak"
+	tempSuffix          = ".tmp"
+	// Offsets of files that were not opened within this time after startup are removed,
+	// because the files were deleted or are no longer watched.
+	garbageCollectionDelay = 5 * time.Minute
+)
 
 type Interface interface {
-	GetOffset(devIno string) int64
+	// Returns the offset where reading the file should be resumed, and starts tracking the file.
+	// The stored offset is only used if the file still has the same fingerprint and was not truncated,
+	// otherwise the file is read from the beginning.
+	ResumeOffset(devIno, path string) int64
 	SetOffset(devIno string, offset int64)
 	DelOffset(devIno string)
+	// Returns the stored cursor of an input that does not read files, like the journald cursor, or "" if there is none.
+	Cursor(name string) string
+	SetCursor(name, cursor string)
 	Stop()
 }
 
@@ -26,34 +48,62 @@ type position struct {
 	logger     logrus.FieldLogger
 	path       string
 	interval   time.Duration
-	offsets    map[string]int64 // dev,ino -> offset
+	entries    map[string]*entry   // dev,ino -> entry
+	used       map[string]struct{} // dev,ino of files opened since startup
+	startedAt  time.Time
+	fileValid  bool // the position file can be used as backup, i.e. it was read or written successfully
 	done       chan struct{}
 	terminated chan struct{}
 }
 
+// Position of a file. The fingerprint identifies the file independent of its dev,ino,
+// which may be reused by another file after the file is deleted, or change when the file is copied to another volume.
+type entry struct {
+	Offset          int64  `json:"offset"`
+	Path            string `json:"path,omitempty"`
+	Size            int64  `json:"size"`                       // size of the file when the fingerprint was taken
+	Fingerprint     string `json:"fingerprint,omitempty"`      // FNV-1a of the first FingerprintSize bytes, empty for version 1 and 2 files
+	FingerprintSize int    `json:"fingerprint_size,omitempty"` // less than fingerprintSize while the file is smaller
+	Cursor          string `json:"cursor,omitempty"`           // for inputs that do not read files, the entry is identified by the input name then
+}
+
+// Content of the position file. Version 1 files contain only a map dev,ino -> offset,
+// version 2 files contain that map as offsets.
+type positionFile struct {
+	Version  int             `json:"version"`
+	Checksum uint32          `json:"checksum"` // CRC-32 (IEEE) of offsets
+	Offsets  json.RawMessage `json:"offsets"`
+}
+
 func New(log logrus.FieldLogger, positionFilePath string, syncInterval time.Duration) (Interface, error) {
-	buf, err := ioutil.ReadFile(positionFilePath)
+	logger := log.WithField("component", "position")
+	entries, err := readPositionFile(positionFilePath)
+	fileValid := err == nil
 	if err != nil {
-		if !os.IsNotExist(err) {
-			return nil, errors.Wrap(err, "position read file failed")
+		// The position file is replaced with rename(), so the backup is missing or corrupt only if the position file was edited.
+		backup, backupErr := readPositionFile(positionFilePath + backupSuffix)
+		switch {
+		case backupErr == nil:
+			logger.WithError(err).Warn("position file unreadable, using backup " + positionFilePath + backupSuffix)
+			entries = backup
+		case os.IsNotExist(err) && os.IsNotExist(backupErr):
+			entries = make(map[string]*entry)
+		case os.IsNotExist(err):
+			return nil, backupErr
+		default:
+			return nil, err
 		}
 	}
 
-	if len(buf) == 0 {
-		buf = []byte("{}")
-	}
-
-	offsets := make(map[string]int64)
-	if err := json.Unmarshal(buf, &offsets); err != nil {
-		return nil, errors.Wrap(err, "position unmarshal failed")
-	}
-
 	p := &position{
 		mutex:      &sync.RWMutex{},
-		logger:     log.WithField("component", "position"),
+		logger:     logger,
 		path:       positionFilePath,
 		interval:   syncInterval,
-		offsets:    offsets,
+		entries:    entries,
+		used:       make(map[string]struct{}),
+		startedAt:  time.Now(),
+		fileValid:  fileValid,
 		done:       make(chan struct{}),
 		terminated: make(chan struct{}),
 	}
@@ -61,6 +111,52 @@ func New(log logrus.FieldLogger, positionFilePath string, syncInterval time.Dura
 	return p, nil
 }
 
+func readPositionFile(path string) (map[string]*entry, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, err
+		}
+		return nil, errors.Wrap(err, "position read file failed")
+	}
+	entries := make(map[string]*entry)
+	if len(buf) == 0 {
+		return entries, nil
+	}
+	var file positionFile
+	if err := json.Unmarshal(buf, &file); err != nil {
+		return nil, errors.Wrap(err, "position unmarshal failed")
+	}
+	switch {
+	case file.Version == 0:
+		// version 1, written by older releases without checksum
+		return readOffsets(buf)
+	case file.Version > positionFileVersion:
+		return nil, errors.Errorf("position file version %v is not supported", file.Version)
+	case crc32.ChecksumIEEE(file.Offsets) != file.Checksum:
+		return nil, errors.New("position checksum mismatch")
+	case file.Version == 2:
+		return readOffsets(file.Offsets)
+	}
+	if err := json.Unmarshal(file.Offsets, &entries); err != nil {
+		return nil, errors.Wrap(err, "position unmarshal failed")
+	}
+	return entries, nil
+}
+
+// Reads positions without fingerprint, as written by version 1 and 2.
+func readOffsets(buf []byte) (map[string]*entry, error) {
+	offsets := make(map[string]int64)
+	if err := json.Unmarshal(buf, &offsets); err != nil {
+		return nil, errors.Wrap(err, "position unmarshal failed")
+	}
+	entries := make(map[string]*entry, len(offsets))
+	for devIno, offset := range offsets {
+		entries[devIno] = &entry{Offset: offset}
+	}
+	return entries, nil
+}
+
 func (p *position) run() {
 	tick := time.NewTimer(p.interval)
 	defer tick.Stop()
@@ -83,47 +179,226 @@ func (p *position) Stop() {
 }
 
 func (p *position) sync() {
-	f, err := os.OpenFile(p.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, positionFileMode)
+	p.updateFingerprints()
+	p.mutex.Lock()
+	p.collectGarbage()
+	offsets, err := json.Marshal(p.entries)
+	p.mutex.Unlock()
 	if err != nil {
-		p.logger.Error("open position file " + p.path)
+		p.logger.WithError(err).Error("marshal position failed")
 		return
 	}
-	defer f.Close()
 
-	p.mutex.RLock()
-
-	buf, err := json.Marshal(p.offsets)
+	buf, err := json.Marshal(positionFile{
+		Version:  positionFileVersion,
+		Checksum: crc32.ChecksumIEEE(offsets),
+		Offsets:  offsets,
+	})
 	if err != nil {
-		p.logger.Error("marshal position failed")
+		p.logger.WithError(err).Error("marshal position failed")
+		return
+	}
+	if err := writeFileAtomic(p.path, buf, p.fileValid); err != nil {
+		p.logger.WithError(err).Error("write position failed")
 		return
 	}
+	p.fileValid = true
+}
 
+// Files that exist are opened by the file tailer when it starts, so offsets that were not used
+// since startup belong to files that were deleted while grok_exporter was not running.
+func (p *position) collectGarbage() {
+	if time.Since(p.startedAt) < garbageCollectionDelay {
+		return
+	}
+	for devIno := range p.entries {
+		if _, used := p.used[devIno]; !used {
+			p.logger.WithField("devIno", devIno).Debug("remove position of file that no longer exists")
+			delete(p.entries, devIno)
+		}
+	}
+}
+
+// The fingerprint of a file that was smaller than fingerprintSize when it was opened is extended as the file grows.
+// Otherwise, all small files with the same first lines would have the same fingerprint.
+func (p *position) updateFingerprints() {
+	p.mutex.RLock()
+	paths := make(map[string]string)
+	for devIno, e := range p.entries {
+		if len(e.Path) > 0 && e.FingerprintSize < fingerprintSize {
+			paths[devIno] = e.Path
+		}
+	}
 	p.mutex.RUnlock()
+	for devIno, path := range paths {
+		head, size, currentDevIno, err := readHead(path)
+		if err != nil || currentDevIno != devIno {
+			continue // the file was deleted or replaced, but the tailer did not stop yet
+		}
+		p.mutex.Lock()
+		if e, exists := p.entries[devIno]; exists && len(head) > e.FingerprintSize {
+			e.Fingerprint, e.FingerprintSize, e.Size = fingerprint(head), len(head), size
+		}
+		p.mutex.Unlock()
+	}
+}
+
+// Reads up to fingerprintSize bytes at the beginning of the file.
+func readHead(path string) (head []byte, size int64, devIno string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, 0, "", err
+	}
+	devIno, err = util.DevInodeNoFromFileInfo(fi)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	head = make([]byte, fingerprintSize)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, 0, "", err
+	}
+	return head[:n], fi.Size(), devIno, nil
+}
+
+func fingerprint(head []byte) string {
+	h := fnv.New64a()
+	h.Write(head)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Checks if the file still has the stored fingerprint. Entries without fingerprint match all files.
+func (e *entry) matches(head []byte) bool {
+	if len(e.Fingerprint) == 0 {
+		return true
+	}
+	return len(head) >= e.FingerprintSize && fingerprint(head[:e.FingerprintSize]) == e.Fingerprint
+}
 
+// Writes a temporary file, and replaces the position file with rename(), so that the position file
+// is never truncated or partially written. The previous position file is kept as backup unless it is corrupt.
+func writeFileAtomic(path string, buf []byte, keepBackup bool) error {
+	tempPath := path + tempSuffix
+	f, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, positionFileMode)
+	if err != nil {
+		return err
+	}
 	if _, err := f.Write(buf); err != nil {
-		p.logger.Error("write position failed")
-		return
+		f.Close()
+		return err
 	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if keepBackup {
+		if err := os.Rename(path, path+backupSuffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
 }
 
-func (p *position) GetOffset(devIno string) int64 {
-	p.mutex.RLock()
-	defer p.mutex.RUnlock()
-	offset, ok := p.offsets[devIno]
-	if !ok {
-		return 0
+// Makes the renames durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
 	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (p *position) ResumeOffset(devIno, path string) int64 {
+	head, size, _, err := readHead(path)
+	if err != nil {
+		// The tailer will report the error when it opens the file.
+		head, size = nil, 0
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	offset := p.resumeOffset(devIno, path, head, size)
+	p.entries[devIno] = &entry{
+		Offset:          offset,
+		Path:            path,
+		Size:            size,
+		Fingerprint:     fingerprint(head),
+		FingerprintSize: len(head),
+	}
+	p.used[devIno] = struct{}{}
 	return offset
 }
 
+func (p *position) resumeOffset(devIno, path string, head []byte, size int64) int64 {
+	logger := p.logger.WithField("path", path).WithField("devIno", devIno)
+	if e, exists := p.entries[devIno]; exists {
+		switch {
+		case !e.matches(head):
+			logger.Info("file has a different fingerprint, the inode was reused or the file was rewritten, reading from the beginning")
+		case size < e.Offset || size < e.Size:
+			logger.Info("file was truncated, reading from the beginning")
+		default:
+			return e.Offset
+		}
+		return 0
+	}
+	// The dev,ino changes when the file is copied to another volume, so look for a file with the same path and fingerprint.
+	// Only complete fingerprints are used, because the first lines of small files are not unique enough.
+	for otherDevIno, e := range p.entries {
+		if e.Path == path && e.FingerprintSize == fingerprintSize && e.matches(head) && size >= e.Offset {
+			logger.WithField("previousDevIno", otherDevIno).Info("file has a new dev,ino, but the same fingerprint as before, resuming")
+			return e.Offset
+		}
+	}
+	return 0
+}
+
 func (p *position) SetOffset(devIno string, offset int64) {
 	p.mutex.Lock()
-	p.offsets[devIno] = offset
+	if e, exists := p.entries[devIno]; exists {
+		e.Offset = offset
+	} else {
+		p.entries[devIno] = &entry{Offset: offset}
+	}
+	p.used[devIno] = struct{}{}
+	p.mutex.Unlock()
+}
+
+func (p *position) Cursor(name string) string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.used[name] = struct{}{}
+	if e, exists := p.entries[name]; exists {
+		return e.Cursor
+	}
+	return ""
+}
+
+func (p *position) SetCursor(name, cursor string) {
+	p.mutex.Lock()
+	if e, exists := p.entries[name]; exists {
+		e.Cursor = cursor
+	} else {
+		p.entries[name] = &entry{Cursor: cursor}
+	}
+	p.used[name] = struct{}{}
 	p.mutex.Unlock()
 }
 
 func (p *position) DelOffset(devIno string) {
 	p.mutex.Lock()
-	delete(p.offsets, devIno)
+	delete(p.entries, devIno)
+	delete(p.used, devIno)
 	p.mutex.Unlock()
 }
@@ -0,0 +1,207 @@
+package position
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/sequix/grok_exporter/util"
+)
+
+func newTestPosition(t *testing.T, path string) Interface {
+	p, err := New(logrus.New(), path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestPositionFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grok_exporter_position")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "position.json")
+
+	p := newTestPosition(t, path)
+	p.SetOffset("fe00-1", 10)
+	p.Stop()
+	p = newTestPosition(t, path)
+	p.SetOffset("fe00-1", 20)
+	p.Stop()
+
+	p = newTestPosition(t, path)
+	if offset := offsetOf(p, "fe00-1"); offset != 20 {
+		t.Fatalf("expected offset 20, but got %v", offset)
+	}
+	p.Stop()
+
+	// corrupt position file -> fall back to the backup written by the previous sync
+	if err := ioutil.WriteFile(path, []byte(`{"version":2,"checksum":1,"offsets":{"fe00-1":30}}`), positionFileMode); err != nil {
+		t.Fatal(err)
+	}
+	p = newTestPosition(t, path)
+	if offset := offsetOf(p, "fe00-1"); offset != 20 {
+		t.Fatalf("expected offset 20 from backup, but got %v", offset)
+	}
+	p.Stop()
+
+	// missing position file, like after a crash between the renames
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	p = newTestPosition(t, path)
+	if offset := offsetOf(p, "fe00-1"); offset != 20 {
+		t.Fatalf("expected offset 20 from backup, but got %v", offset)
+	}
+	p.Stop()
+
+	// both corrupt
+	for _, file := range []string{path, path + backupSuffix} {
+		if err := ioutil.WriteFile(file, []byte(`{"fe00-1":`), positionFileMode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := New(logrus.New(), path, time.Hour); err == nil {
+		t.Fatal("expected error for corrupt position file and backup")
+	}
+}
+
+func TestCursor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grok_exporter_position")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "position.json")
+
+	p := newTestPosition(t, path)
+	if cursor := p.Cursor("journald"); cursor != "" {
+		t.Fatalf("expected no cursor, but got %q", cursor)
+	}
+	p.SetCursor("journald", "s=739ad463;i=4ece7")
+	p.SetOffset("fe00-1", 10)
+	p.Stop()
+
+	p = newTestPosition(t, path)
+	defer p.Stop()
+	if cursor := p.Cursor("journald"); cursor != "s=739ad463;i=4ece7" {
+		t.Fatalf("expected cursor s=739ad463;i=4ece7, but got %q", cursor)
+	}
+	if offset := offsetOf(p, "fe00-1"); offset != 10 {
+		t.Fatalf("expected offset 10, but got %v", offset)
+	}
+}
+
+func TestPositionFileVersion1(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grok_exporter_position")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "position.json")
+	if err := ioutil.WriteFile(path, []byte(`{"fe00-1":10,"fe00-2":20}`), positionFileMode); err != nil {
+		t.Fatal(err)
+	}
+	p := newTestPosition(t, path)
+	defer p.Stop()
+	if offset := offsetOf(p, "fe00-2"); offset != 20 {
+		t.Fatalf("expected offset 20, but got %v", offset)
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	p := &position{
+		logger:    logrus.New(),
+		mutex:     &sync.RWMutex{},
+		entries:   map[string]*entry{"fe00-1": {Offset: 10}, "fe00-2": {Offset: 20}},
+		used:      make(map[string]struct{}),
+		startedAt: time.Now(),
+	}
+	p.SetOffset("fe00-1", 11)
+	p.collectGarbage()
+	if len(p.entries) != 2 {
+		t.Fatalf("expected no garbage collection right after startup, but got %v", p.entries)
+	}
+	p.startedAt = time.Now().Add(-garbageCollectionDelay)
+	p.collectGarbage()
+	if _, exists := p.entries["fe00-2"]; exists || len(p.entries) != 1 {
+		t.Fatalf("expected offset of unused file fe00-2 to be removed, but got %v", p.entries)
+	}
+}
+
+func offsetOf(p Interface, devIno string) int64 {
+	pos := p.(*position)
+	pos.mutex.RLock()
+	defer pos.mutex.RUnlock()
+	if e, exists := pos.entries[devIno]; exists {
+		return e.Offset
+	}
+	return -1
+}
+
+func TestResumeOffset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grok_exporter_position")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	positionPath := filepath.Join(dir, "position.json")
+	logPath := filepath.Join(dir, "test.log")
+
+	content := strings.Repeat("line\n", 1000)
+	if err := ioutil.WriteFile(logPath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	devIno, err := util.DevInodeNoFromFilePath(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newTestPosition(t, positionPath)
+	if offset := p.ResumeOffset(devIno, logPath); offset != 0 {
+		t.Fatalf("expected offset 0 for new file, but got %v", offset)
+	}
+	p.SetOffset(devIno, 2000)
+	p.Stop()
+
+	p = newTestPosition(t, positionPath)
+	if offset := p.ResumeOffset(devIno, logPath); offset != 2000 {
+		t.Fatalf("expected offset 2000, but got %v", offset)
+	}
+	p.Stop()
+
+	// file copied to another volume -> different dev,ino, same path and fingerprint
+	p = newTestPosition(t, positionPath)
+	if offset := p.ResumeOffset("ffff-1", logPath); offset != 2000 {
+		t.Fatalf("expected offset 2000 for file with new dev,ino, but got %v", offset)
+	}
+	p.Stop()
+
+	// truncated
+	if err := ioutil.WriteFile(logPath, []byte(content[:1000]), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p = newTestPosition(t, positionPath)
+	if offset := p.ResumeOffset(devIno, logPath); offset != 0 {
+		t.Fatalf("expected offset 0 for truncated file, but got %v", offset)
+	}
+	p.SetOffset(devIno, 1000)
+	p.Stop()
+
+	// inode reused by a file with different content
+	if err := ioutil.WriteFile(logPath, []byte(strings.Repeat("other line\n", 1000)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p = newTestPosition(t, positionPath)
+	if offset := p.ResumeOffset(devIno, logPath); offset != 0 {
+		t.Fatalf("expected offset 0 for file with different fingerprint, but got %v", offset)
+	}
+	p.Stop()
+}
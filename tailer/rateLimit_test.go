@@ -0,0 +1,135 @@
+// Copyright 2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/sequix/grok_exporter/tailer/fswatcher"
+	"github.com/sequix/grok_exporter/tailer/position"
+)
+
+func TestRateLimitDoesNotDropLines(t *testing.T) {
+	for _, polling := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "grok_exporter_ratelimit")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		logfile := filepath.Join(dir, "app.log")
+		appendLines(t, logfile, 1, 30)
+		input := fmt.Sprintf("ratelimit_polling_%v", polling)
+
+		// 20 lines per second with a burst of 20 lines, so the last 10 lines take 500ms.
+		start := time.Now()
+		tailer := runTestFileTailer(t, logfile, position.NewMemPos(), fswatcher.NewRateLimit(20, input), polling)
+		expectLines(t, tailer, polling, 1, 30)
+		if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+			t.Fatalf("polling=%v: expected reading to be throttled, but read 30 lines in %v", polling, elapsed)
+		}
+		if throttled, ok := throttledSeconds(t, input, logfile); !ok || throttled <= 0 {
+			t.Fatalf("polling=%v: expected throttled seconds > 0 for %v, got %v", polling, logfile, throttled)
+		}
+		tailer.Close()
+		if throttled, ok := throttledSeconds(t, input, logfile); ok {
+			t.Fatalf("polling=%v: expected throttled seconds to be removed on close, got %v", polling, throttled)
+		}
+	}
+}
+
+// The offset of each line is stored after it was passed on,
+// so after a restart reading continues with the first line that was not passed on.
+func TestRateLimitResumesFromOffset(t *testing.T) {
+	for _, polling := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "grok_exporter_ratelimit")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		logfile := filepath.Join(dir, "app.log")
+		appendLines(t, logfile, 1, 30)
+		pos := position.NewMemPos()
+
+		tailer := runTestFileTailer(t, logfile, pos, fswatcher.NewRateLimit(20, fmt.Sprintf("ratelimit_resume_polling_%v", polling)), polling)
+		expectLines(t, tailer, polling, 1, 25)
+		tailer.Close()
+
+		tailer = runTestFileTailer(t, logfile, pos, nil, polling)
+		expectLines(t, tailer, polling, 26, 30)
+		select {
+		case line := <-tailer.Lines():
+			t.Fatalf("polling=%v: unexpected line %q", polling, line.Line)
+		case <-time.After(300 * time.Millisecond):
+		}
+		tailer.Close()
+	}
+}
+
+func appendLines(t *testing.T, path string, from, to int) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for i := from; i <= to; i++ {
+		if _, err := fmt.Fprintf(f, "line %v\n", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func expectLines(t *testing.T, tailer fswatcher.Interface, polling bool, from, to int) {
+	for i := from; i <= to; i++ {
+		select {
+		case line := <-tailer.Lines():
+			if expected := fmt.Sprintf("line %v", i); line.Line != expected {
+				t.Fatalf("polling=%v: expected %q, got %q", polling, expected, line.Line)
+			}
+		case err := <-tailer.Errors():
+			t.Fatalf("polling=%v: unexpected error: %v", polling, err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("polling=%v: timeout waiting for line %v", polling, i)
+		}
+	}
+}
+
+func throttledSeconds(t *testing.T, input, path string) (float64, bool) {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != "grok_exporter_file_throttled_seconds_total" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			labels := make(map[string]string)
+			for _, label := range m.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if labels["input"] == input && labels["path"] == path {
+				return m.GetCounter().GetValue(), true
+			}
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,68 @@
+package tailer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sequix/grok_exporter/tailer/fswatcher"
+	"github.com/sequix/grok_exporter/tailer/position"
+)
+
+// Kubernetes node layout, new pod directories are created while the tailer is running.
+func TestWildcardDirectories(t *testing.T) {
+	for _, pattern := range []string{"pods/*/*/*.log", "pods/**/*.log"} {
+		for _, polling := range []bool{false, true} {
+			dir, err := ioutil.TempDir("", "grok_exporter_wildcard_dirs")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			writeTestLogFile(t, filepath.Join(dir, "pods", "ns_a_1", "app"), "0.log", "line a\n")
+			tailer := runTestFileTailer(t, filepath.Join(dir, pattern), position.NewMemPos(), nil, polling)
+			expectTestLines(t, tailer, map[string]string{"line a": filepath.Join(dir, "pods", "ns_a_1", "app", "0.log")})
+
+			writeTestLogFile(t, filepath.Join(dir, "pods", "ns_b_2", "app"), "0.log", "line b\n")
+			expectTestLines(t, tailer, map[string]string{"line b": filepath.Join(dir, "pods", "ns_b_2", "app", "0.log")})
+
+			// not matching the directory depth of the glob without '**'
+			writeTestLogFile(t, filepath.Join(dir, "pods", "ns_c_3"), "0.log", "line c\n")
+			writeTestLogFile(t, filepath.Join(dir, "pods", "ns_a_1", "app"), "ignored.txt", "ignored\n")
+			writeTestLogFile(t, filepath.Join(dir, "pods", "ns_a_1", "app"), "1.log", "line d\n")
+			expected := map[string]string{"line d": filepath.Join(dir, "pods", "ns_a_1", "app", "1.log")}
+			if pattern == "pods/**/*.log" {
+				expected["line c"] = filepath.Join(dir, "pods", "ns_c_3", "0.log")
+			}
+			expectTestLines(t, tailer, expected)
+			tailer.Close()
+		}
+	}
+}
+
+func writeTestLogFile(t *testing.T, dir, name, content string) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Lines from different files may be read in any order.
+func expectTestLines(t *testing.T, tailer fswatcher.Interface, expected map[string]string) {
+	for len(expected) > 0 {
+		select {
+		case l := <-tailer.Lines():
+			if file, ok := expected[l.Line]; !ok || file != l.File {
+				t.Fatalf("unexpected line %q from %v, expected %v", l.Line, l.File, expected)
+			}
+			delete(expected, l.Line)
+		case err := <-tailer.Errors():
+			t.Fatalf("unexpected error: %v", err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for %v", expected)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+// Copyright 2016-2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sequix/grok_exporter/tailer/fswatcher"
+)
+
+const (
+	defaultSpillSegmentSize = 16 * 1024 * 1024
+	spillSegmentSuffix      = ".seg"
+)
+
+// A line in a segment file, encoded as JSON and terminated by a newline.
+type spillRecord struct {
+	Line   string            `json:"line"`
+	File   string            `json:"file,omitempty"`
+	Fields map[string]string `json:"fields,omitempty"`
+	Input  string            `json:"input,omitempty"`
+}
+
+type spillSegment struct {
+	path string
+	size int64
+}
+
+// FIFO queue of lines in segment files on local disk. Lines are appended to the newest segment,
+// a new segment is started when it reaches segmentSize, and segments are removed when all of their lines were read.
+// Segments left over by a previous run are read first, so lines spilled before a restart are not lost.
+// Not thread safe, the boundedLineBuffer holds its spillLock while calling the spillQueue.
+type spillQueue struct {
+	dir         string
+	segmentSize int64
+	segments    []*spillSegment // oldest first, lines are appended to the last one
+	writeFile   *os.File
+	writer      *bufio.Writer
+	readFile    *os.File
+	reader      *bufio.Reader // reads segments[0]
+	readOffset  int64         // bytes read from segments[0]
+	lines       int
+	size        int64 // bytes in all segment files
+	nextId      uint64
+}
+
+func openSpillQueue(dir string, segmentSize int64) (*spillQueue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create buffer spill directory: %v", err)
+	}
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read buffer spill directory: %v", err)
+	}
+	q := &spillQueue{
+		dir:         dir,
+		segmentSize: segmentSize,
+	}
+	var ids []uint64
+	for _, fi := range fis {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), spillSegmentSuffix) {
+			continue
+		}
+		if id, err := strconv.ParseUint(strings.TrimSuffix(fi.Name(), spillSegmentSuffix), 10, 64); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		segment := &spillSegment{path: q.segmentPath(id)}
+		lines, err := recoverSpillSegment(segment)
+		if err != nil {
+			return nil, err
+		}
+		if lines == 0 {
+			os.Remove(segment.path)
+			continue
+		}
+		q.segments = append(q.segments, segment)
+		q.lines += lines
+		q.size += segment.size
+		q.nextId = id + 1
+	}
+	return q, nil
+}
+
+// Counts the lines in a segment, and truncates an incomplete line at the end,
+// which is left over if grok_exporter terminated while writing.
+func recoverSpillSegment(segment *spillSegment) (int, error) {
+	f, err := os.OpenFile(segment.path, os.O_RDWR, 0)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open buffer spill segment: %v", err)
+	}
+	defer f.Close()
+	var (
+		lines  int
+		size   int64
+		reader = bufio.NewReader(f)
+	)
+	for {
+		record, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, fmt.Errorf("failed to read buffer spill segment %v: %v", segment.path, err)
+		}
+		lines++
+		size += int64(len(record))
+	}
+	if err = f.Truncate(size); err != nil {
+		return 0, fmt.Errorf("failed to truncate buffer spill segment %v: %v", segment.path, err)
+	}
+	segment.size = size
+	return lines, nil
+}
+
+func (q *spillQueue) segmentPath(id uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%v", id, spillSegmentSuffix))
+}
+
+func (q *spillQueue) Len() int {
+	return q.lines
+}
+
+// Size of all segment files in bytes, including lines that were already read from the oldest segment.
+func (q *spillQueue) Size() int64 {
+	return q.size
+}
+
+// Returns the record for line, so that the caller can check the size before calling Push().
+func encodeSpillRecord(line *fswatcher.Line) ([]byte, error) {
+	record, err := json.Marshal(spillRecord{Line: line.Line, File: line.File, Fields: line.Fields, Input: line.Input})
+	if err != nil {
+		return nil, err
+	}
+	return append(record, '\n'), nil
+}
+
+func (q *spillQueue) Push(record []byte) error {
+	if q.writer == nil || q.segments[len(q.segments)-1].size >= q.segmentSize {
+		if err := q.startSegment(); err != nil {
+			return err
+		}
+	}
+	segment := q.segments[len(q.segments)-1]
+	n, err := q.writer.Write(record)
+	segment.size += int64(n)
+	q.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write buffer spill segment %v: %v", segment.path, err)
+	}
+	q.lines++
+	return nil
+}
+
+func (q *spillQueue) startSegment() error {
+	if err := q.closeWriter(); err != nil {
+		return err
+	}
+	segment := &spillSegment{path: q.segmentPath(q.nextId)}
+	f, err := os.OpenFile(segment.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create buffer spill segment: %v", err)
+	}
+	q.nextId++
+	q.segments = append(q.segments, segment)
+	q.writeFile = f
+	q.writer = bufio.NewWriter(f)
+	return nil
+}
+
+// A line that could not be decoded. It is removed from the queue, so the next line can be read.
+type invalidSpillRecordError struct {
+	err error
+}
+
+func (e invalidSpillRecordError) Error() string {
+	return fmt.Sprintf("invalid line in buffer spill segment: %v", e.err)
+}
+
+// Must only be called if Len() > 0. If the error is not an invalidSpillRecordError, the queue cannot be read any further.
+func (q *spillQueue) Pop() (*fswatcher.Line, error) {
+	for {
+		if q.reader == nil {
+			f, err := os.Open(q.segments[0].path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to open buffer spill segment: %v", err)
+			}
+			q.readFile = f
+			q.reader = bufio.NewReader(f)
+		}
+		if len(q.segments) == 1 && q.writer != nil {
+			if err := q.writer.Flush(); err != nil {
+				return nil, fmt.Errorf("failed to write buffer spill segment %v: %v", q.segments[0].path, err)
+			}
+		}
+		record, err := q.reader.ReadBytes('\n')
+		if err == io.EOF && len(record) == 0 && len(q.segments) > 1 {
+			// All lines of the oldest segment were read, continue with the next one.
+			q.readFile.Close()
+			q.readFile, q.reader, q.readOffset = nil, nil, 0
+			os.Remove(q.segments[0].path)
+			q.size -= q.segments[0].size
+			q.segments = q.segments[1:]
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read buffer spill segment %v: %v", q.segments[0].path, err)
+		}
+		q.readOffset += int64(len(record))
+		q.lines--
+		if q.lines == 0 {
+			// Start over with an empty directory, so that the last segment does not grow forever.
+			if err := q.Clear(); err != nil {
+				return nil, err
+			}
+		}
+		var r spillRecord
+		if err := json.Unmarshal(bytes.TrimSuffix(record, []byte{'\n'}), &r); err != nil {
+			return nil, invalidSpillRecordError{err}
+		}
+		return &fswatcher.Line{Line: r.Line, File: r.File, Fields: r.Fields, Input: r.Input}, nil
+	}
+}
+
+// Closes the files, the segments are kept and read again by the next openSpillQueue().
+// The lines that were already read are removed from the oldest segment. If grok_exporter terminates
+// without Close(), these lines are read again after the restart.
+func (q *spillQueue) Close() error {
+	err := q.closeWriter()
+	if q.readFile != nil {
+		q.readFile.Close()
+		q.readFile, q.reader = nil, nil
+		if compactErr := q.removeReadLines(); err == nil {
+			err = compactErr
+		}
+	}
+	return err
+}
+
+// Inserts records before all other lines, so that they are read first.
+func (q *spillQueue) Prepend(records [][]byte) error {
+	if len(records) == 0 {
+		return nil
+	}
+	if len(q.segments) == 0 {
+		for _, record := range records {
+			if err := q.Push(record); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := q.closeWriter(); err != nil {
+		return err
+	}
+	if q.readFile != nil {
+		q.readFile.Close()
+		q.readFile, q.reader = nil, nil
+	}
+	if err := q.rewriteOldestSegment(bytes.Join(records, nil)); err != nil {
+		return err
+	}
+	q.lines += len(records)
+	return nil
+}
+
+// Replaces the oldest segment with a copy without the lines that were already read.
+func (q *spillQueue) removeReadLines() error {
+	if q.readOffset == 0 {
+		return nil
+	}
+	return q.rewriteOldestSegment(nil)
+}
+
+// Replaces the oldest segment with prefix followed by the lines that were not read yet.
+// The segment must not be open for reading or writing.
+func (q *spillQueue) rewriteOldestSegment(prefix []byte) error {
+	segment := q.segments[0]
+	b, err := ioutil.ReadFile(segment.path)
+	if err != nil {
+		return fmt.Errorf("failed to read buffer spill segment: %v", err)
+	}
+	tmp := segment.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, append(prefix, b[q.readOffset:]...), 0644); err != nil {
+		return fmt.Errorf("failed to write buffer spill segment: %v", err)
+	}
+	if err = os.Rename(tmp, segment.path); err != nil {
+		return fmt.Errorf("failed to write buffer spill segment: %v", err)
+	}
+	delta := int64(len(prefix)) - q.readOffset
+	q.size += delta
+	segment.size += delta
+	q.readOffset = 0
+	return nil
+}
+
+func (q *spillQueue) closeWriter() error {
+	if q.writer == nil {
+		return nil
+	}
+	err := q.writer.Flush()
+	if closeErr := q.writeFile.Close(); err == nil {
+		err = closeErr
+	}
+	q.writeFile, q.writer = nil, nil
+	if err != nil {
+		return fmt.Errorf("failed to write buffer spill segment: %v", err)
+	}
+	return nil
+}
+
+// Removes all segments.
+func (q *spillQueue) Clear() error {
+	q.readOffset = 0 // the segments are removed anyway
+	err := q.Close()
+	for _, segment := range q.segments {
+		if removeErr := os.Remove(segment.path); removeErr != nil && !os.IsNotExist(removeErr) && err == nil {
+			err = fmt.Errorf("failed to remove buffer spill segment: %v", removeErr)
+		}
+	}
+	q.segments = nil
+	q.lines = 0
+	q.size = 0
+	return err
+}
@@ -0,0 +1,104 @@
+// Copyright 2016-2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/sequix/grok_exporter/tailer/fswatcher"
+)
+
+func TestSpillQueueRecovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grok_exporter_spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := openSpillQueue(dir, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 10; i++ {
+		pushSpill(t, q, fmt.Sprintf("line %v", i))
+	}
+	popSpill(t, q, "line 1")
+	if err = q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a line that was not completely written when grok_exporter terminated.
+	segments, err := filepath.Glob(filepath.Join(dir, "*"+spillSegmentSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) < 2 {
+		t.Fatalf("expected more than one segment, got %v", segments)
+	}
+	sort.Strings(segments)
+	f, err := os.OpenFile(segments[len(segments)-1], os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteString(`{"line":"line 1`); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	q, err = openSpillQueue(dir, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Len() != 9 {
+		t.Fatalf("expected 9 lines after restart, got %v", q.Len())
+	}
+	pushSpill(t, q, "line 11")
+	for i := 2; i <= 11; i++ {
+		popSpill(t, q, fmt.Sprintf("line %v", i))
+	}
+	if q.Len() != 0 || q.Size() != 0 {
+		t.Fatalf("expected an empty queue, got %v lines and %v bytes", q.Len(), q.Size())
+	}
+	if err = q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if fis, _ := ioutil.ReadDir(dir); len(fis) != 0 {
+		t.Fatalf("expected no segments, got %v files", len(fis))
+	}
+}
+
+func pushSpill(t *testing.T, q *spillQueue, line string) {
+	record, err := encodeSpillRecord(&fswatcher.Line{Line: line})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Push(record); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func popSpill(t *testing.T, q *spillQueue, expected string) {
+	line, err := q.Pop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line.Line != expected {
+		t.Fatalf("expected %q, got %q", expected, line.Line)
+	}
+}
@@ -0,0 +1,462 @@
+// Copyright 2016-2018 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sequix/grok_exporter/config/v2"
+	"github.com/sequix/grok_exporter/tailer/fswatcher"
+	"github.com/sirupsen/logrus"
+)
+
+// Larger messages are rejected. RFC 5425 requires at least 2048 bytes, and recommends 8192 bytes.
+const maxSyslogMessageSize = 64 * 1024
+
+// Names of the fields in fswatcher.Line.Fields for lines received via syslog.
+var SyslogFields = []string{"hostname", "appname", "facility", "severity"}
+
+var syslogFacilities = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+var syslogSeverities = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+type syslogMessage struct {
+	facility int
+	severity int
+	hostname string
+	appname  string
+	msg      string
+}
+
+// implements fswatcher.Interface
+type syslogTailer struct {
+	lines       chan *fswatcher.Line
+	errors      chan fswatcher.Error
+	udpConn     net.PacketConn // nil if UDP is not configured
+	tcpListener net.Listener   // nil if TCP is not configured
+	tcpConns    map[net.Conn]struct{}
+	mutex       sync.Mutex // protects tcpConns
+	wg          sync.WaitGroup
+	done        chan struct{}
+}
+
+func (t *syslogTailer) Lines() chan *fswatcher.Line {
+	return t.lines
+}
+
+func (t *syslogTailer) Errors() chan fswatcher.Error {
+	return t.errors
+}
+
+func (t *syslogTailer) Close() {
+	close(t.done)
+	if t.udpConn != nil {
+		t.udpConn.Close()
+	}
+	if t.tcpListener != nil {
+		t.tcpListener.Close()
+	}
+	t.mutex.Lock()
+	for conn := range t.tcpConns {
+		conn.Close()
+	}
+	t.mutex.Unlock()
+	t.wg.Wait()
+	close(t.lines)
+	close(t.errors)
+}
+
+// Listens for syslog messages in RFC 3164 or RFC 5424 format.
+// UDP datagrams contain a single message. TCP messages are either separated by newlines,
+// or prefixed with their length (octet counting, see RFC 6587).
+func RunSyslogTailer(cfg *v2.InputConfig, logger logrus.FieldLogger) (fswatcher.Interface, error) {
+	t := &syslogTailer{
+		lines:    make(chan *fswatcher.Line),
+		errors:   make(chan fswatcher.Error),
+		tcpConns: make(map[net.Conn]struct{}),
+		done:     make(chan struct{}),
+	}
+	var err error
+	if len(cfg.SyslogUdpAddress) > 0 {
+		t.udpConn, err = net.ListenPacket("udp", cfg.SyslogUdpAddress)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen for syslog messages on udp %v: %v", cfg.SyslogUdpAddress, err)
+		}
+	}
+	if len(cfg.SyslogTcpAddress) > 0 {
+		t.tcpListener, err = net.Listen("tcp", cfg.SyslogTcpAddress)
+		if err != nil {
+			if t.udpConn != nil {
+				t.udpConn.Close()
+			}
+			return nil, fmt.Errorf("failed to listen for syslog messages on tcp %v: %v", cfg.SyslogTcpAddress, err)
+		}
+	}
+	if t.udpConn != nil {
+		logger.Infof("Start listening for syslog messages on udp %v", t.udpConn.LocalAddr())
+		t.wg.Add(1)
+		go t.runUdp()
+	}
+	if t.tcpListener != nil {
+		logger.Infof("Start listening for syslog messages on tcp %v", t.tcpListener.Addr())
+		t.wg.Add(1)
+		go t.runTcp()
+	}
+	return t, nil
+}
+
+func (t *syslogTailer) runUdp() {
+	defer t.wg.Done()
+	buf := make([]byte, maxSyslogMessageSize)
+	for {
+		n, addr, err := t.udpConn.ReadFrom(buf)
+		if err != nil {
+			if t.isClosed() {
+				return
+			}
+			t.sendError(err, "reading syslog message", addr)
+			continue
+		}
+		t.process(strings.TrimRight(string(buf[:n]), "\r\n\x00"), addr)
+	}
+}
+
+func (t *syslogTailer) runTcp() {
+	defer t.wg.Done()
+	for {
+		conn, err := t.tcpListener.Accept()
+		if err != nil {
+			if t.isClosed() {
+				return
+			}
+			t.sendError(err, "accepting syslog connection", nil)
+			time.Sleep(100 * time.Millisecond) // don't spin if we ran out of file descriptors
+			continue
+		}
+		t.mutex.Lock()
+		if t.isClosed() {
+			t.mutex.Unlock()
+			conn.Close()
+			return
+		}
+		t.tcpConns[conn] = struct{}{}
+		t.wg.Add(1)
+		t.mutex.Unlock()
+		go t.handleTcpConn(conn)
+	}
+}
+
+func (t *syslogTailer) handleTcpConn(conn net.Conn) {
+	defer t.wg.Done()
+	defer func() {
+		t.mutex.Lock()
+		delete(t.tcpConns, conn)
+		t.mutex.Unlock()
+		conn.Close()
+	}()
+	reader := bufio.NewReader(conn)
+	for {
+		msg, err := readSyslogFrame(reader)
+		if err != nil {
+			if err != io.EOF && !t.isClosed() {
+				t.sendError(err, "reading syslog message", conn.RemoteAddr())
+			}
+			return
+		}
+		if len(msg) > 0 {
+			t.process(msg, conn.RemoteAddr())
+		}
+	}
+}
+
+// Reads the next message from a TCP stream, see RFC 6587.
+func readSyslogFrame(reader *bufio.Reader) (string, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return "", err
+	}
+	if first[0] >= '0' && first[0] <= '9' {
+		// octet counting: MSG-LEN SP SYSLOG-MSG
+		msgLen, err := readSyslogMessageLength(reader)
+		if err != nil {
+			return "", err
+		}
+		msg := make([]byte, msgLen)
+		_, err = io.ReadFull(reader, msg)
+		if err != nil {
+			return "", unexpectedEOF(err)
+		}
+		return strings.TrimRight(string(msg), "\r\n\x00"), nil
+	}
+	// non-transparent framing: messages are terminated by a newline
+	var sb strings.Builder
+	for {
+		chunk, isPrefix, err := reader.ReadLine()
+		if err != nil {
+			if err == io.EOF && sb.Len() > 0 {
+				break
+			}
+			return "", err
+		}
+		sb.Write(chunk)
+		if sb.Len() > maxSyslogMessageSize {
+			return "", fmt.Errorf("message exceeds the limit of %v bytes", maxSyslogMessageSize)
+		}
+		if !isPrefix {
+			break
+		}
+	}
+	return strings.TrimRight(sb.String(), "\x00"), nil
+}
+
+// Reads the MSG-LEN and the following space. The length is read digit by digit, so a client cannot make us
+// buffer an arbitrarily long prefix, and it is checked against maxSyslogMessageSize before the message is allocated.
+func readSyslogMessageLength(reader *bufio.Reader) (int, error) {
+	maxDigits := len(strconv.Itoa(maxSyslogMessageSize))
+	digits := make([]byte, 0, maxDigits)
+	for {
+		c, err := reader.ReadByte()
+		if err != nil {
+			return 0, unexpectedEOF(err)
+		}
+		if c == ' ' {
+			break
+		}
+		if c < '0' || c > '9' {
+			return 0, fmt.Errorf("invalid message length %q: unexpected character %q", digits, c)
+		}
+		if len(digits) == maxDigits {
+			return 0, fmt.Errorf("message length with more than %v digits exceeds the limit of %v bytes", maxDigits, maxSyslogMessageSize)
+		}
+		digits = append(digits, c)
+	}
+	msgLen, err := strconv.Atoi(string(digits))
+	if err != nil || msgLen <= 0 {
+		return 0, fmt.Errorf("invalid message length %q", digits)
+	}
+	if msgLen > maxSyslogMessageSize {
+		return 0, fmt.Errorf("message length %v exceeds the limit of %v bytes", msgLen, maxSyslogMessageSize)
+	}
+	return msgLen, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (t *syslogTailer) process(raw string, addr net.Addr) {
+	msg, err := parseSyslogMessage(raw)
+	if err != nil {
+		t.sendError(err, "parsing syslog message", addr)
+		return
+	}
+	if len(msg.hostname) == 0 && addr != nil {
+		msg.hostname = remoteHost(addr)
+	}
+	line := &fswatcher.Line{
+		Line: msg.msg,
+		Fields: map[string]string{
+			"hostname": msg.hostname,
+			"appname":  msg.appname,
+			"facility": syslogFacilities[msg.facility],
+			"severity": syslogSeverities[msg.severity],
+		},
+	}
+	select {
+	case t.lines <- line:
+	case <-t.done:
+	}
+}
+
+func remoteHost(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+func (t *syslogTailer) sendError(cause error, msg string, addr net.Addr) {
+	kvs := map[string]interface{}{}
+	if addr != nil {
+		kvs["remote"] = addr.String()
+	}
+	select {
+	case t.errors <- fswatcher.NewStructuredError(cause, msg, kvs):
+	case <-t.done:
+	}
+}
+
+func (t *syslogTailer) isClosed() bool {
+	select {
+	case <-t.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func parseSyslogMessage(raw string) (*syslogMessage, error) {
+	if !strings.HasPrefix(raw, "<") {
+		return nil, errors.New("missing priority")
+	}
+	end := strings.IndexByte(raw, '>')
+	if end < 2 || end > 4 {
+		return nil, errors.New("invalid priority")
+	}
+	pri, err := strconv.Atoi(raw[1:end])
+	if err != nil || pri < 0 || pri >= len(syslogFacilities)*8 {
+		return nil, fmt.Errorf("invalid priority %q", raw[1:end])
+	}
+	msg := &syslogMessage{
+		facility: pri / 8,
+		severity: pri % 8,
+	}
+	rest := raw[end+1:]
+	if strings.HasPrefix(rest, "1 ") {
+		err = parseRfc5424(msg, rest[2:])
+	} else {
+		parseRfc3164(msg, rest)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// TIMESTAMP SP HOSTNAME SP APP-NAME SP PROCID SP MSGID SP STRUCTURED-DATA [SP MSG]
+func parseRfc5424(msg *syslogMessage, rest string) error {
+	header := strings.SplitN(rest, " ", 6)
+	if len(header) < 6 {
+		return errors.New("incomplete RFC 5424 header")
+	}
+	msg.hostname = nilValue(header[1])
+	msg.appname = nilValue(header[2])
+	rest = header[5]
+	sdLen, err := structuredDataLength(rest)
+	if err != nil {
+		return err
+	}
+	rest = strings.TrimPrefix(rest[sdLen:], " ")
+	msg.msg = strings.TrimPrefix(rest, "\ufeff") // BOM
+	return nil
+}
+
+func nilValue(s string) string {
+	if s == "-" {
+		return ""
+	}
+	return s
+}
+
+// STRUCTURED-DATA is either "-" or a list of [SD-ID PARAM="VALUE" ...] elements.
+// Inside the values, '"', '\' and ']' are escaped with '\'.
+func structuredDataLength(s string) (int, error) {
+	if strings.HasPrefix(s, "-") {
+		return 1, nil
+	}
+	i := 0
+	for i < len(s) && s[i] == '[' {
+		inQuotes := false
+		for i++; i < len(s); i++ {
+			c := s[i]
+			if inQuotes && c == '\\' {
+				i++
+			} else if c == '"' {
+				inQuotes = !inQuotes
+			} else if c == ']' && !inQuotes {
+				break
+			}
+		}
+		if i >= len(s) {
+			return 0, errors.New("unterminated structured data")
+		}
+		i++
+	}
+	if i == 0 {
+		return 0, errors.New("invalid structured data")
+	}
+	return i, nil
+}
+
+// TIMESTAMP SP HOSTNAME SP TAG MSG, where TAG is usually APP-NAME[PID]:
+// Devices often deviate from RFC 3164, so if there is no valid timestamp, the whole rest is the message.
+func parseRfc3164(msg *syslogMessage, rest string) {
+	msg.msg = rest
+	timestampLen := rfc3164TimestampLength(rest)
+	if timestampLen == 0 {
+		return
+	}
+	rest = rest[timestampLen:]
+	sp := strings.IndexByte(rest, ' ')
+	if sp <= 0 {
+		msg.msg = rest
+		return
+	}
+	msg.hostname = rest[:sp]
+	rest = rest[sp+1:]
+	msg.msg = rest
+	tagEnd := strings.IndexAny(rest, "[: ")
+	if tagEnd <= 0 || tagEnd > 48 {
+		return
+	}
+	tag := rest[:tagEnd]
+	rest = rest[tagEnd:]
+	if strings.HasPrefix(rest, "[") {
+		pidEnd := strings.IndexByte(rest, ']')
+		if pidEnd < 0 {
+			return
+		}
+		rest = rest[pidEnd+1:]
+	}
+	if !strings.HasPrefix(rest, ":") {
+		return
+	}
+	msg.appname = tag
+	msg.msg = strings.TrimPrefix(rest[1:], " ")
+}
+
+// Length of the timestamp including the trailing space, 0 if there is no timestamp.
+// Besides 'Jan _2 15:04:05', RFC 3339 timestamps are accepted as sent by rsyslog and others.
+func rfc3164TimestampLength(s string) int {
+	const stamp = "Jan _2 15:04:05"
+	if len(s) > len(stamp) && s[len(stamp)] == ' ' {
+		if _, err := time.Parse(time.Stamp, s[:len(stamp)]); err == nil {
+			return len(stamp) + 1
+		}
+	}
+	sp := strings.IndexByte(s, ' ')
+	if sp > 0 {
+		if _, err := time.Parse(time.RFC3339Nano, s[:sp]); err == nil {
+			return sp + 1
+		}
+	}
+	return 0
+}
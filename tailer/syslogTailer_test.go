@@ -0,0 +1,176 @@
+// Copyright 2016-2018 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"bufio"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sequix/grok_exporter/config/v2"
+	"github.com/sequix/grok_exporter/tailer/fswatcher"
+)
+
+func TestParseSyslogMessage(t *testing.T) {
+	for _, test := range []struct {
+		raw      string
+		expected syslogMessage
+	}{
+		{
+			raw:      "<34>Oct 11 22:14:15 mymachine su: 'su root' failed for lonvick on /dev/pts/8",
+			expected: syslogMessage{facility: 4, severity: 2, hostname: "mymachine", appname: "su", msg: "'su root' failed for lonvick on /dev/pts/8"},
+		},
+		{
+			raw:      "<13>Feb  5 17:32:18 10.0.0.99 sshd[1234]: Accepted publickey",
+			expected: syslogMessage{facility: 1, severity: 5, hostname: "10.0.0.99", appname: "sshd", msg: "Accepted publickey"},
+		},
+		{
+			raw:      "<13>2019-01-02T03:04:05.123+01:00 host kernel: oops",
+			expected: syslogMessage{facility: 1, severity: 5, hostname: "host", appname: "kernel", msg: "oops"},
+		},
+		{
+			raw:      "<13>Feb  5 17:32:18 host no tag here",
+			expected: syslogMessage{facility: 1, severity: 5, hostname: "host", msg: "no tag here"},
+		},
+		{
+			raw:      "<190>just a message",
+			expected: syslogMessage{facility: 23, severity: 6, msg: "just a message"},
+		},
+		{
+			raw:      "<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut=\"3\" eventSource=\"App\\]lication\"][x y=\"z\"] \ufeffAn application event",
+			expected: syslogMessage{facility: 20, severity: 5, hostname: "mymachine.example.com", appname: "evntslog", msg: "An application event"},
+		},
+		{
+			raw:      "<165>1 2003-10-11T22:14:15.003Z - - - - -",
+			expected: syslogMessage{facility: 20, severity: 5},
+		},
+	} {
+		msg, err := parseSyslogMessage(test.raw)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", test.raw, err)
+		}
+		if !reflect.DeepEqual(*msg, test.expected) {
+			t.Fatalf("%v: expected %#v, but got %#v", test.raw, test.expected, *msg)
+		}
+	}
+	for _, raw := range []string{
+		"no priority",
+		"<>empty priority",
+		"<192>priority too large",
+		"<13>1 2003-10-11T22:14:15.003Z host app - -",
+		"<13>1 2003-10-11T22:14:15.003Z host app - - [unterminated",
+		"<13>1 2003-10-11T22:14:15.003Z host app - - invalid",
+	} {
+		if _, err := parseSyslogMessage(raw); err == nil {
+			t.Fatalf("%v: expected error", raw)
+		}
+	}
+}
+
+func TestReadSyslogFrame(t *testing.T) {
+	reader := bufio.NewReader(strings.NewReader("<13>a\n\n<13>b\r\n9 <13>c\nd e5 <13>f"))
+	for _, expected := range []string{"<13>a", "", "<13>b", "<13>c\nd e", "<13>f"} {
+		msg, err := readSyslogFrame(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg != expected {
+			t.Fatalf("expected %q, but got %q", expected, msg)
+		}
+	}
+	if _, err := readSyslogFrame(reader); err == nil {
+		t.Fatal("expected EOF")
+	}
+	reader = bufio.NewReader(strings.NewReader("10 <13>short"))
+	if _, err := readSyslogFrame(reader); err == nil {
+		t.Fatal("expected error for truncated message")
+	}
+	for input, expected := range map[string]string{
+		"12a <13>x":                    "unexpected character 'a'",
+		"0 <13>x":                      "invalid message length",
+		"99999 <13>x":                  "exceeds the limit of 65536 bytes",
+		strings.Repeat("1", 1024*1024): "more than 5 digits",
+		"123456 <13>x":                 "more than 5 digits",
+	} {
+		_, err := readSyslogFrame(bufio.NewReader(strings.NewReader(input)))
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("%.20q: expected error %q, but got %v", input, expected, err)
+		}
+	}
+}
+
+func expectSyslogLine(t *testing.T, tail fswatcher.Interface, expected *fswatcher.Line) {
+	select {
+	case line := <-tail.Lines():
+		if !reflect.DeepEqual(line, expected) {
+			t.Fatalf("expected %#v, but got %#v", expected, line)
+		}
+	case err := <-tail.Errors():
+		t.Fatalf("unexpected error: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout while waiting for %q", expected.Line)
+	}
+}
+
+func TestSyslogTailer(t *testing.T) {
+	tail, err := RunSyslogTailer(&v2.InputConfig{
+		SyslogUdpAddress: "127.0.0.1:0",
+		SyslogTcpAddress: "127.0.0.1:0",
+	}, testLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tail.Close()
+	st := tail.(*syslogTailer)
+
+	udp, err := net.Dial("udp", st.udpConn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	udp.Write([]byte("<34>Oct 11 22:14:15 mymachine su: failed\n"))
+	expectSyslogLine(t, tail, &fswatcher.Line{
+		Line:   "failed",
+		Fields: map[string]string{"hostname": "mymachine", "appname": "su", "facility": "auth", "severity": "crit"},
+	})
+
+	tcp, err := net.Dial("tcp", st.tcpListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	tcp.Write([]byte("<14>no header\n31 <165>1 - - app - - - multi\nline"))
+	expectSyslogLine(t, tail, &fswatcher.Line{
+		Line:   "no header",
+		Fields: map[string]string{"hostname": "127.0.0.1", "appname": "", "facility": "user", "severity": "info"},
+	})
+	expectSyslogLine(t, tail, &fswatcher.Line{
+		Line:   "multi\nline",
+		Fields: map[string]string{"hostname": "127.0.0.1", "appname": "app", "facility": "local4", "severity": "notice"},
+	})
+
+	udp.Write([]byte("invalid"))
+	select {
+	case err := <-tail.Errors():
+		if !strings.Contains(err.Error(), "parsing syslog message") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout while waiting for parse error")
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2016-2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/sequix/grok_exporter/config/v2"
+	"github.com/sequix/grok_exporter/tailer/fswatcher"
+	"github.com/sequix/grok_exporter/tailer/jsonpath"
+)
+
+// Shippers like Filebeat request the cluster info before they send documents, and refuse to send to unknown versions.
+const elasticsearchInfo = `{"name":"grok_exporter","cluster_name":"grok_exporter","version":{"number":"7.10.2","build_flavor":"oss"},"tagline":"You Know, for Search"}`
+
+// Result of one action in the response of the _bulk API.
+type elasticsearchBulkItem map[string]elasticsearchBulkItemStatus
+
+type elasticsearchBulkItemStatus struct {
+	Status int                     `json:"status"`
+	Error  *elasticsearchBulkError `json:"error,omitempty"`
+}
+
+type elasticsearchBulkError struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+type elasticsearchBulkResponse struct {
+	Took   int                     `json:"took"`
+	Errors bool                    `json:"errors"`
+	Items  []elasticsearchBulkItem `json:"items"`
+}
+
+// Reads the NDJSON body of the Elasticsearch _bulk API: Each action line is followed by a document line,
+// except for the delete action. The documents of index and create actions are log entries,
+// the messages are selected with webhook_json_selector, and the document fields configured in webhook_fields are provided as fields.
+// Update and delete actions are acknowledged but ignored.
+// Returns the response body of the _bulk API, documents without message are reported as failed items.
+func processElasticsearchBulk(c *v2.InputConfig, b []byte) ([]*fswatcher.Line, []byte, error) {
+	var (
+		lines    []*fswatcher.Line
+		response = elasticsearchBulkResponse{Items: []elasticsearchBulkItem{}}
+		scanner  = bufio.NewScanner(bytes.NewReader(b))
+	)
+	selector, err := jsonpath.Parse(c.WebhookJsonSelector)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The body size is already limited by webhook_max_body_size.
+	scanner.Buffer(make([]byte, 0, 64*1024), len(b)+1)
+	nextLine := func() ([]byte, bool) {
+		for scanner.Scan() {
+			if line := bytes.TrimSpace(scanner.Bytes()); len(line) > 0 {
+				return line, true
+			}
+		}
+		return nil, false
+	}
+	for {
+		actionLine, ok := nextLine()
+		if !ok {
+			break
+		}
+		var action map[string]json.RawMessage
+		if err := json.Unmarshal(actionLine, &action); err != nil || len(action) != 1 {
+			return nil, nil, fmt.Errorf("invalid action in bulk request: %s", actionLine)
+		}
+		var name string
+		for name = range action {
+		}
+		switch name {
+		case "index", "create", "update":
+			docLine, ok := nextLine()
+			if !ok {
+				return nil, nil, fmt.Errorf("missing document for action %v in bulk request", name)
+			}
+			if name == "update" {
+				response.Items = append(response.Items, elasticsearchBulkItem{name: {Status: http.StatusOK}})
+				continue
+			}
+			docLines, err := elasticsearchDocument(c, selector, docLine)
+			lines = append(lines, docLines...)
+			if err != nil {
+				response.Errors = true
+				response.Items = append(response.Items, elasticsearchBulkItem{name: {
+					Status: http.StatusBadRequest,
+					Error:  &elasticsearchBulkError{Type: "mapper_parsing_exception", Reason: err.Error()},
+				}})
+				continue
+			}
+			response.Items = append(response.Items, elasticsearchBulkItem{name: {Status: http.StatusCreated}})
+		case "delete":
+			response.Items = append(response.Items, elasticsearchBulkItem{name: {Status: http.StatusOK}})
+		default:
+			return nil, nil, fmt.Errorf("unsupported action %v in bulk request", name)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("failed to read bulk request: %v", err)
+	}
+	body, err := json.Marshal(response)
+	if err != nil {
+		return nil, nil, err
+	}
+	return lines, body, nil
+}
+
+// The strings selected before an error are returned anyway, like in the json formats.
+func elasticsearchDocument(c *v2.InputConfig, selector *jsonpath.Path, b []byte) ([]*fswatcher.Line, error) {
+	var doc map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("failed to parse document: %v", err)
+	}
+	messages, err := selectJsonLines(selector, doc)
+	fields := make(map[string]string, len(c.WebhookFields))
+	for name, path := range c.WebhookFields {
+		fields[name], _ = documentField(doc, strings.Split(path, "."))
+	}
+	result := make([]*fswatcher.Line, 0, len(messages))
+	for _, message := range messages {
+		result = append(result, &fswatcher.Line{Line: strings.TrimSpace(message), Fields: fields})
+	}
+	return result, err
+}
+
+// Looks up a path like host.name in nested objects. Shippers may also send the dotted name as a key,
+// like {"host.name": "web-1"}, so at each level the remaining path is tried as a key as well.
+// Strings are returned without quotes, other values as compact JSON.
+func documentField(doc map[string]interface{}, path []string) (string, bool) {
+	var value interface{}
+	found := false
+	for i := range path {
+		if v, exists := doc[strings.Join(path[i:], ".")]; exists {
+			value, found = v, true
+			break
+		}
+		next, ok := doc[path[i]].(map[string]interface{})
+		if !ok {
+			break
+		}
+		doc = next
+	}
+	if !found {
+		return "", false
+	}
+	switch v := value.(type) {
+	case nil:
+		return "", true
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return "", false
+		}
+		return string(b), true
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2016-2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sequix/grok_exporter/config/v2"
+	"github.com/sequix/grok_exporter/tailer/fswatcher"
+)
+
+const bulkBody = `{"index":{"_index":"filebeat-7.10.2"}}
+{"@timestamp":"2019-10-11T18:23:58.000Z","message":"GET /index.html 200\n","host":{"name":"web-1"},"log.file.path":"/var/log/nginx/access.log"}
+{"create":{"_index":"filebeat-7.10.2"}}
+{"@timestamp":"2019-10-11T18:23:59.000Z","message":"GET /missing 404","host":{"name":"web-2"},"status":404}
+
+{"delete":{"_index":"filebeat-7.10.2","_id":"1"}}
+{"update":{"_index":"filebeat-7.10.2","_id":"2"}}
+{"doc":{"message":"ignored"}}
+{"index":{}}
+{"no_message":true}
+`
+
+func TestWebhookElasticsearchBulk(t *testing.T) {
+	c := &v2.InputConfig{
+		Name:                "elasticsearch",
+		Type:                "webhook",
+		WebhookPath:         "/es/",
+		WebhookFormat:       "elasticsearch_bulk",
+		WebhookJsonSelector: ".message",
+		WebhookQueueSize:    10,
+		WebhookQueueTimeout: time.Second,
+		WebhookFields: map[string]string{
+			"host":   "host.name",
+			"file":   "log.file.path",
+			"status": "status",
+		},
+	}
+	tail := InitWebhookTailer(c)
+	go func() {
+		for range tail.Errors() {
+		}
+	}()
+	if paths := WebhookPaths(c); !reflect.DeepEqual(paths, []string{"/es/", "/es/_bulk"}) {
+		t.Fatalf("unexpected paths %v", paths)
+	}
+	handler := WebhookHandler(c.WebhookPath)
+
+	// Shippers check the version before sending documents.
+	rec, _ := serveWebhook(handler, tail, httptest.NewRequest(http.MethodGet, "/es/", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"number":"7.10.2"`) {
+		t.Fatalf("unexpected cluster info response %v %v", rec.Code, rec.Body.String())
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/es/_bulk", strings.NewReader(bulkBody))
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	rec, lines := serveWebhook(handler, tail, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %v: %v", rec.Code, rec.Body.String())
+	}
+	expectedLines := []*fswatcher.Line{
+		{Line: "GET /index.html 200", Fields: map[string]string{"host": "web-1", "file": "/var/log/nginx/access.log", "status": ""}},
+		{Line: "GET /missing 404", Fields: map[string]string{"host": "web-2", "file": "", "status": "404"}},
+	}
+	if !reflect.DeepEqual(lines, expectedLines) {
+		t.Fatalf("expected lines %v, got %v", expectedLines, lines)
+	}
+	var response elasticsearchBulkResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if !response.Errors || len(response.Items) != 5 {
+		t.Fatalf("unexpected response %v", rec.Body.String())
+	}
+	for i, expected := range []struct {
+		action string
+		status int
+	}{{"index", 201}, {"create", 201}, {"delete", 200}, {"update", 200}, {"index", 400}} {
+		if status := response.Items[i][expected.action].Status; status != expected.status {
+			t.Errorf("item %v: expected %v with status %v, got %v", i, expected.action, expected.status, response.Items[i])
+		}
+	}
+
+	for name, body := range map[string]string{
+		"invalid action":   "{\"index\":\n",
+		"unknown action":   "{\"upsert\":{}}\n{}\n",
+		"missing document": "{\"index\":{}}\n",
+	} {
+		rec, lines = serveWebhook(handler, tail, httptest.NewRequest(http.MethodPost, "/es/_bulk", strings.NewReader(body)))
+		if rec.Code != http.StatusBadRequest || len(lines) > 0 {
+			t.Errorf("%v: expected status 400 without lines, got %v and %v lines", name, rec.Code, len(lines))
+		}
+	}
+}
@@ -0,0 +1,266 @@
+// Copyright 2016-2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/sequix/grok_exporter/config/v2"
+	"github.com/sequix/grok_exporter/tailer/fswatcher"
+)
+
+// A stream of the Loki push API, with the labels already parsed.
+type lokiStream struct {
+	labels map[string]string
+	lines  []string
+}
+
+// The JSON format of the Loki push API. Promtail and the Loki clients send "stream" and "values",
+// older clients send "labels" in the Prometheus format and "entries".
+type lokiJsonPushRequest struct {
+	Streams []struct {
+		Stream  map[string]string   `json:"stream"`
+		Values  [][]json.RawMessage `json:"values"` // [ "<unix epoch in nanoseconds>", "<log line>", optional structured metadata ]
+		Labels  string              `json:"labels"`
+		Entries []struct {
+			Line string `json:"line"`
+		} `json:"entries"`
+	} `json:"streams"`
+}
+
+// Reads the body of a request to the Loki push API /loki/api/v1/push.
+// Promtail sends snappy compressed protobuf with Content-Type application/x-protobuf, other clients send JSON.
+// The stream labels configured in webhook_fields are provided as fields.
+// Returns the HTTP status code for the error, or 204 like Loki.
+func processLokiPush(c *v2.InputConfig, contentType string, b []byte) ([]*fswatcher.Line, int, error) {
+	var (
+		streams []lokiStream
+		err     error
+	)
+	if strings.HasPrefix(strings.ToLower(contentType), "application/x-protobuf") {
+		b, err = decodeSnappy(b, c.WebhookMaxBodySize)
+		if err != nil {
+			return nil, bodyErrorStatus(err), err
+		}
+		streams, err = parseLokiProtobuf(b)
+	} else {
+		streams, err = parseLokiJson(b)
+	}
+	if err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("failed to parse Loki push request: %v", err)
+	}
+	var result []*fswatcher.Line
+	for _, stream := range streams {
+		for _, line := range stream.lines {
+			fields := make(map[string]string, len(c.WebhookFields))
+			for name, label := range c.WebhookFields {
+				fields[name] = stream.labels[label]
+			}
+			result = append(result, &fswatcher.Line{Line: strings.TrimSpace(line), Fields: fields})
+		}
+	}
+	return result, http.StatusNoContent, nil
+}
+
+// Loki uses the snappy block format. The decoded length is checked before decoding,
+// so that a small body cannot exhaust the memory.
+func decodeSnappy(b []byte, maxSize int64) ([]byte, error) {
+	size, err := snappy.DecodedLen(b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress snappy body: %v", err)
+	}
+	if maxSize > 0 && int64(size) > maxSize {
+		// bodyErrorStatus() maps this to 413, like a body exceeding the size limit before decompression.
+		return nil, fmt.Errorf("request body too large: decompressed size %v exceeds %v bytes", size, maxSize)
+	}
+	result, err := snappy.Decode(nil, b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress snappy body: %v", err)
+	}
+	return result, nil
+}
+
+func parseLokiJson(b []byte) ([]lokiStream, error) {
+	var req lokiJsonPushRequest
+	if err := json.Unmarshal(b, &req); err != nil {
+		return nil, err
+	}
+	result := make([]lokiStream, 0, len(req.Streams))
+	for _, s := range req.Streams {
+		stream := lokiStream{labels: s.Stream}
+		if stream.labels == nil && len(s.Labels) > 0 {
+			labels, err := parseLokiLabels(s.Labels)
+			if err != nil {
+				return nil, err
+			}
+			stream.labels = labels
+		}
+		for _, value := range s.Values {
+			if len(value) < 2 {
+				return nil, fmt.Errorf("invalid value in stream %v: expected timestamp and line", s.Stream)
+			}
+			var line string
+			if err := json.Unmarshal(value[1], &line); err != nil {
+				return nil, fmt.Errorf("invalid line in stream %v: %v", s.Stream, err)
+			}
+			stream.lines = append(stream.lines, line)
+		}
+		for _, entry := range s.Entries {
+			stream.lines = append(stream.lines, entry.Line)
+		}
+		result = append(result, stream)
+	}
+	return result, nil
+}
+
+// Decodes the protobuf messages of the Loki push API, see logproto/push.proto in the Loki repository:
+//
+//	message PushRequest { repeated StreamAdapter streams = 1; }
+//	message StreamAdapter { string labels = 1; repeated EntryAdapter entries = 2; uint64 hash = 3; }
+//	message EntryAdapter { google.protobuf.Timestamp timestamp = 1; string line = 2; ... }
+//
+// Unknown fields are skipped, so that additions to the protocol are ignored.
+func parseLokiProtobuf(b []byte) ([]lokiStream, error) {
+	var result []lokiStream
+	err := readProtobufMessage(b, func(field uint64, value []byte) error {
+		if field != 1 {
+			return nil
+		}
+		stream, err := parseLokiProtobufStream(value)
+		if err != nil {
+			return err
+		}
+		result = append(result, stream)
+		return nil
+	})
+	return result, err
+}
+
+func parseLokiProtobufStream(b []byte) (lokiStream, error) {
+	var (
+		stream lokiStream
+		labels string
+	)
+	err := readProtobufMessage(b, func(field uint64, value []byte) error {
+		switch field {
+		case 1:
+			labels = string(value)
+		case 2:
+			return readProtobufMessage(value, func(field uint64, value []byte) error {
+				if field == 2 {
+					stream.lines = append(stream.lines, string(value))
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil || len(labels) == 0 {
+		return stream, err
+	}
+	stream.labels, err = parseLokiLabels(labels)
+	return stream, err
+}
+
+// Calls f for each length-delimited field of a protobuf message. Fields with other wire types are skipped.
+func readProtobufMessage(b []byte, f func(field uint64, value []byte) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errors.New("invalid protobuf field key")
+		}
+		b = b[n:]
+		field, wireType := key>>3, key&7
+		switch wireType {
+		case 0: // varint
+			if _, n = binary.Uvarint(b); n <= 0 {
+				return fmt.Errorf("invalid varint in protobuf field %v", field)
+			}
+			b = b[n:]
+		case 1: // 64 bit
+			if len(b) < 8 {
+				return fmt.Errorf("truncated protobuf field %v", field)
+			}
+			b = b[8:]
+		case 2: // length-delimited
+			length, n := binary.Uvarint(b)
+			if n <= 0 || length > uint64(len(b)-n) {
+				return fmt.Errorf("truncated protobuf field %v", field)
+			}
+			value := b[n : n+int(length)]
+			b = b[n+int(length):]
+			if err := f(field, value); err != nil {
+				return err
+			}
+		case 5: // 32 bit
+			if len(b) < 4 {
+				return fmt.Errorf("truncated protobuf field %v", field)
+			}
+			b = b[4:]
+		default:
+			return fmt.Errorf("unsupported wire type %v in protobuf field %v", wireType, field)
+		}
+	}
+	return nil
+}
+
+// Parses labels in the Prometheus format, like {job="varlogs", filename="/var/log/syslog"}.
+// Loki formats the values as Go string literals, so they are unquoted with strconv.Unquote().
+func parseLokiLabels(s string) (map[string]string, error) {
+	s = strings.TrimSpace(s)
+	if len(s) < 2 || s[0] != '{' || s[len(s)-1] != '}' {
+		return nil, fmt.Errorf("invalid labels %q: expected {name=\"value\", ...}", s)
+	}
+	result := make(map[string]string)
+	rest := s[1 : len(s)-1]
+	for {
+		rest = strings.TrimLeft(rest, " ,")
+		if len(rest) == 0 {
+			return result, nil
+		}
+		i := strings.IndexByte(rest, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("invalid labels %q: missing '='", s)
+		}
+		name := strings.TrimSpace(rest[:i])
+		rest = strings.TrimLeft(rest[i+1:], " ")
+		if len(rest) == 0 || rest[0] != '"' {
+			return nil, fmt.Errorf("invalid labels %q: value of %v is not quoted", s, name)
+		}
+		end := 1
+		for end < len(rest) && rest[end] != '"' {
+			if rest[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(rest) {
+			return nil, fmt.Errorf("invalid labels %q: unterminated value of %v", s, name)
+		}
+		value, err := strconv.Unquote(rest[:end+1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid labels %q: value of %v: %v", s, name, err)
+		}
+		result[name] = value
+		rest = rest[end+1:]
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2016-2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/sequix/grok_exporter/config/v2"
+	"github.com/sequix/grok_exporter/tailer/fswatcher"
+)
+
+func TestParseLokiLabels(t *testing.T) {
+	for s, expected := range map[string]map[string]string{
+		`{}`: {},
+		`{job="varlogs", filename="/var/log/syslog"}`: {"job": "varlogs", "filename": "/var/log/syslog"},
+		`{msg="say \"hi\", then \\ leave",a="b"}`:     {"msg": `say "hi", then \ leave`, "a": "b"},
+	} {
+		actual, err := parseLokiLabels(s)
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", s, err)
+		} else if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("%v: expected %v, got %v", s, expected, actual)
+		}
+	}
+	for _, s := range []string{``, `job="varlogs"`, `{job}`, `{job=varlogs}`, `{job="varlogs}`} {
+		if _, err := parseLokiLabels(s); err == nil {
+			t.Errorf("%v: expected error", s)
+		}
+	}
+}
+
+func TestWebhookLoki(t *testing.T) {
+	c := &v2.InputConfig{
+		Name:          "loki",
+		Type:          "webhook",
+		WebhookPath:   "/loki/api/v1/push",
+		WebhookFormat: "loki",
+		WebhookFields: map[string]string{
+			"job":  "job",
+			"host": "hostname",
+		},
+		WebhookMaxBodySize:  1024,
+		WebhookQueueSize:    10,
+		WebhookQueueTimeout: time.Second,
+	}
+	tail := InitWebhookTailer(c)
+	go func() {
+		for range tail.Errors() {
+		}
+	}()
+
+	jsonBody := `{"streams": [
+		{"stream": {"job": "nginx", "hostname": "web-1"}, "values": [["1570818238000000000", "GET /index.html 200"], ["1570818238000000001", "GET /missing 404", {"trace_id": "0242ac120002"}]]},
+		{"labels": "{job=\"postgres\"}", "entries": [{"ts": "2019-10-11T18:23:58Z", "line": "checkpoint starting"}]}
+	]}`
+	protobufBody := protobufField(1, append(
+		protobufField(1, []byte(`{hostname="web-2", job="nginx"}`)),
+		protobufField(2, append(
+			protobufField(1, protobufVarintField(1, 1570818238)),
+			protobufField(2, []byte("GET /login 302"))...))...))
+	protobufBody = append(protobufBody, protobufVarintField(3, 42)...) // unknown fields are skipped
+
+	for _, test := range []struct {
+		name           string
+		contentType    string
+		body           []byte
+		expectedStatus int
+		expectedLines  []*fswatcher.Line
+	}{
+		{"json", "application/json", []byte(jsonBody), http.StatusNoContent, []*fswatcher.Line{
+			{Line: "GET /index.html 200", Fields: map[string]string{"job": "nginx", "host": "web-1"}},
+			{Line: "GET /missing 404", Fields: map[string]string{"job": "nginx", "host": "web-1"}},
+			{Line: "checkpoint starting", Fields: map[string]string{"job": "postgres", "host": ""}},
+		}},
+		{"protobuf", "application/x-protobuf", snappy.Encode(nil, protobufBody), http.StatusNoContent, []*fswatcher.Line{
+			{Line: "GET /login 302", Fields: map[string]string{"job": "nginx", "host": "web-2"}},
+		}},
+		{"invalid json", "application/json", []byte(`{"streams": [`), http.StatusBadRequest, nil},
+		{"invalid snappy", "application/x-protobuf", []byte("not snappy"), http.StatusBadRequest, nil},
+		{"truncated protobuf", "application/x-protobuf", snappy.Encode(nil, protobufBody[:10]), http.StatusBadRequest, nil},
+		{"too large decompressed", "application/x-protobuf", snappy.Encode(nil, bytes.Repeat([]byte{0}, 1025)), http.StatusRequestEntityTooLarge, nil},
+	} {
+		req := httptest.NewRequest(http.MethodPost, c.WebhookPath, bytes.NewReader(test.body))
+		req.Header.Set("Content-Type", test.contentType)
+		rec, lines := serveWebhook(WebhookHandler(c.WebhookPath), tail, req)
+		if rec.Code != test.expectedStatus {
+			t.Errorf("%v: expected status %v, got %v", test.name, test.expectedStatus, rec.Code)
+		}
+		if !reflect.DeepEqual(lines, test.expectedLines) {
+			t.Errorf("%v: expected lines %v, got %v", test.name, test.expectedLines, lines)
+		}
+	}
+}
+
+func protobufField(field uint64, value []byte) []byte {
+	result := protobufVarint(field<<3 | 2)
+	result = append(result, protobufVarint(uint64(len(value)))...)
+	return append(result, value...)
+}
+
+func protobufVarintField(field uint64, value uint64) []byte {
+	return append(protobufVarint(field<<3), protobufVarint(value)...)
+}
+
+func protobufVarint(v uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return buf[:binary.PutUvarint(buf, v)]
+}
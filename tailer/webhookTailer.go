@@ -15,24 +15,117 @@
 package tailer
 
 import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/subtle"
+	"encoding/json"
 	"errors"
-	json "github.com/bitly/go-simplejson"
-	"github.com/sequix/grok_exporter/config/v2"
-	"github.com/sequix/grok_exporter/log"
-	"github.com/sequix/grok_exporter/tailer/fswatcher"
-	"github.com/sirupsen/logrus"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sequix/grok_exporter/config/v2"
+	"github.com/sequix/grok_exporter/log"
+	"github.com/sequix/grok_exporter/tailer/fswatcher"
+	"github.com/sequix/grok_exporter/tailer/jsonpath"
 )
 
 type WebhookTailer struct {
 	lines  chan *fswatcher.Line
 	errors chan fswatcher.Error
 	config *v2.InputConfig
+	queue  *webhookQueue
+}
+
+// One tailer for each webhook_path, as the handlers are registered only once when the server starts.
+var webhookTailers = make(map[string]*WebhookTailer)
+
+var (
+	webhookRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "grok_exporter_webhook_requests_total",
+		Help: "Number of requests received by the webhook input, partitioned by HTTP status code.",
+	}, []string{"input", "status"})
+	webhookQueueLength = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "grok_exporter_webhook_queue_length",
+		Help: "Number of lines received by the webhook input that are not processed yet.",
+	}, []string{"input"})
+	webhookRejectedLines = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "grok_exporter_webhook_rejected_lines_total",
+		Help: "Number of lines in requests that were rejected because the queue of the webhook input was full.",
+	}, []string{"input"})
+	registerWebhookMetrics sync.Once
+)
+
+// Requests wait until there is space for all of their lines in the queue, so that a request is either processed completely or rejected.
+// A request with more lines than the queue size is accepted when the queue is empty.
+type webhookQueue struct {
+	lines    chan *fswatcher.Line
+	size     int
+	mutex    sync.Mutex
+	length   int           // number of lines that are accepted but not passed on yet
+	released chan struct{} // closed when lines are passed on, so that waiting requests check the length again
+	gauge    prometheus.Gauge
+}
+
+func newWebhookQueue(size int, gauge prometheus.Gauge) *webhookQueue {
+	return &webhookQueue{
+		lines:    make(chan *fswatcher.Line, size),
+		size:     size,
+		released: make(chan struct{}),
+		gauge:    gauge,
+	}
+}
+
+// Returns false if there is not enough space for n lines in the queue within the timeout.
+func (q *webhookQueue) reserve(n int, timeout time.Duration) bool {
+	var deadline <-chan time.Time
+	for {
+		q.mutex.Lock()
+		if q.length == 0 || q.length+n <= q.size {
+			q.length += n
+			q.gauge.Set(float64(q.length))
+			q.mutex.Unlock()
+			return true
+		}
+		released := q.released
+		q.mutex.Unlock()
+		if deadline == nil {
+			deadline = time.After(timeout)
+		}
+		select {
+		case <-released:
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+func (q *webhookQueue) release() {
+	q.mutex.Lock()
+	q.length--
+	q.gauge.Set(float64(q.length))
+	close(q.released)
+	q.released = make(chan struct{})
+	q.mutex.Unlock()
 }
 
-var webhookTailerSingleton *WebhookTailer
+// Passes the queued lines on to the tailer's line channel. Runs forever, like the webhook handler.
+func (q *webhookQueue) run(out chan *fswatcher.Line) {
+	for line := range q.lines {
+		out <- line
+		q.release()
+	}
+}
 
 func (t *WebhookTailer) Lines() chan *fswatcher.Line {
 	return t.lines
@@ -47,59 +140,233 @@ func (t *WebhookTailer) Close() {
 }
 
 func InitWebhookTailer(inputConfig *v2.InputConfig) fswatcher.Interface {
-	if webhookTailerSingleton != nil {
-		return webhookTailerSingleton
+	if t, exists := webhookTailers[inputConfig.WebhookPath]; exists {
+		return t
 	}
 
 	lineChan := make(chan *fswatcher.Line)
 	errorChan := make(chan fswatcher.Error)
-	webhookTailerSingleton = &WebhookTailer{
+	registerWebhookMetrics.Do(func() {
+		prometheus.MustRegister(webhookRequests, webhookQueueLength, webhookRejectedLines)
+	})
+	t := &WebhookTailer{
 		lines:  lineChan,
 		errors: errorChan,
 		config: inputConfig,
+		queue:  newWebhookQueue(inputConfig.WebhookQueueSize, webhookQueueLength.WithLabelValues(inputConfig.Name)),
 	}
-	return webhookTailerSingleton
+	go t.queue.run(lineChan)
+	webhookTailers[inputConfig.WebhookPath] = t
+	webhookRequests.WithLabelValues(inputConfig.Name, strconv.Itoa(http.StatusOK)).Add(0)
+	webhookRejectedLines.WithLabelValues(inputConfig.Name).Add(0)
+	return t
+}
+
+func WebhookHandler(path string) http.Handler {
+	return webhookTailers[path]
 }
 
-func WebhookHandler() http.Handler {
-	return webhookTailerSingleton
+// The HTTP paths served for an input. Elasticsearch clients are configured with the base URL,
+// and append /_bulk for sending documents.
+func WebhookPaths(inputConfig *v2.InputConfig) []string {
+	if inputConfig.WebhookFormat == "elasticsearch_bulk" {
+		return []string{inputConfig.WebhookPath, strings.TrimSuffix(inputConfig.WebhookPath, "/") + "/_bulk"}
+	}
+	return []string{inputConfig.WebhookPath}
 }
 
-func (t WebhookTailer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+func (t *WebhookTailer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Implement the http handler interface
+	status := t.serve(w, r)
+	webhookRequests.WithLabelValues(t.config.Name, strconv.Itoa(status)).Inc()
+}
 
-	wts := webhookTailerSingleton
-	lineChan := wts.lines
-	errorChan := wts.errors
+// Returns the HTTP status code of the response.
+func (t *WebhookTailer) serve(w http.ResponseWriter, r *http.Request) int {
+
+	if !t.authorized(r) {
+		log.WithField("remote_addr", r.RemoteAddr).Warn("unauthorized webhook request")
+		if t.config.WebhookBasicAuthUsername != "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="grok_exporter"`)
+		} else {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="grok_exporter"`)
+		}
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return http.StatusUnauthorized
+	}
+
+	if t.config.WebhookFormat == "elasticsearch_bulk" && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, elasticsearchInfo)
+		return http.StatusOK
+	}
 
 	if r.Body == nil {
 		err := errors.New("got empty request body")
 		log.WithError(err).Warn()
 		http.Error(w, err.Error(), http.StatusBadRequest)
-		errorChan <- fswatcher.NewError(fswatcher.NotSpecified, err, "")
-		return
+		t.sendError(fswatcher.NewError(fswatcher.NotSpecified, err, ""))
+		return http.StatusBadRequest
 	}
+	defer r.Body.Close()
 
-	b, err := ioutil.ReadAll(r.Body)
+	b, status, err := t.readBody(w, r)
 	if err != nil {
 		log.WithError(err).Warn()
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		errorChan <- fswatcher.NewError(fswatcher.NotSpecified, err, "")
-		return
+		http.Error(w, err.Error(), status)
+		t.sendError(fswatcher.NewError(fswatcher.NotSpecified, err, ""))
+		return status
+	}
+
+	var (
+		lines    []*fswatcher.Line
+		response []byte
+	)
+	status = http.StatusOK
+	switch t.config.WebhookFormat {
+	case "loki":
+		lines, status, err = processLokiPush(t.config, r.Header.Get("Content-Type"), b)
+	case "elasticsearch_bulk":
+		lines, response, err = processElasticsearchBulk(t.config, b)
+		if err != nil {
+			status = http.StatusBadRequest
+		}
+	default:
+		strs, errs := WebhookProcessBody(t.config, b)
+		for _, line := range strs {
+			lines = append(lines, &fswatcher.Line{Line: line})
+		}
+		for _, e := range errs {
+			t.sendError(e)
+		}
+	}
+	if err != nil {
+		log.WithError(err).Warn()
+		http.Error(w, err.Error(), status)
+		t.sendError(fswatcher.NewError(fswatcher.NotSpecified, err, ""))
+		return status
 	}
-	defer r.Body.Close()
 
-	lines := WebhookProcessBody(wts.config, b)
+	if !t.queue.reserve(len(lines), t.config.WebhookQueueTimeout) {
+		log.WithField("lines", len(lines)).Warn("webhook queue is full, rejecting request")
+		webhookRejectedLines.WithLabelValues(t.config.Name).Add(float64(len(lines)))
+		// Clients should retry after the time the request waited for the queue.
+		retryAfter := int(math.Ceil(t.config.WebhookQueueTimeout.Seconds()))
+		if retryAfter < 1 {
+			retryAfter = 1
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		http.Error(w, "webhook queue is full", http.StatusTooManyRequests)
+		return http.StatusTooManyRequests
+	}
 	for _, line := range lines {
-		log.WithField("line", line).Debug("Groking line")
-		lineChan <- &fswatcher.Line{Line: line}
+		log.WithField("line", line.Line).Debug("Groking line")
+		t.queue.lines <- line
+	}
+	if response != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write(response)
+	} else if status != http.StatusOK {
+		w.WriteHeader(status)
+	}
+	return status
+}
+
+// Like the lines, errors are not waited for longer than webhook_queue_timeout, so that a busy main loop does not block the request.
+func (t *WebhookTailer) sendError(err fswatcher.Error) {
+	select {
+	case t.errors <- err:
+	case <-time.After(t.config.WebhookQueueTimeout):
+		log.WithError(err).Warn("dropping webhook error, because it was not processed within the webhook_queue_timeout")
 	}
-	return
 }
 
-func WebhookProcessBody(c *v2.InputConfig, b []byte) []string {
+// Without configured credentials all requests are authorized.
+func (t *WebhookTailer) authorized(r *http.Request) bool {
+	switch {
+	case t.config.WebhookBearerToken != "":
+		auth := r.Header.Get("Authorization")
+		const prefix = "bearer "
+		if len(auth) < len(prefix) || strings.ToLower(auth[:len(prefix)]) != prefix {
+			return false
+		}
+		return secureCompare(auth[len(prefix):], t.config.WebhookBearerToken)
+	case t.config.WebhookBasicAuthUsername != "":
+		username, password, ok := r.BasicAuth()
+		// Both are compared, so that the response time does not reveal whether the username is correct.
+		usernameOk := secureCompare(username, t.config.WebhookBasicAuthUsername)
+		passwordOk := secureCompare(password, t.config.WebhookBasicAuthPassword)
+		return ok && usernameOk && passwordOk
+	default:
+		return true
+	}
+}
+
+func secureCompare(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// Reads the body and decompresses it according to the Content-Encoding header.
+// If the compressed or the decompressed body exceeds webhook_max_body_size, the status is 413.
+func (t *WebhookTailer) readBody(w http.ResponseWriter, r *http.Request) ([]byte, int, error) {
+	maxSize := t.config.WebhookMaxBodySize
+	var body io.Reader = r.Body
+	if maxSize > 0 {
+		body = http.MaxBytesReader(w, r.Body, maxSize)
+	}
+	var err error
+	switch encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+	case "gzip", "x-gzip":
+		body, err = gzip.NewReader(body)
+	case "deflate":
+		body, err = newDeflateReader(body)
+	default:
+		return nil, http.StatusUnsupportedMediaType, fmt.Errorf("unsupported Content-Encoding %q", encoding)
+	}
+	if err != nil {
+		return nil, bodyErrorStatus(err), fmt.Errorf("failed to read request body: %v", err)
+	}
+	if maxSize > 0 {
+		// Also limit the decompressed size, so that a small compressed body cannot exhaust the memory.
+		body = io.LimitReader(body, maxSize+1)
+	}
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, bodyErrorStatus(err), fmt.Errorf("failed to read request body: %v", err)
+	}
+	if maxSize > 0 && int64(len(b)) > maxSize {
+		return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("decompressed request body exceeds %v bytes", maxSize)
+	}
+	return b, http.StatusOK, nil
+}
+
+// The deflate Content-Encoding should use the zlib format, but some clients send raw deflate data.
+func newDeflateReader(r io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(r)
+	header, err := buffered.Peek(2)
+	if err == nil && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(buffered)
+	}
+	return flate.NewReader(buffered), nil
+}
+
+// http.MaxBytesReader does not have a dedicated error type, so we recognize it by its message.
+func bodyErrorStatus(err error) int {
+	if strings.Contains(err.Error(), "request body too large") {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// Returns the log lines in the body. For the JSON formats, each string selected by webhook_json_selector is a line.
+// In json_bulk format, the selector is applied to each entry of the array,
+// entries that cannot be processed are reported as errors without affecting the other entries.
+func WebhookProcessBody(c *v2.InputConfig, b []byte) ([]string, []fswatcher.Error) {
 
 	strs := []string{}
+	var errs []fswatcher.Error
 
 	switch c.WebhookFormat {
 	case "text_single":
@@ -108,47 +375,55 @@ func WebhookProcessBody(c *v2.InputConfig, b []byte) []string {
 	case "text_bulk":
 		s := strings.TrimSpace(string(b))
 		strs = strings.Split(s, c.WebhookTextBulkSeparator)
-	case "json_single":
-		path := strings.Split(c.WebhookJsonSelector[1:], ".")
-		j, err := json.NewJson(b)
+	case "json_single", "json_bulk":
+		selector, err := jsonpath.Parse(c.WebhookJsonSelector)
 		if err != nil {
-			log.WithField("post_body", string(b)).Warn("Unable to Parse JSON")
+			// This cannot happen, because the selector is validated when the config is loaded.
+			errs = append(errs, fswatcher.NewError(fswatcher.NotSpecified, err, "webhook_json_selector"))
 			break
 		}
-		s, err := j.GetPath(path...).String()
-		if err != nil {
-			log.WithFields(logrus.Fields{
-				"post_body":             string(b),
-				"webhook_json_selector": c.WebhookJsonSelector,
-			}).Warn("Unable to find selector path")
+		var doc interface{}
+		decoder := json.NewDecoder(bytes.NewReader(b))
+		decoder.UseNumber()
+		if err = decoder.Decode(&doc); err != nil {
+			errs = append(errs, fswatcher.NewError(fswatcher.NotSpecified, err, "unable to parse JSON"))
 			break
 		}
-		strs = append(strs, s)
-	case "json_bulk":
-		path := strings.Split(c.WebhookJsonSelector[1:], ".")
-		j, err := json.NewJson(b)
-		if err != nil {
-			log.WithField("post_body", string(b)).Warn("Unable to Parse JSON")
+		if c.WebhookFormat == "json_single" {
+			lines, err := selectJsonLines(selector, doc)
+			if err != nil {
+				errs = append(errs, fswatcher.NewStructuredError(err, "unable to select log line", map[string]interface{}{
+					"webhook_json_selector": selector.String(),
+				}))
+			}
+			strs = append(strs, lines...)
 			break
 		}
-
-		for _, ei := range j.MustArray() {
-			// Cast the entry interface{} back to the Json object.
-			//   Unfortunately, this is how the simplejson lib works.
-			ej := json.New()
-			ej.Set("x", ei)
-			new_path := []string{}
-			new_path = append([]string{"x"}, path...)
-
-			s, err := ej.GetPath(new_path...).String()
+		entries, ok := doc.([]interface{})
+		if !ok {
+			errs = append(errs, fswatcher.NewError(fswatcher.NotSpecified, nil, "unable to parse JSON: json_bulk body must be an array"))
+			break
+		}
+		// The bad entries are reported as a single error, because each error may block the request up to webhook_queue_timeout.
+		var (
+			failed   []int
+			firstErr error
+		)
+		for i, entry := range entries {
+			lines, err := selectJsonLines(selector, entry)
 			if err != nil {
-				log.WithFields(logrus.Fields{
-					"post_body":             string(b),
-					"webhook_json_selector": c.WebhookJsonSelector,
-				}).Warn("Unable to find selector path")
-				break
+				if firstErr == nil {
+					firstErr = err
+				}
+				failed = append(failed, i)
 			}
-			strs = append(strs, s)
+			strs = append(strs, lines...)
+		}
+		if len(failed) > 0 {
+			errs = append(errs, fswatcher.NewStructuredError(firstErr, fmt.Sprintf("unable to select log line in %v of %v entries", len(failed), len(entries)), map[string]interface{}{
+				"webhook_json_selector": selector.String(),
+				"entries":               failed,
+			}))
 		}
 	default:
 		// error silently
@@ -159,5 +434,23 @@ func WebhookProcessBody(c *v2.InputConfig, b []byte) []string {
 		strs[i] = strings.TrimSpace(strs[i])
 	}
 
-	return strs
+	return strs, errs
+}
+
+// Returns the strings selected in doc. Returns an error if nothing is selected or if a selected value is not a string,
+// the strings selected before the error are returned anyway.
+func selectJsonLines(selector *jsonpath.Path, doc interface{}) ([]string, error) {
+	values := selector.Find(doc)
+	if len(values) == 0 {
+		return nil, fmt.Errorf("%v not found", selector)
+	}
+	result := make([]string, 0, len(values))
+	for _, value := range values {
+		line, ok := value.(string)
+		if !ok {
+			return result, fmt.Errorf("%v selects a %T value, expected a string", selector, value)
+		}
+		result = append(result, line)
+	}
+	return result, nil
 }
@@ -15,10 +15,21 @@
 package tailer
 
 import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
 	"fmt"
-	"github.com/sequix/grok_exporter/config/v2"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sequix/grok_exporter/config/v2"
+	"github.com/sequix/grok_exporter/tailer/fswatcher"
 )
 
 func TestWebhookTextSingle(t *testing.T) {
@@ -32,7 +43,7 @@ func TestWebhookTextSingle(t *testing.T) {
 
 	message := "2016-04-18 09:33:27 H=(85.214.241.101) [114.37.190.56] F=<z2007tw@yahoo.com.tw> rejected RCPT <alan.a168@msa.hinet.net>: relay not permitted"
 	fmt.Printf("Sending Payload: %v", message)
-	lines := WebhookProcessBody(c, []byte(message))
+	lines, _ := WebhookProcessBody(c, []byte(message))
 	if len(lines) != 1 {
 		t.Fatal("Expected 1 line processed")
 	}
@@ -57,7 +68,7 @@ func TestWebhookTextBulk(t *testing.T) {
 	}
 	payload := strings.Join(messages, c.WebhookTextBulkSeparator)
 	fmt.Printf("Sending Payload: %v", payload)
-	lines := WebhookProcessBody(c, []byte(payload))
+	lines, _ := WebhookProcessBody(c, []byte(payload))
 	if len(lines) != len(messages) {
 		t.Fatal("Expected number of lines to equal number of messages")
 	}
@@ -85,7 +96,7 @@ func TestWebhookTextBulkNegative(t *testing.T) {
 	}
 	payload := strings.Join(messages, "\t\t")
 	fmt.Printf("Sending Payload: %v", payload)
-	lines := WebhookProcessBody(c, []byte(payload))
+	lines, _ := WebhookProcessBody(c, []byte(payload))
 	if len(lines) == len(messages) {
 		t.Fatal("Expected number of lines to equal number of messages")
 	}
@@ -106,7 +117,7 @@ func TestWebhookJsonSingle(t *testing.T) {
 	message := "2016-04-18 09:33:27 H=(85.214.241.101) [114.37.190.56] F=<z2007tw@yahoo.com.tw> rejected RCPT <alan.a168@msa.hinet.net>: relay not permitted"
 	s := createJsonBlob(message)
 	fmt.Printf("Sending Payload: %v", s)
-	lines := WebhookProcessBody(c, []byte(s))
+	lines, _ := WebhookProcessBody(c, []byte(s))
 	if len(lines) != 1 {
 		t.Fatal("Expected 1 line processed")
 	}
@@ -128,7 +139,10 @@ func TestWebhookJsonSingleNegativeWebhookJsonSelector(t *testing.T) {
 	message := "2016-04-18 09:33:27 H=(85.214.241.101) [114.37.190.56] F=<z2007tw@yahoo.com.tw> rejected RCPT <alan.a168@msa.hinet.net>: relay not permitted"
 	s := createJsonBlob(message)
 	fmt.Printf("Sending Payload: %v", s)
-	lines := WebhookProcessBody(c, []byte(s))
+	lines, errs := WebhookProcessBody(c, []byte(s))
+	if len(errs) == 0 {
+		t.Fatal("Expected an error")
+	}
 	if len(lines) != 0 {
 		t.Fatal("Expected 1 line processed")
 	}
@@ -147,7 +161,10 @@ func TestWebhookJsonSingleNegativeMalformedJson(t *testing.T) {
 	message := "2016-04-18 09:33:27 H=(85.214.241.101) [114.37.190.56] F=<z2007tw@yahoo.com.tw> rejected RCPT <alan.a168@msa.hinet.net>: relay not permitted"
 	s := createMalformedJsonBlob(message)
 	fmt.Printf("Sending Payload: %v", s)
-	lines := WebhookProcessBody(c, []byte(s))
+	lines, errs := WebhookProcessBody(c, []byte(s))
+	if len(errs) == 0 {
+		t.Fatal("Expected an error")
+	}
 	if len(lines) != 0 {
 		t.Fatal("Expected 0 lines processed")
 	}
@@ -178,7 +195,7 @@ func TestWebhookJsonBulk(t *testing.T) {
 	}
 	s := "[\n" + strings.Join(blobs, ",\n") + "\n]"
 	fmt.Printf("Sending Payload: %v", s)
-	lines := WebhookProcessBody(c, []byte(s))
+	lines, _ := WebhookProcessBody(c, []byte(s))
 	if len(lines) != len(messages) {
 		t.Fatal("Expected number of lines to equal number of messages")
 	}
@@ -214,12 +231,189 @@ func TestWebhookJsonBulkNegativeMalformedJson(t *testing.T) {
 	}
 	s := "[\n" + strings.Join(blobs, ",\n") + "\n]"
 	fmt.Printf("Sending Payload: %v", s)
-	lines := WebhookProcessBody(c, []byte(s))
+	lines, errs := WebhookProcessBody(c, []byte(s))
+	if len(errs) == 0 {
+		t.Fatal("Expected an error")
+	}
 	if len(lines) != 0 {
 		t.Fatal("Expected 0 lines processed")
 	}
 }
 
+func TestWebhookJsonPath(t *testing.T) {
+	c := &v2.InputConfig{
+		Type:                "webhook",
+		WebhookPath:         "/webhook",
+		WebhookFormat:       "json_single",
+		WebhookJsonSelector: "$.events[*].msg",
+	}
+	lines, errs := WebhookProcessBody(c, []byte(`{"events": [{"msg": "first"}, {"msg": " second "}]}`))
+	if strings.Join(lines, "|") != "first|second" || len(errs) != 0 {
+		t.Fatalf("unexpected lines %q, errors %v", lines, errs)
+	}
+	c.WebhookJsonSelector = "$.records[0]['log','msg']"
+	lines, errs = WebhookProcessBody(c, []byte(`{"records": [{"log": "a", "msg": "b"}, {"log": "c"}]}`))
+	if strings.Join(lines, "|") != "a|b" || len(errs) != 0 {
+		t.Fatalf("unexpected lines %q, errors %v", lines, errs)
+	}
+}
+
+func TestWebhookJsonBulkEntryErrors(t *testing.T) {
+	c := &v2.InputConfig{
+		Name:                "bulk",
+		Type:                "webhook",
+		WebhookPath:         "/bulk",
+		WebhookFormat:       "json_bulk",
+		WebhookJsonSelector: "$.log",
+		WebhookQueueSize:    10,
+		WebhookQueueTimeout: time.Second,
+	}
+	tail := InitWebhookTailer(c)
+	errs := make(chan fswatcher.Error, 10)
+	go func() {
+		for err := range tail.Errors() {
+			errs <- err
+		}
+	}()
+	body := `[{"log": "first"}, {"other": "x"}, {"log": 42}, {"log": "last"}]`
+	rec, received := serveWebhook(WebhookHandler(c.WebhookPath), tail, httptest.NewRequest(http.MethodPost, c.WebhookPath, strings.NewReader(body)))
+	var (
+		lines   []string
+		entries []interface{}
+	)
+	for _, line := range received {
+		lines = append(lines, line.Line)
+	}
+	// The errors are sent before the handler returns.
+	for len(errs) > 0 {
+		err := <-errs
+		structured, ok := err.(*fswatcher.StructuredError)
+		if !ok {
+			t.Fatalf("expected structured error, got %v", err)
+		}
+		entries = append(entries, structured.KVs["entries"])
+	}
+	// The bad entries do not prevent the following entries from being processed.
+	if rec.Code != http.StatusOK || strings.Join(lines, "|") != "first|last" {
+		t.Fatalf("unexpected status %v and lines %q", rec.Code, lines)
+	}
+	if fmt.Sprint(entries) != "[[1 2]]" {
+		t.Fatalf("expected a single error for entries 1 and 2, got %v", entries)
+	}
+}
+
+func TestWebhookQueueFull(t *testing.T) {
+	c := &v2.InputConfig{
+		Name:                     "queue",
+		Type:                     "webhook",
+		WebhookPath:              "/queue",
+		WebhookFormat:            "text_bulk",
+		WebhookTextBulkSeparator: "\n",
+		WebhookQueueSize:         3,
+		WebhookQueueTimeout:      100 * time.Millisecond,
+	}
+	tail := InitWebhookTailer(c)
+	handler := WebhookHandler(c.WebhookPath)
+	post := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, c.WebhookPath, strings.NewReader(body)))
+		return rec
+	}
+
+	// Nobody reads the lines, so the requests return as soon as the lines are queued.
+	if rec := post("1\n2"); rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %v", rec.Code)
+	}
+	// A request is either queued completely or rejected.
+	rec := post("3\n4")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "1" {
+		t.Fatalf("expected status 429 with Retry-After, got %v %v", rec.Code, rec.Header())
+	}
+	if rec := post("3"); rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %v", rec.Code)
+	}
+	if length := testutil.ToFloat64(webhookQueueLength.WithLabelValues(c.Name)); length != 3 {
+		t.Fatalf("expected queue length 3, got %v", length)
+	}
+
+	// Requests wait for the lines to be processed within the timeout.
+	done := make(chan int)
+	go func() {
+		done <- post("4\n5").Code
+	}()
+	var lines []string
+	for len(lines) < 5 {
+		select {
+		case line := <-tail.Lines():
+			lines = append(lines, line.Line)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout while waiting for lines, got %v", lines)
+		}
+	}
+	if status := <-done; status != http.StatusOK {
+		t.Fatalf("expected status 200, got %v", status)
+	}
+	if strings.Join(lines, "|") != "1|2|3|4|5" {
+		t.Fatalf("unexpected lines %v", lines)
+	}
+
+	// Requests with more lines than the queue size are accepted when the queue is empty.
+	go func() {
+		done <- post("6\n7\n8\n9").Code
+	}()
+	for i := 0; i < 4; i++ {
+		<-tail.Lines()
+	}
+	if status := <-done; status != http.StatusOK {
+		t.Fatalf("expected status 200, got %v", status)
+	}
+	if rejected := testutil.ToFloat64(webhookRejectedLines.WithLabelValues(c.Name)); rejected != 2 {
+		t.Fatalf("expected 2 rejected lines, got %v", rejected)
+	}
+	if requests := testutil.ToFloat64(webhookRequests.WithLabelValues(c.Name, "429")); requests != 1 {
+		t.Fatalf("expected 1 rejected request, got %v", requests)
+	}
+}
+
+// Runs the request and collects the lines sent by the handler.
+// The handler returns when the lines are queued, so the lines are collected until the queue is empty.
+func serveWebhook(handler http.Handler, tail fswatcher.Interface, req *http.Request) (*httptest.ResponseRecorder, []*fswatcher.Line) {
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		handler.ServeHTTP(rec, req)
+		close(done)
+	}()
+	var lines []*fswatcher.Line
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case line := <-tail.Lines():
+			lines = append(lines, line)
+		case <-done:
+			queue := tail.(*WebhookTailer).queue
+			for {
+				queue.mutex.Lock()
+				length := queue.length
+				queue.mutex.Unlock()
+				if length == 0 {
+					return rec, lines
+				}
+				// The length is decremented after the line is received, so it is checked again after a short time.
+				select {
+				case line := <-tail.Lines():
+					lines = append(lines, line)
+				case <-time.After(10 * time.Millisecond):
+				case <-timeout:
+					return rec, lines
+				}
+			}
+		case <-timeout:
+			return rec, lines
+		}
+	}
+}
+
 func createJsonBlob(message string) string {
 	s := fmt.Sprintf(`{
   "message": "%v",
@@ -249,3 +443,131 @@ func createMalformedJsonBlob(message string) string {
 }`, message)
 	return s
 }
+
+func TestWebhookHandler(t *testing.T) {
+	c := &v2.InputConfig{
+		Name:                     "secured",
+		Type:                     "webhook",
+		WebhookPath:              "/secured",
+		WebhookFormat:            "text_bulk",
+		WebhookTextBulkSeparator: "\n",
+		WebhookBearerToken:       "s3cr3t",
+		WebhookMaxBodySize:       64,
+		WebhookQueueSize:         10,
+		WebhookQueueTimeout:      time.Second,
+	}
+	tail := InitWebhookTailer(c)
+	handler := WebhookHandler(c.WebhookPath)
+	go func() {
+		for range tail.Errors() {
+		}
+	}()
+
+	for _, test := range []struct {
+		name           string
+		encoding       string
+		authorization  string
+		body           []byte
+		expectedStatus int
+		expectedLines  []string
+	}{
+		{"plain", "", "Bearer s3cr3t", []byte("line 1\nline 2"), http.StatusOK, []string{"line 1", "line 2"}},
+		{"no token", "", "", []byte("line 1"), http.StatusUnauthorized, nil},
+		{"wrong token", "", "Bearer secret", []byte("line 1"), http.StatusUnauthorized, nil},
+		{"token without scheme", "", "s3cr3t", []byte("line 1"), http.StatusUnauthorized, nil},
+		{"gzip", "gzip", "Bearer s3cr3t", compress(t, "gzip", "line 3"), http.StatusOK, []string{"line 3"}},
+		{"deflate zlib", "deflate", "Bearer s3cr3t", compress(t, "zlib", "line 4"), http.StatusOK, []string{"line 4"}},
+		{"deflate raw", "deflate", "Bearer s3cr3t", compress(t, "deflate", "line 5"), http.StatusOK, []string{"line 5"}},
+		{"too large", "", "Bearer s3cr3t", bytes.Repeat([]byte("x"), 65), http.StatusRequestEntityTooLarge, nil},
+		{"too large decompressed", "gzip", "Bearer s3cr3t", compress(t, "gzip", strings.Repeat("x", 65)), http.StatusRequestEntityTooLarge, nil},
+		{"corrupt gzip", "gzip", "Bearer s3cr3t", []byte("line 6"), http.StatusBadRequest, nil},
+		{"unsupported encoding", "br", "Bearer s3cr3t", []byte("line 7"), http.StatusUnsupportedMediaType, nil},
+	} {
+		req := httptest.NewRequest(http.MethodPost, c.WebhookPath, bytes.NewReader(test.body))
+		if test.encoding != "" {
+			req.Header.Set("Content-Encoding", test.encoding)
+		}
+		if test.authorization != "" {
+			req.Header.Set("Authorization", test.authorization)
+		}
+		rec, received := serveWebhook(handler, tail, req)
+		lines := make([]string, 0)
+		for _, line := range received {
+			lines = append(lines, line.Line)
+		}
+		if rec.Code != test.expectedStatus {
+			t.Errorf("%v: expected status %v, got %v", test.name, test.expectedStatus, rec.Code)
+		}
+		if strings.Join(lines, "|") != strings.Join(test.expectedLines, "|") {
+			t.Errorf("%v: expected lines %q, got %q", test.name, test.expectedLines, lines)
+		}
+	}
+	for status, expected := range map[string]float64{"200": 4, "401": 3, "413": 2, "400": 1, "415": 1} {
+		if actual := testutil.ToFloat64(webhookRequests.WithLabelValues(c.Name, status)); actual != expected {
+			t.Errorf("expected %v requests with status %v, got %v", expected, status, actual)
+		}
+	}
+}
+
+func TestWebhookBasicAuth(t *testing.T) {
+	c := &v2.InputConfig{
+		Name:                     "basic",
+		Type:                     "webhook",
+		WebhookPath:              "/basic",
+		WebhookFormat:            "text_single",
+		WebhookBasicAuthUsername: "shipper",
+		WebhookBasicAuthPassword: "s3cr3t",
+		WebhookQueueSize:         10,
+		WebhookQueueTimeout:      time.Second,
+	}
+	tail := InitWebhookTailer(c)
+	go func() {
+		for range tail.Lines() {
+		}
+	}()
+	for _, test := range []struct {
+		username, password string
+		expectedStatus     int
+	}{
+		{"shipper", "s3cr3t", http.StatusOK},
+		{"shipper", "secret", http.StatusUnauthorized},
+		{"other", "s3cr3t", http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest(http.MethodPost, c.WebhookPath, strings.NewReader("line"))
+		req.SetBasicAuth(test.username, test.password)
+		rec := httptest.NewRecorder()
+		WebhookHandler(c.WebhookPath).ServeHTTP(rec, req)
+		if rec.Code != test.expectedStatus {
+			t.Errorf("%v:%v: expected status %v, got %v", test.username, test.password, test.expectedStatus, rec.Code)
+		}
+		if rec.Code == http.StatusUnauthorized && !strings.HasPrefix(rec.Header().Get("WWW-Authenticate"), "Basic") {
+			t.Errorf("%v:%v: expected basic auth challenge, got %q", test.username, test.password, rec.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
+
+func compress(t *testing.T, format, s string) []byte {
+	var (
+		buf bytes.Buffer
+		w   io.WriteCloser
+		err error
+	)
+	switch format {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "zlib":
+		w = zlib.NewWriter(&buf)
+	case "deflate":
+		w, err = flate.NewWriter(&buf, flate.DefaultCompression)
+	}
+	if err == nil {
+		_, err = w.Write([]byte(s))
+	}
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
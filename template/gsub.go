@@ -18,10 +18,15 @@ import (
 	"fmt"
 	"github.com/sequix/grok_exporter/oniguruma"
 	"os"
+	"sync"
 	"text/template/parse"
 )
 
-var cache = make(map[string]*oniguruma.Regex)
+// Templates are executed by multiple goroutines in parallel, but oniguruma regular expressions are not thread safe.
+var (
+	cache      = make(map[string]*oniguruma.Regex)
+	cacheMutex = &sync.Mutex{}
+)
 
 func newGsubFunc() functionWithValidator {
 	return functionWithValidator{
@@ -31,6 +36,8 @@ func newGsubFunc() functionWithValidator {
 }
 
 func gsub(src, expr, repl string) string {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
 	regex, found := cache[expr] // alternative: compile regex here and call defer regex.Free()
 	if !found {
 		// this cannot happen, because validateGsubCall() was successful
@@ -55,7 +62,9 @@ func validateGsubCall(cmd *parse.CommandNode) error {
 		if err != nil {
 			return fmt.Errorf("%v: '%v' is not a valid regular expression: %v", prefix, stringNode.Text, err)
 		}
+		cacheMutex.Lock()
 		cache[stringNode.Text] = regex
+		cacheMutex.Unlock()
 	} else {
 		// The regular expression should be a string, everything else is probably an error.
 		return fmt.Errorf("%v: second parameter is not a valid regular expression", prefix)
@@ -0,0 +1,153 @@
+// Copyright 2016-2018 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/sequix/grok_exporter/config/v2"
+	"github.com/sequix/grok_exporter/exporter"
+	"github.com/sequix/grok_exporter/tailer/fswatcher"
+)
+
+const workerQueueSize = 100
+
+// Matches log lines against the metrics in parallel.
+// Lines are distributed by input and file name, so all lines of a file are processed in order by the same worker.
+// This is required for gauges and for delete_match, where the order of the lines matters.
+type workerPool struct {
+	workers []*worker
+	wg      sync.WaitGroup
+}
+
+type worker struct {
+	// The metrics share their collectors with the other workers, but have their own regular expressions.
+	metrics []*exporter.PathMetric
+	lines   chan *fswatcher.Line
+}
+
+// The first worker uses the metrics as they are, the other workers get copies with newly compiled regular expressions.
+func newWorkerPool(cfg *v2.Config, patterns *exporter.Patterns, metrics []*exporter.PathMetric) (*workerPool, error) {
+	pool := &workerPool{
+		workers: make([]*worker, 0, cfg.Global.MatchingWorkers),
+	}
+	for i := 0; i < cfg.Global.MatchingWorkers; i++ {
+		workerMetrics := metrics
+		if i > 0 {
+			workerMetrics = make([]*exporter.PathMetric, 0, len(metrics))
+			for j, m := range cfg.Metrics {
+				regex, deleteRegex, err := compileRegexes(m, patterns)
+				if err != nil {
+					return nil, err
+				}
+				workerMetrics = append(workerMetrics, metrics[j].WithRegex(regex, deleteRegex))
+			}
+		}
+		pool.workers = append(pool.workers, &worker{
+			metrics: workerMetrics,
+			lines:   make(chan *fswatcher.Line, workerQueueSize),
+		})
+	}
+	return pool, nil
+}
+
+func (p *workerPool) start(selfMonitoring *selfMonitoring, logger logrus.FieldLogger) {
+	for _, w := range p.workers {
+		p.wg.Add(1)
+		go func(w *worker) {
+			defer p.wg.Done()
+			for line := range w.lines {
+				processLine(line, w.metrics, selfMonitoring, logger)
+			}
+		}(w)
+	}
+}
+
+// Blocks if the worker responsible for the line's file is busy.
+func (p *workerPool) process(line *fswatcher.Line) {
+	p.workerFor(line).lines <- line
+}
+
+func (p *workerPool) workerFor(line *fswatcher.Line) *worker {
+	if len(p.workers) == 1 {
+		return p.workers[0]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(line.Input))
+	h.Write([]byte(line.File))
+	return p.workers[h.Sum32()%uint32(len(p.workers))]
+}
+
+// Waits until all lines that were passed to process() are processed.
+func (p *workerPool) stop() {
+	for _, w := range p.workers {
+		close(w.lines)
+	}
+	p.wg.Wait()
+}
+
+func processLine(line *fswatcher.Line, metrics []*exporter.PathMetric, selfMonitoring *selfMonitoring, logger logrus.FieldLogger) {
+	matched := false
+	lineFields := exporter.WithPathField(line.Fields, line.File)
+	for _, metric := range metrics {
+		start := time.Now()
+		if !metric.MatchInput(line.Input) || !metric.MatchPath(line.File) {
+			continue
+		}
+		fields, ok := metric.PathFields(line.File, lineFields)
+		if !ok {
+			continue
+		}
+		// The filter only applies to match, lines that are filtered out may still delete time series with delete_match.
+		if metric.MatchFilter(line.Line, fields) {
+			match, err := metric.ProcessMatch(line.Line, fields)
+			if err != nil {
+				logger.WithFields(map[string]interface{}{
+					"line": line.Line,
+					"err":  err,
+				}).Warn("process matching, skip log line")
+				selfMonitoring.nErrorsByMetric.WithLabelValues(metric.Name(), line.Input).Inc()
+			}
+			if match != nil {
+				selfMonitoring.nMatchesByMetric.WithLabelValues(metric.Name(), line.Input).Inc()
+				selfMonitoring.procTimeMicrosecondsByMetric.WithLabelValues(metric.Name(), line.Input).Add(float64(time.Since(start).Nanoseconds() / int64(1000)))
+				if match.SeriesDropped > 0 {
+					selfMonitoring.nSeriesDroppedByMetric.WithLabelValues(metric.Name(), line.Input).Add(float64(match.SeriesDropped))
+				}
+				matched = true
+			}
+		} else {
+			selfMonitoring.nFilteredByMetric.WithLabelValues(metric.Name(), line.Input).Inc()
+		}
+		_, err := metric.ProcessDeleteMatch(line.Line, fields)
+		if err != nil {
+			logger.WithFields(map[string]interface{}{
+				"line": line.Line,
+				"err":  err,
+			}).Warn("process delete match, skip log line")
+			selfMonitoring.nErrorsByMetric.WithLabelValues(metric.Name(), line.Input).Inc()
+		}
+		// TODO: create metric to monitor number of matching delete_patterns
+	}
+	if matched {
+		selfMonitoring.nLinesTotal.WithLabelValues(number_of_lines_matched_label, line.Input).Inc()
+	} else {
+		selfMonitoring.nLinesTotal.WithLabelValues(number_of_lines_ignored_label, line.Input).Inc()
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2016-2018 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/sequix/grok_exporter/config"
+	"github.com/sequix/grok_exporter/config/v2"
+	"github.com/sequix/grok_exporter/exporter"
+	"github.com/sequix/grok_exporter/tailer/fswatcher"
+)
+
+const workerTestConfig = `
+global:
+    config_version: 2
+    matching_workers: %v
+input:
+    type: webhook
+grok:
+    additional_patterns:
+    - 'NAME \w+'
+metrics:
+    - type: counter
+      name: logins_total
+      help: Logins by user.
+      match: 'login %%{NAME:user}'
+      labels:
+          user: '{{.user}}'
+      delete_match: 'logout %%{NAME:user}'
+      delete_labels:
+          user: '{{.user}}'
+      filter:
+          contains:
+          - 'login'
+`
+
+var (
+	testSelfMonitoring     *selfMonitoring
+	initTestSelfMonitoring sync.Once
+)
+
+func TestFilterDoesNotSkipDeleteMatch(t *testing.T) {
+	cfg, patterns, metrics := createTestMetrics(t, 1)
+	processTestLines(t, cfg, patterns, metrics, "login alice", "login bob")
+	if n := testutil.CollectAndCount(metrics[0].Collector()); n != 2 {
+		t.Fatalf("expected 2 time series, but got %v", n)
+	}
+	// The filter skips the match pattern, but the line still deletes alice's time series.
+	processTestLines(t, cfg, patterns, metrics, "logout alice")
+	if n := testutil.CollectAndCount(metrics[0].Collector()); n != 1 {
+		t.Fatalf("expected 1 time series after alice logged out, but got %v", n)
+	}
+}
+
+// Each file's user logs in and out repeatedly. If a worker processed the lines of a file out of order,
+// the last login would be deleted or counted more than once.
+func TestWorkersKeepLineOrderPerFile(t *testing.T) {
+	cfg, patterns, metrics := createTestMetrics(t, 4)
+	workers := newTestWorkerPool(t, cfg, patterns, metrics)
+	usedWorkers := make(map[*worker]bool)
+	lines := make([]*fswatcher.Line, 0)
+	for i := 0; i < 100; i++ {
+		for f := 0; f < 8; f++ {
+			file := fmt.Sprintf("test%v.log", f)
+			for _, line := range []string{"login user%v", "logout user%v", "login user%v"} {
+				lines = append(lines, &fswatcher.Line{Line: fmt.Sprintf(line, f), File: file, Input: "webhook"})
+			}
+		}
+	}
+	for _, line := range lines {
+		usedWorkers[workers.workerFor(line)] = true
+	}
+	if len(usedWorkers) < 2 {
+		t.Fatalf("expected the files to be distributed across workers, but all lines went to %v worker", len(usedWorkers))
+	}
+	workers.start(testSelfMonitoring, testLogger())
+	for _, line := range lines {
+		workers.process(line)
+	}
+	workers.stop()
+	if n := testutil.CollectAndCount(metrics[0].Collector()); n != 8 {
+		t.Fatalf("expected 8 time series, but got %v", n)
+	}
+	counterVec := metrics[0].Collector().(*prometheus.CounterVec)
+	for f := 0; f < 8; f++ {
+		if value := testutil.ToFloat64(counterVec.WithLabelValues(fmt.Sprintf("user%v", f))); value != 1 {
+			t.Fatalf("expected 1 login of user%v after the last logout, but got %v", f, value)
+		}
+	}
+}
+
+func TestWorkersUseOwnRegex(t *testing.T) {
+	cfg, patterns, metrics := createTestMetrics(t, 3)
+	workers := newTestWorkerPool(t, cfg, patterns, metrics)
+	for i, w := range workers.workers {
+		for j, m := range w.metrics {
+			if i == 0 && m != metrics[j] || i > 0 && m == metrics[j] {
+				t.Fatalf("worker %v: expected only the first worker to use the original metric %v", i, m.Name())
+			}
+			if m.Collector() != metrics[j].Collector() {
+				t.Fatalf("worker %v: expected metric %v to share the collector with the original metric", i, m.Name())
+			}
+		}
+	}
+}
+
+func createTestMetrics(t *testing.T, matchingWorkers int) (*v2.Config, *exporter.Patterns, []*exporter.PathMetric) {
+	cfg, _, err := config.LoadConfigString([]byte(fmt.Sprintf(workerTestConfig, matchingWorkers)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	patterns, err := initPatterns(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics, err := createMetrics(cfg, patterns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg, patterns, metrics
+}
+
+// Processes the lines of the webhook input with a new worker pool, and waits until all lines are processed.
+func processTestLines(t *testing.T, cfg *v2.Config, patterns *exporter.Patterns, metrics []*exporter.PathMetric, lines ...string) {
+	workers := newTestWorkerPool(t, cfg, patterns, metrics)
+	workers.start(testSelfMonitoring, testLogger())
+	for _, line := range lines {
+		workers.process(&fswatcher.Line{Line: line, File: "test.log", Input: "webhook"})
+	}
+	workers.stop()
+}
+
+func newTestWorkerPool(t *testing.T, cfg *v2.Config, patterns *exporter.Patterns, metrics []*exporter.PathMetric) *workerPool {
+	initTestSelfMonitoring.Do(func() {
+		testSelfMonitoring = initSelfMonitoring(nil, nil)
+	})
+	workers, err := newWorkerPool(cfg, patterns, metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return workers
+}